@@ -0,0 +1,43 @@
+package main
+
+import (
+	"caching-proxy/internal/cache"
+	"caching-proxy/internal/health"
+	"caching-proxy/internal/proxy"
+	"net/http"
+	"sync/atomic"
+)
+
+// handleHealth registers the liveness and readiness probes on mux. The proxy
+// is ready while listening is set, redis lets commands through and at least
+// one origin can take requests.
+func handleHealth(mux *http.ServeMux, listening *atomic.Bool, c *cache.Cache, p *proxy.Proxy) {
+	mux.HandleFunc("GET /healthz", health.Handler(health.Component{
+		Name:  "process",
+		Check: func() (bool, string) { return true, "" },
+	}))
+	mux.HandleFunc("GET /readyz", health.Handler(
+		health.Component{
+			Name: "listener",
+			Check: func() (bool, string) {
+				if listening.Load() {
+					return true, ""
+				}
+				return false, "shutting down"
+			},
+		},
+		health.Component{
+			Name:  "redis",
+			Check: c.RedisReady,
+		},
+		health.Component{
+			Name: "origins",
+			Check: func() (bool, string) {
+				if p.OriginsReady() {
+					return true, ""
+				}
+				return false, "no healthy origin"
+			},
+		},
+	))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"caching-proxy/internal/cache"
+	"caching-proxy/internal/config"
+	"caching-proxy/internal/health"
+	"caching-proxy/internal/proxy"
+	"caching-proxy/internal/upstream"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingRedis accepts redis connections, answers PING and fails every other
+// command.
+func failingRedis(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					name, err := readCommand(r)
+					if err != nil {
+						return
+					}
+					reply := "-ERR failing\r\n"
+					if name == "ping" {
+						reply = "+PONG\r\n"
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// readCommand reads a command sent as an array of bulk strings and returns
+// its name.
+func readCommand(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	var args []string
+	for range n {
+		if _, err := r.ReadString('\n'); err != nil {
+			return "", err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		args = append(args, strings.TrimSpace(arg))
+	}
+	if len(args) == 0 {
+		return "", nil
+	}
+	return strings.ToLower(args[0]), nil
+}
+
+func TestReadyz_RedisFailing(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	// the default settings disable the origin breakers
+	cfg := config.NewConfig()
+	breakerConfig := upstream.BreakerConfig{
+		Window:           cfg.CircuitBreaker.Window,
+		MinRequests:      cfg.CircuitBreaker.MinRequests,
+		ErrorRate:        cfg.CircuitBreaker.ErrorRate,
+		OpenTime:         time.Duration(cfg.CircuitBreaker.OpenTime),
+		HalfOpenRequests: cfg.CircuitBreaker.HalfOpenRequests,
+	}
+	c := cache.New(&cache.CacheConfig{
+		TTL:          time.Minute,
+		Capacity:     10,
+		RedisAddr:    failingRedis(t),
+		RedisBreaker: upstream.NewBreaker("redis", redisBreakerConfig(breakerConfig)),
+	})
+	defer c.Close(context.Background())
+
+	var listening atomic.Bool
+	listening.Store(true)
+	mux := http.NewServeMux()
+	handleHealth(mux, &listening, c, &proxy.Proxy{Origin: origin.URL})
+
+	for i := range cfg.CircuitBreaker.MinRequests {
+		if _, ok := c.Get(context.Background(), "GETexample.com/"+strconv.Itoa(i)); ok {
+			t.Fatalf("expected a miss while redis fails")
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	var report health.Report
+	if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if got := report.Components["redis"]; got.Status != health.StatusDown || got.Detail != upstream.BreakerOpen.String() {
+		t.Errorf("expected redis down with an open breaker, got %+v", got)
+	}
+}
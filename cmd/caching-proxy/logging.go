@@ -0,0 +1,36 @@
+package main
+
+import (
+	"caching-proxy/internal/config"
+	"caching-proxy/internal/logging"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// newAccessLog opens the access log configured in cfg, or returns nil when
+// it is disabled.
+func newAccessLog(cfg config.AccessLog) (*logging.AccessLog, error) {
+	var w io.Writer
+	switch cfg.Output {
+	case "":
+		return nil, nil
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(cfg.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return logging.NewAccessLog(w, cfg.Format, cfg.SampleHits)
+}
@@ -1,65 +1,377 @@
 package main
 
 import (
+	"caching-proxy/internal/admin"
 	"caching-proxy/internal/cache"
 	"caching-proxy/internal/config"
+	"caching-proxy/internal/logging"
+	"caching-proxy/internal/metrics"
 	"caching-proxy/internal/proxy"
+	"caching-proxy/internal/upstream"
 	"context"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 func main() {
-	port := flag.String("port", "8080", "port to listen on")
-	origin := flag.String("origin", "", "origin host")
+	flag.String("port", "8080", "port to listen on, overrides server.port")
+	flag.String("origin", "", "origin host, overrides upstream.origin")
 	clearCache := flag.Bool("clear-cache", false, "clear cache")
 	configFile := flag.String("config", "config.yaml", "config file")
+	printConfig := flag.Bool("print-config", false, "print the effective config and where each value comes from, then exit")
 	flag.Parse()
 
-	if *origin == "" && !*clearCache {
-		log.Fatal("origin server URL is required")
+	cfg, err := loadConfig(*configFile, flag.CommandLine)
+	if *printConfig && cfg != nil {
+		// printed before the problems, to show where the invalid values come from
+		if err := cfg.PrintSources(os.Stdout); err != nil {
+			fatal("printing the config", err)
+		}
 	}
-
-	cfg := config.NewConfig()
-	if err := config.OverrideFromConfigYAML(cfg, *configFile); err != nil {
-		log.Fatal(err)
-		return
+	if err != nil {
+		fatal("loading the config", err)
 	}
-	if err := config.OverrideFromEnvironment(cfg); err != nil {
-		log.Fatal(err)
+	if *printConfig {
 		return
 	}
 
+	logger, err := logging.New(os.Stderr, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		fatal("setting up logging", err)
+	}
+	slog.SetDefault(logger)
+
+	if cfg.Upstream.Origin == "" && len(cfg.Routes) == 0 && !*clearCache {
+		fatal("starting", errors.New("origin server URL is required"))
+	}
+
+	breakerConfig := upstream.BreakerConfig{
+		Window:           cfg.CircuitBreaker.Window,
+		MinRequests:      cfg.CircuitBreaker.MinRequests,
+		ErrorRate:        cfg.CircuitBreaker.ErrorRate,
+		SlowCall:         time.Duration(cfg.CircuitBreaker.SlowCall),
+		SlowCallRate:     cfg.CircuitBreaker.SlowCallRate,
+		OpenTime:         time.Duration(cfg.CircuitBreaker.OpenTime),
+		HalfOpenRequests: cfg.CircuitBreaker.HalfOpenRequests,
+	}
+
 	cacheInstance := cache.New(
 		&cache.CacheConfig{
 			TTL:           time.Duration(cfg.Cache.TTL),
+			StaleTTL:      time.Duration(cfg.Cache.StaleTTL),
 			Capacity:      cfg.Cache.Capacity,
 			RedisAddr:     cfg.Cache.Redis.Addr,
 			RedisDB:       cfg.Cache.Redis.DB,
 			RedisPwd:      cfg.Cache.Redis.Password,
 			RedisUsername: cfg.Cache.Redis.Username,
+			RedisBreaker:  upstream.NewBreaker("redis", redisBreakerConfig(breakerConfig)),
+			CompileBan:    proxy.CompileBan,
+
+			Compression:        cfg.Cache.Compression.Algorithm,
+			CompressionMinSize: cfg.Cache.Compression.MinSize,
+			CompressionTypes:   cfg.Cache.Compression.ContentTypes,
 		})
 
 	if *clearCache {
 		if err := cacheInstance.RemoveAll(context.Background()); err != nil {
-			log.Fatal(err)
-			return
+			fatal("clearing the cache", err)
+		}
+		closeCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Server.ShutdownTimeout))
+		defer cancel()
+		if err := cacheInstance.Close(closeCtx); err != nil {
+			fatal("closing the cache", err)
 		}
-		log.Println("Cache cleared")
+		slog.Info("cache cleared")
 		return
 	}
 
-	proxy := proxy.Proxy{
-		Origin:     *origin,
-		HttpClient: &http.Client{},
-		Cache:      cacheInstance,
+	trustedProxies, err := proxy.ParseTrustedProxies(cfg.Forwarding.TrustedProxies)
+	if err != nil {
+		fatal("parsing the trusted proxies", err)
+	}
+
+	purge, err := proxy.NewPurgePolicy(cfg.Purge.Allow, cfg.Purge.Tokens)
+	if err != nil {
+		fatal("parsing the purge policy", err)
+	}
+
+	accessLog, err := newAccessLog(cfg.Log.Access)
+	if err != nil {
+		fatal("opening the access log", err)
+	}
+
+	exporter, err := startTracing(cfg.Tracing)
+	if err != nil {
+		fatal("starting tracing", err)
+	}
+	cleanup := cacheInstance.Close
+	if exporter != nil {
+		cleanup = func(ctx context.Context) error {
+			return errors.Join(cacheInstance.Close(ctx), exporter.Shutdown(ctx))
+		}
+	}
+
+	breakers := upstream.NewBreakers(breakerConfig)
+
+	transport := upstream.NewTransport(upstream.TransportConfig{
+		ConnectTimeout:        time.Duration(cfg.Upstream.ConnectTimeout),
+		TLSHandshakeTimeout:   time.Duration(cfg.Upstream.TLSTimeout),
+		ResponseHeaderTimeout: time.Duration(cfg.Upstream.HeaderTimeout),
+		IdleConnTimeout:       time.Duration(cfg.Upstream.IdleConnTimeout),
+		MaxIdleConnsPerHost:   cfg.Upstream.MaxIdleConnsPerHost,
+	})
+
+	routes, pools, err := newRoutes(cfg.Routes, breakers, transport, nil)
+	if err != nil {
+		fatal("creating the routes", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	p := proxy.Proxy{
+		Origin: cfg.Upstream.Origin,
+		HttpClient: &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(cfg.Upstream.Timeout),
+		},
+		Cache:    cacheInstance,
+		Routes:   routes,
+		Breakers: breakers,
+		Retry: proxy.RetryPolicy{
+			Attempts:   cfg.Upstream.Retries,
+			Backoff:    time.Duration(cfg.Upstream.RetryBackoff),
+			MaxBackoff: time.Duration(cfg.Upstream.RetryMaxBackoff),
+			Budget:     upstream.NewRetryBudget(cfg.Upstream.RetryBudget, cfg.Upstream.RetryBurst),
+		},
+
+		MaxObjectSize:  cfg.Cache.MaxObjectSize,
+		RangeChunkSize: cfg.Cache.RangeChunkSize,
+		TrustedProxies: trustedProxies,
+		Purge:          purge,
+		Coalesce:       cfg.Cache.Coalesce,
+		AccessLog:      accessLog,
+		ServerTiming:   cfg.ServerTiming.Enabled,
+		DebugTokens:    cfg.ServerTiming.Tokens,
+	}
+	if len(cfg.Compression.Encodings) > 0 {
+		p.Compression = &proxy.Compression{
+			Encodings:    cfg.Compression.Encodings,
+			MinSize:      cfg.Compression.MinSize,
+			ContentTypes: cfg.Compression.ContentTypes,
+		}
+	}
+
+	registerMetrics(cacheInstance, breakers)
+
+	rl := &reloader{file: *configFile, flags: flag.CommandLine, proxy: &p, breakers: breakers, transport: transport}
+	rl.swap(ctx, cfg, routes, pools)
+	go rl.run(ctx, time.Duration(cfg.Server.WatchInterval))
+
+	var listening atomic.Bool
+	mux := http.NewServeMux()
+	handleHealth(mux, &listening, cacheInstance, &p)
+	mux.HandleFunc("/", p.Handler())
+	srv := &http.Server{Handler: mux}
+	srv.RegisterOnShutdown(func() { listening.Store(false) })
+
+	ln, err := net.Listen("tcp", ":"+cfg.Server.Port)
+	if err != nil {
+		fatal("listening", err)
+	}
+	// the admin API and the metrics are served next to the proxy, and drain
+	// at the same time on shutdown
+	var servers sync.WaitGroup
+	serveErrs := make(chan error, 2)
+	serveBackground := func(name string, ln net.Listener, handler http.Handler) {
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			srv := &http.Server{Handler: handler}
+			noop := func(context.Context) error { return nil }
+			if err := serve(ctx, srv, ln, time.Duration(cfg.Server.ShutdownTimeout), noop); err != nil {
+				slog.Error("serving the "+name, "error", err)
+				serveErrs <- fmt.Errorf("serving the %s: %w", name, err)
+			}
+		}()
+	}
+	if cfg.Admin.Addr != "" {
+		adminServer := &admin.Server{
+			Token:    cfg.Admin.Token,
+			Cache:    cacheInstance,
+			Breakers: breakers,
+			Config:   rl.config,
+			Metrics:  metrics.Handler(),
+			Debug:    cfg.Admin.Debug,
+		}
+		adminLn, err := net.Listen("tcp", cfg.Admin.Addr)
+		if err != nil {
+			fatal("listening for the admin API", err)
+		}
+		slog.Info("admin API listening", "addr", cfg.Admin.Addr)
+		serveBackground("admin API", adminLn, adminServer.Handler())
+	}
+	if cfg.Metrics.Addr != "" {
+		metricsLn, err := net.Listen("tcp", cfg.Metrics.Addr)
+		if err != nil {
+			fatal("listening for the metrics", err)
+		}
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", metrics.Handler())
+		slog.Info("metrics listening", "addr", cfg.Metrics.Addr)
+		serveBackground("metrics", metricsLn, metricsMux)
+	}
+
+	slog.Info("proxy listening", "port", cfg.Server.Port)
+	listening.Store(true)
+	err = serve(ctx, srv, ln, time.Duration(cfg.Server.ShutdownTimeout), cleanup)
+	servers.Wait()
+	close(serveErrs)
+	for serveErr := range serveErrs {
+		err = errors.Join(err, serveErr)
 	}
+	if err != nil {
+		fatal("serving", err)
+	}
+}
+
+// defaultRedisErrorRate opens the redis breaker when the origin breakers
+// are disabled.
+const defaultRedisErrorRate = 0.5
+
+// redisBreakerConfig returns the settings of the redis circuit breaker, those
+// of the origins with an error rate even when they disable the breakers: a
+// failing redis must degrade the cache to memory and show in /readyz.
+func redisBreakerConfig(cfg upstream.BreakerConfig) upstream.BreakerConfig {
+	if cfg.ErrorRate == 0 {
+		cfg.ErrorRate = defaultRedisErrorRate
+	}
+	return cfg
+}
 
-	log.Printf("ListenAndServe on port %s ...", *port)
-	http.HandleFunc("/", proxy.Handler())
-	if err := http.ListenAndServe(":"+*port, nil); err != nil {
-		log.Fatal(err)
+// serve serves HTTP requests on ln until ctx is done, then stops accepting
+// connections and drains the active requests for up to timeout. Once they
+// are done, or the timeout has passed, it calls cleanup with what is left of
+// the timeout.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, timeout time.Duration, cleanup func(context.Context) error) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down, draining active requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("draining active requests", "error", err)
+		srv.Close()
+	}
+	if err := cleanup(shutdownCtx); err != nil {
+		slog.Error("flushing the cache and the traces", "error", err)
+	}
+	slog.Info("shutdown complete")
+	return nil
+}
+
+// routePool is the origin pool of a route and the settings it was built
+// from, so a reload can keep it when they did not change.
+type routePool struct {
+	cfg  upstream.Config
+	pool *upstream.Pool
+	// stop ends the health checks, nil until they are started
+	stop context.CancelFunc
+}
+
+// newRoutes converts the configured routes into proxy routes, whose health
+// checks are sent over transport. A route whose pool settings match one of
+// previous keeps that pool, with its health and ejection state.
+func newRoutes(cfgRoutes []config.Route, breakers *upstream.Breakers, transport http.RoundTripper, previous []*routePool) ([]*proxy.Route, []*routePool, error) {
+	routes := make([]*proxy.Route, 0, len(cfgRoutes))
+	pools := make([]*routePool, 0, len(cfgRoutes))
+	for i, r := range cfgRoutes {
+		origins := r.Origins
+		if r.Origin != "" {
+			origins = append([]string{r.Origin}, origins...)
+		}
+		poolConfig := upstream.Config{
+			Origins:  origins,
+			Balancer: r.Balancer,
+			HealthCheck: upstream.HealthCheck{
+				Path:               r.HealthCheck.Path,
+				Interval:           time.Duration(r.HealthCheck.Interval),
+				Timeout:            time.Duration(r.HealthCheck.Timeout),
+				HealthyThreshold:   r.HealthCheck.HealthyThreshold,
+				UnhealthyThreshold: r.HealthCheck.UnhealthyThreshold,
+			},
+			OutlierDetection: upstream.OutlierDetection{
+				ConsecutiveFailures: r.OutlierDetection.ConsecutiveFailures,
+				EjectionTime:        time.Duration(r.OutlierDetection.EjectionTime),
+			},
+			Breakers:  breakers,
+			Transport: transport,
+		}
+		rp := reusePool(previous, pools, poolConfig)
+		if rp == nil {
+			pool, err := upstream.NewPool(poolConfig)
+			if err != nil {
+				return nil, nil, fmt.Errorf("routes[%d]: %s", i, err)
+			}
+			rp = &routePool{cfg: poolConfig, pool: pool}
+		}
+		pools = append(pools, rp)
+		var bypass bool
+		switch r.CachePolicy {
+		case "", "cache":
+		case "bypass":
+			bypass = true
+		default:
+			return nil, nil, fmt.Errorf("routes[%d]: unknown cache_policy %q", i, r.CachePolicy)
+		}
+		routes = append(routes, &proxy.Route{
+			Name:       r.Name,
+			Host:       r.Host,
+			PathPrefix: r.PathPrefix,
+			Pool:       rp.pool,
+			TTL:        time.Duration(r.TTL),
+			Bypass:     bypass,
+			RequestHeaders: proxy.HeaderRules{
+				Set:    r.RequestHeaders.Set,
+				Remove: r.RequestHeaders.Remove,
+			},
+			ResponseHeaders: proxy.HeaderRules{
+				Set:    r.ResponseHeaders.Set,
+				Remove: r.ResponseHeaders.Remove,
+			},
+		})
+	}
+	return routes, pools, nil
+}
+
+// reusePool returns the pool of previous built from cfg that is not taken
+// yet, or nil.
+func reusePool(previous, taken []*routePool, cfg upstream.Config) *routePool {
+	for _, rp := range previous {
+		if !slices.Contains(taken, rp) && reflect.DeepEqual(rp.cfg, cfg) {
+			return rp
+		}
 	}
+	return nil
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -86,3 +88,65 @@ func TestMainFunction(t *testing.T) {
 	}
 
 }
+
+func TestServe_DrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("drained"))
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cleanedUp := make(chan struct{})
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, srv, ln, 5*time.Second, func(context.Context) error {
+			close(cleanedUp)
+			return nil
+		})
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/slow")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{body: string(body), err: err}
+	}()
+
+	// shut down while the request is in flight
+	<-started
+	cancel()
+
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("expected in-flight request to complete, got %v", res.err)
+	}
+	if res.body != "drained" {
+		t.Errorf("expected body %q, got %q", "drained", res.body)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	select {
+	case <-cleanedUp:
+	default:
+		t.Errorf("expected cleanup to be called")
+	}
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Errorf("expected listener to be closed")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"caching-proxy/internal/cache"
+	"caching-proxy/internal/metrics"
+	"caching-proxy/internal/upstream"
+)
+
+// registerMetrics exposes the state of the cache and of the circuit breakers.
+func registerMetrics(c *cache.Cache, breakers *upstream.Breakers) {
+	metrics.Default.NewGaugeFunc("caching_proxy_cache_items", "Items in the in-memory cache.", nil,
+		func(observe func(float64, ...string)) {
+			observe(float64(c.Stats().Items))
+		})
+	metrics.Default.NewGaugeFunc("caching_proxy_cache_bytes", "Size of the bodies in the in-memory cache.", nil,
+		func(observe func(float64, ...string)) {
+			observe(float64(c.Stats().Bytes))
+		})
+	metrics.Default.NewCounterFunc("caching_proxy_cache_evictions_total",
+		"Items dropped from the in-memory cache by reason: capacity, expired, purge or ban.", []string{"reason"},
+		func(observe func(float64, ...string)) {
+			evictions := c.Stats().Evictions
+			for _, reason := range []string{"capacity", "expired", "purge", "ban"} {
+				observe(float64(evictions[reason]), reason)
+			}
+		})
+
+	states := []upstream.BreakerState{upstream.BreakerClosed, upstream.BreakerOpen, upstream.BreakerHalfOpen}
+	metrics.Default.NewGaugeFunc("caching_proxy_circuit_breaker_state",
+		"State of the circuit breaker of every origin, 1 for the current state.", []string{"origin", "state"},
+		func(observe func(float64, ...string)) {
+			for _, status := range breakers.Status() {
+				for _, state := range states {
+					v := 0.0
+					if status.State == state.String() {
+						v = 1
+					}
+					observe(v, status.Origin, state.String())
+				}
+			}
+		})
+}
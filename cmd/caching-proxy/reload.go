@@ -0,0 +1,137 @@
+package main
+
+import (
+	"caching-proxy/internal/config"
+	"caching-proxy/internal/logging"
+	"caching-proxy/internal/proxy"
+	"caching-proxy/internal/upstream"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// loadConfig returns the defaults overridden by file, the environment and
+// the flags set in fs. An invalid result is returned along with every
+// problem found, so its sources can still be printed.
+func loadConfig(file string, fs *flag.FlagSet) (*config.Config, error) {
+	cfg := config.NewConfig()
+	if err := config.OverrideFromConfigYAML(cfg, file); err != nil {
+		return nil, err
+	}
+	if err := config.OverrideFromEnvironment(cfg); err != nil {
+		return nil, err
+	}
+	config.OverrideFromFlags(cfg, fs)
+	return cfg, cfg.Validate()
+}
+
+// reloader swaps the routes, the cache TTL and the log level of a running
+// proxy when the config file changes. The other settings need a restart.
+type reloader struct {
+	file     string
+	flags    *flag.FlagSet // keep overriding the reloaded file
+	proxy    *proxy.Proxy
+	breakers *upstream.Breakers
+	// transport sends the health checks of the routes
+	transport http.RoundTripper
+
+	// pools are the origin pools of the routes in use
+	pools   []*routePool
+	current atomic.Pointer[config.Config]
+}
+
+// swap starts the health checks of the new pools and makes the proxy use
+// routes, together with the TTL of cfg. The pools no route uses anymore
+// are stopped.
+func (rl *reloader) swap(ctx context.Context, cfg *config.Config, routes []*proxy.Route, pools []*routePool) {
+	for _, rp := range pools {
+		if rp.stop == nil {
+			poolCtx, stop := context.WithCancel(ctx)
+			rp.pool.Start(poolCtx)
+			rp.stop = stop
+		}
+	}
+	rl.proxy.Reload(routes, time.Duration(cfg.Cache.TTL))
+	applied := cfg
+	if current := rl.current.Load(); current != nil {
+		applied = current.WithReloaded(cfg)
+	}
+	rl.current.Store(applied)
+	for _, rp := range rl.pools {
+		if !slices.Contains(pools, rp) {
+			rp.stop()
+		}
+	}
+	rl.pools = pools
+}
+
+// config returns the configuration in effect: the one the proxy started
+// with, updated with the routes, the TTL and the log level of the reloads.
+func (rl *reloader) config() *config.Config {
+	return rl.current.Load()
+}
+
+// reload re-reads the config file and swaps it in, unless it is invalid.
+func (rl *reloader) reload(ctx context.Context) error {
+	if _, err := os.Stat(rl.file); err != nil {
+		return err
+	}
+	cfg, err := loadConfig(rl.file, rl.flags)
+	if err != nil {
+		return err
+	}
+	if rl.proxy.Origin == "" && len(cfg.Routes) == 0 {
+		return errors.New("origin server URL is required")
+	}
+	routes, pools, err := newRoutes(cfg.Routes, rl.breakers, rl.transport, rl.pools)
+	if err != nil {
+		return err
+	}
+	if err := logging.SetLevel(cfg.Log.Level); err != nil {
+		return err
+	}
+	rl.swap(ctx, cfg, routes, pools)
+	return nil
+}
+
+// run reloads the config on SIGHUP and, if interval is not 0, when the file
+// changes, until ctx is done.
+func (rl *reloader) run(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	changed := make(chan struct{}, 1)
+	if interval > 0 {
+		go config.Watch(ctx, rl.file, interval, func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("received SIGHUP, reloading", "file", rl.file)
+		case <-changed:
+			slog.Info("config file changed, reloading", "file", rl.file)
+		}
+		if err := rl.reload(ctx); err != nil {
+			slog.Error("rejecting invalid config, keeping the current one", "file", rl.file, "error", err)
+			continue
+		}
+		slog.Info("config reloaded", "file", rl.file)
+	}
+}
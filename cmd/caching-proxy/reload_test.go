@@ -0,0 +1,145 @@
+package main
+
+import (
+	"caching-proxy/internal/cache"
+	"caching-proxy/internal/config"
+	"caching-proxy/internal/proxy"
+	"context"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloader_Reload(t *testing.T) {
+	newOrigin := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+	}
+	a := newOrigin("a")
+	defer a.Close()
+	b := newOrigin("b")
+	defer b.Close()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(content string) {
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &proxy.Proxy{
+		HttpClient: &http.Client{},
+		Cache:      cache.New(&cache.CacheConfig{TTL: time.Minute, Capacity: 10}),
+	}
+	rl := &reloader{file: file, proxy: p}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		body, _ := io.ReadAll(w.Result().Body)
+		return string(body)
+	}
+
+	writeConfig("routes:\n  - path_prefix: /\n    origin: " + a.URL + "\n    cache_policy: bypass\n")
+	if err := rl.reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if body := get("/test"); body != "a" {
+		t.Errorf("expected body %q, got %q", "a", body)
+	}
+
+	writeConfig("routes:\n  - path_prefix: /\n    origin: " + b.URL + "\n    cache_policy: bypass\n")
+	if err := rl.reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if body := get("/test"); body != "b" {
+		t.Errorf("expected body %q, got %q", "b", body)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "invalid yaml", content: "routes: [\n"},
+		{name: "unknown balancer", content: "routes:\n  - origin: " + a.URL + "\n    balancer: random\n"},
+		{name: "no origin", content: "cache:\n  ttl: 1m\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeConfig(tt.content)
+			if err := rl.reload(ctx); err == nil {
+				t.Errorf("expected the config to be rejected")
+			}
+			if body := get("/test"); body != "b" {
+				t.Errorf("expected the previous routes to stay, got body %q", body)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("cache:\n  ttl: 0s\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(file, flag.NewFlagSet("test", flag.ContinueOnError))
+	if err == nil {
+		t.Fatal("expected an error for a zero cache.ttl")
+	}
+	// the invalid configuration is still returned to print its sources
+	if cfg == nil || cfg.Source("cache.ttl") != config.SourceFile {
+		t.Errorf("expected the invalid config with cache.ttl from the file, got %v", cfg)
+	}
+}
+
+func TestReloader_AppliedConfig(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(upstream, ttl string) {
+		content := "upstream:\n  origin: " + upstream + "\ncache:\n  ttl: " + ttl + "\n" +
+			"routes:\n  - origin: " + origin.URL + "\n    health_check:\n      path: /\n      interval: 1h\n"
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &proxy.Proxy{
+		HttpClient: &http.Client{},
+		Cache:      cache.New(&cache.CacheConfig{TTL: time.Minute, Capacity: 10}),
+	}
+	rl := &reloader{file: file, proxy: p}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writeConfig("http://old:8080", "1m")
+	if err := rl.reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	pool := rl.pools[0].pool
+
+	writeConfig("http://new:8080", "2m")
+	if err := rl.reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rl.pools[0].pool != pool {
+		t.Errorf("expected the unchanged route to keep its pool")
+	}
+	cfg := rl.config()
+	if cfg.Upstream.Origin != "http://old:8080" {
+		t.Errorf("expected the origin in effect %q, got %q", "http://old:8080", cfg.Upstream.Origin)
+	}
+	if cfg.Cache.TTL != config.YAMLDuration(2*time.Minute) {
+		t.Errorf("expected the reloaded TTL %v, got %v", 2*time.Minute, time.Duration(cfg.Cache.TTL))
+	}
+}
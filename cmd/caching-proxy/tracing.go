@@ -0,0 +1,25 @@
+package main
+
+import (
+	"caching-proxy/internal/config"
+	"caching-proxy/internal/tracing"
+	"fmt"
+	"net/url"
+)
+
+// startTracing sets up the default tracer configured in cfg and returns its
+// exporter, or nil when tracing is disabled.
+func startTracing(cfg config.Tracing) (*tracing.OTLPExporter, error) {
+	if cfg.Endpoint == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(cfg.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid tracing endpoint %q, expected an http or https URL", cfg.Endpoint)
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, fmt.Errorf("invalid tracing sample ratio %v, expected a value from 0 to 1", cfg.SampleRatio)
+	}
+	exporter := tracing.NewOTLPExporter(cfg.Endpoint, cfg.ServiceName)
+	tracing.SetDefault(tracing.NewTracer(exporter, cfg.SampleRatio))
+	return exporter, nil
+}
@@ -0,0 +1,235 @@
+// Package admin implements the HTTP API operators use to inspect and
+// invalidate the cache. It is meant to be served on its own listener.
+package admin
+
+import (
+	"caching-proxy/internal/cache"
+	"caching-proxy/internal/config"
+	"caching-proxy/internal/upstream"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// Cache is the part of the cache the admin API manages.
+type Cache interface {
+	Remove(ctx context.Context, key string) (bool, error)
+	RemovePrefix(ctx context.Context, prefix string) (int, error)
+	RemoveTag(ctx context.Context, tag string) (int, error)
+	RemoveAll(ctx context.Context) error
+	Entry(ctx context.Context, key string) (*cache.EntryInfo, bool)
+	Keys(prefix string, offset, limit int) ([]string, int)
+	Stats() cache.Stats
+	HotKeys(n int) []cache.KeyInfo
+	LRU(n int) cache.LRUSample
+	Histograms() cache.Histograms
+	LockStats() cache.LockStats
+}
+
+// Server serves the admin API.
+type Server struct {
+	// Token is the bearer token every request must present.
+	Token string
+	Cache Cache
+	// Breakers reports the state of the origin circuit breakers, may be nil.
+	Breakers *upstream.Breakers
+	// Config returns the configuration in effect.
+	Config func() *config.Config
+	// Metrics serves the metrics in the Prometheus text format, may be nil.
+	Metrics http.Handler
+	// Debug enables the pprof and cache introspection endpoints under /debug/.
+	Debug bool
+}
+
+// Handler returns the handler of the admin API. Every endpoint requires the
+// bearer token.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /cache", s.clear)
+	mux.HandleFunc("GET /cache/entry", s.entry)
+	mux.HandleFunc("DELETE /cache/entry", s.purgeKey)
+	mux.HandleFunc("DELETE /cache/prefix", s.purgePrefix)
+	mux.HandleFunc("DELETE /cache/tag", s.purgeTag)
+	mux.HandleFunc("GET /cache/keys", s.keys)
+	mux.HandleFunc("GET /stats", s.stats)
+	mux.HandleFunc("GET /breakers", s.breakers)
+	mux.HandleFunc("GET /config", s.config)
+	if s.Metrics != nil {
+		mux.Handle("GET /metrics", s.Metrics)
+	}
+	if s.Debug {
+		s.handleDebug(mux)
+	}
+	return s.authenticate(mux)
+}
+
+// authenticate rejects requests without the bearer token.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) clear(w http.ResponseWriter, r *http.Request) {
+	if err := s.Cache.RemoveAll(r.Context()); err != nil {
+		slog.Error("admin: clearing the cache", "error", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	slog.Info("admin: cache cleared")
+	writeJSON(w, http.StatusOK, map[string]bool{"cleared": true})
+}
+
+func (s *Server) entry(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, "key is required")
+		return
+	}
+	info, ok := s.Cache.Entry(r.Context(), key)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no entry for key")
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (s *Server) purgeKey(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, "key is required")
+		return
+	}
+	found, err := s.Cache.Remove(r.Context(), key)
+	if err != nil {
+		slog.Error("admin: purging key", "key", key, "error", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	slog.Info("admin: purged key", "key", key)
+	writeJSON(w, http.StatusOK, map[string]bool{"purged": found})
+}
+
+func (s *Server) purgePrefix(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		// an empty prefix would clear everything, DELETE /cache says so explicitly
+		writeError(w, http.StatusBadRequest, "prefix is required")
+		return
+	}
+	n, err := s.Cache.RemovePrefix(r.Context(), prefix)
+	if err != nil {
+		slog.Error("admin: purging prefix", "prefix", prefix, "error", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	slog.Info("admin: purged prefix", "prefix", prefix, "count", n)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
+
+func (s *Server) purgeTag(w http.ResponseWriter, r *http.Request) {
+	tag := r.URL.Query().Get("tag")
+	if tag == "" {
+		writeError(w, http.StatusBadRequest, "tag is required")
+		return
+	}
+	n, err := s.Cache.RemoveTag(r.Context(), tag)
+	if err != nil {
+		slog.Error("admin: purging tag", "tag", tag, "error", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	slog.Info("admin: purged tag", "tag", tag, "count", n)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
+
+func (s *Server) keys(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	offset, err := intParam(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "invalid offset")
+		return
+	}
+	limit, err := intParam(query.Get("limit"), defaultPageSize)
+	if err != nil || limit <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid limit")
+		return
+	}
+	limit = min(limit, maxPageSize)
+
+	keys, total := s.Cache.Keys(query.Get("prefix"), offset, limit)
+	page := struct {
+		Keys       []string `json:"keys"`
+		Total      int      `json:"total"`
+		Offset     int      `json:"offset"`
+		Limit      int      `json:"limit"`
+		NextOffset *int     `json:"next_offset,omitempty"`
+	}{Keys: keys, Total: total, Offset: offset, Limit: limit}
+	if next := offset + len(keys); next < total {
+		page.NextOffset = &next
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Cache.Stats())
+}
+
+func (s *Server) breakers(w http.ResponseWriter, r *http.Request) {
+	status := s.Breakers.Status()
+	if status == nil {
+		status = []upstream.BreakerStatus{}
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) config(w http.ResponseWriter, r *http.Request) {
+	// go through YAML so the output uses the config file's field names
+	b, err := yaml.Marshal(s.Config().Redacted())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var v map[string]interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func intParam(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("admin: writing response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,247 @@
+package admin
+
+import (
+	"caching-proxy/internal/cache"
+	"caching-proxy/internal/config"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testToken = "secret"
+
+func newTestServer() (*Server, *cache.Cache) {
+	c := cache.New(&cache.CacheConfig{TTL: time.Minute, Capacity: 10})
+	for key, tag := range map[string]string{"GETexample.com/a": "example", "GETexample.com/b": "example", "GETother.com/c": "other"} {
+		c.Set(context.TODO(), key, &cache.Item{
+			Key:                key,
+			ResponseBody:       []byte("body"),
+			ResponseHeaders:    http.Header{"Content-Type": []string{"text/plain"}},
+			ResponseStatusCode: http.StatusOK,
+			Expiration:         time.Now().Add(time.Minute),
+			Tags:               []string{tag},
+		})
+	}
+
+	cfg := config.NewConfig()
+	cfg.Cache.Redis.Password = "redis-password"
+	cfg.Admin.Token = testToken
+	return &Server{
+		Token:  testToken,
+		Cache:  c,
+		Config: func() *config.Config { return cfg },
+	}, c
+}
+
+func do(t *testing.T, h http.Handler, method, target, token string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("expected a JSON object, got %q", w.Body.String())
+	}
+	return w, body
+}
+
+func TestServer_Authentication(t *testing.T) {
+	s, _ := newTestServer()
+	h := s.Handler()
+
+	tests := []struct {
+		name           string
+		token          string
+		expectedStatus int
+	}{
+		{name: "no token", token: "", expectedStatus: http.StatusUnauthorized},
+		{name: "wrong token", token: "guess", expectedStatus: http.StatusUnauthorized},
+		{name: "valid token", token: testToken, expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, _ := do(t, h, http.MethodGet, "/stats", tt.token)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestServer_Purge(t *testing.T) {
+	s, c := newTestServer()
+	h := s.Handler()
+
+	w, body := do(t, h, http.MethodDelete, "/cache/entry?key=GETexample.com/a", testToken)
+	if w.Code != http.StatusOK || body["purged"] != true {
+		t.Errorf("expected key to be purged, got %d %v", w.Code, body)
+	}
+	if c.Stats().Items != 2 {
+		t.Errorf("expected %d items, got %d", 2, c.Stats().Items)
+	}
+
+	w, body = do(t, h, http.MethodDelete, "/cache/prefix?prefix=GETexample.com/", testToken)
+	if w.Code != http.StatusOK || body["purged"] != float64(1) {
+		t.Errorf("expected 1 key to be purged, got %d %v", w.Code, body)
+	}
+
+	w, body = do(t, h, http.MethodDelete, "/cache/tag?tag=other", testToken)
+	if w.Code != http.StatusOK || body["purged"] != float64(1) {
+		t.Errorf("expected 1 key to be purged, got %d %v", w.Code, body)
+	}
+
+	w, _ = do(t, h, http.MethodDelete, "/cache/prefix", testToken)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w, _ = do(t, h, http.MethodDelete, "/cache", testToken)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if c.Stats().Items != 0 {
+		t.Errorf("expected an empty cache, got %d items", c.Stats().Items)
+	}
+}
+
+func TestServer_Entry(t *testing.T) {
+	s, _ := newTestServer()
+	h := s.Handler()
+
+	w, body := do(t, h, http.MethodGet, "/cache/entry?key=GETexample.com/a", testToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if body["tier"] != "memory" || body["size"] != float64(4) || body["status_code"] != float64(200) {
+		t.Errorf("unexpected entry metadata %v", body)
+	}
+
+	w, _ = do(t, h, http.MethodGet, "/cache/entry?key=missing", testToken)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestServer_Keys(t *testing.T) {
+	s, _ := newTestServer()
+	h := s.Handler()
+
+	w, body := do(t, h, http.MethodGet, "/cache/keys?limit=2", testToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if len(body["keys"].([]interface{})) != 2 || body["total"] != float64(3) || body["next_offset"] != float64(2) {
+		t.Errorf("unexpected first page %v", body)
+	}
+
+	_, body = do(t, h, http.MethodGet, "/cache/keys?limit=2&offset=2", testToken)
+	if len(body["keys"].([]interface{})) != 1 || body["next_offset"] != nil {
+		t.Errorf("unexpected last page %v", body)
+	}
+
+	_, body = do(t, h, http.MethodGet, "/cache/keys?prefix=GETother.com", testToken)
+	if keys := body["keys"].([]interface{}); len(keys) != 1 || keys[0] != "GETother.com/c" {
+		t.Errorf("unexpected prefix page %v", body)
+	}
+
+	w, _ = do(t, h, http.MethodGet, "/cache/keys?limit=-1", testToken)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestServer_Config(t *testing.T) {
+	s, _ := newTestServer()
+
+	w, body := do(t, s.Handler(), http.MethodGet, "/config", testToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if strings.Contains(w.Body.String(), "redis-password") || strings.Contains(w.Body.String(), testToken) {
+		t.Errorf("expected secrets to be redacted, got %s", w.Body.String())
+	}
+	if ttl := body["cache"].(map[string]interface{})["ttl"]; ttl != "5m0s" {
+		t.Errorf("expected cache ttl %q, got %v", "5m0s", ttl)
+	}
+}
+
+func TestServer_Metrics(t *testing.T) {
+	s, _ := newTestServer()
+	s.Metrics = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("caching_proxy_cache_items 3\n"))
+	})
+	h := s.Handler()
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d without token, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "caching_proxy_cache_items 3\n" {
+		t.Errorf("expected the metrics, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestServer_Debug(t *testing.T) {
+	s, c := newTestServer()
+	c.Get(context.Background(), "GETexample.com/a")
+	h := s.Handler()
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/cache/locks", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d while debug is disabled, got %d", http.StatusNotFound, w.Code)
+	}
+
+	s.Debug = true
+	h = s.Handler()
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"/debug/pprof/", http.StatusOK},
+		{"/debug/pprof/heap?debug=1", http.StatusOK},
+		{"/debug/cache/hot?n=1", http.StatusOK},
+		{"/debug/cache/hot?n=0", http.StatusBadRequest},
+		{"/debug/cache/lru", http.StatusOK},
+		{"/debug/cache/histograms", http.StatusOK},
+		{"/debug/cache/locks", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		req.Header.Set("Authorization", "Bearer "+testToken)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: expected status %d, got %d", tt.target, tt.code, w.Code)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/debug/cache/hot?n=1", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	var hot []cache.KeyInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &hot); err != nil {
+		t.Fatal(err)
+	}
+	if len(hot) != 1 || hot[0].Key != "GETexample.com/a" || hot[0].Uses != 1 {
+		t.Errorf("unexpected hot keys %+v", hot)
+	}
+}
@@ -0,0 +1,59 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// defaultDebugKeys is the number of keys the cache introspection endpoints
+// return by default.
+const defaultDebugKeys = 20
+
+// handleDebug registers the profiling and cache introspection endpoints.
+func (s *Server) handleDebug(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("GET /debug/cache/hot", s.hotKeys)
+	mux.HandleFunc("GET /debug/cache/lru", s.lru)
+	mux.HandleFunc("GET /debug/cache/histograms", s.histograms)
+	mux.HandleFunc("GET /debug/cache/locks", s.locks)
+}
+
+// debugKeys returns the n query parameter of r, capped to the page size.
+func debugKeys(w http.ResponseWriter, r *http.Request) (int, bool) {
+	n, err := intParam(r.URL.Query().Get("n"), defaultDebugKeys)
+	if err != nil || n <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid n")
+		return 0, false
+	}
+	return min(n, maxPageSize), true
+}
+
+func (s *Server) hotKeys(w http.ResponseWriter, r *http.Request) {
+	n, ok := debugKeys(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Cache.HotKeys(n))
+}
+
+func (s *Server) lru(w http.ResponseWriter, r *http.Request) {
+	n, ok := debugKeys(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Cache.LRU(n))
+}
+
+func (s *Server) histograms(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Cache.Histograms())
+}
+
+func (s *Server) locks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Cache.LockStats())
+}
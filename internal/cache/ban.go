@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"caching-proxy/internal/upstream"
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// banSyncInterval bounds how often the bans added by the other instances
+// are read from redis.
+const banSyncInterval = time.Second
+
+// BanCompiler turns a ban expression into the predicate of the items it
+// invalidates.
+type BanCompiler func(expr string) (func(*Item) bool, error)
+
+// ban invalidates every item stored before it that matches.
+type ban struct {
+	// id is the ban record in redis, "<created unix nanoseconds> <expression>"
+	id      string
+	match   func(*Item) bool
+	created time.Time
+}
+
+// Ban invalidates every item stored before now, in memory or in redis, that
+// matches expr as compiled by CacheConfig.CompileBan. Bans are evaluated
+// lazily: a banned item is removed the next time it is looked up. With
+// redis, the ban is also recorded there for the other instances to apply.
+func (c *Cache) Ban(ctx context.Context, expr string) error {
+	if c.compileBan == nil {
+		return errors.New("cache: no ban compiler configured")
+	}
+	match, err := c.compileBan(expr)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	b := ban{id: strconv.FormatInt(now.UnixNano(), 10) + " " + expr, match: match, created: now}
+	c.addBan(b)
+
+	if c.redis == nil {
+		return nil
+	}
+	return c.redis.AddBan(ctx, b.id, now, c.banLifetime())
+}
+
+// addBan adds b unless it is known already, and drops the bans older than
+// every item that could still be stored.
+func (c *Cache) addBan(b ban) {
+	oldest := time.Now().Add(-c.banLifetime())
+
+	c.bansMu.Lock()
+	defer c.bansMu.Unlock()
+	bans := c.bans[:0]
+	for _, existing := range c.bans {
+		if existing.id == b.id {
+			b.id = ""
+		}
+		if existing.created.After(oldest) {
+			bans = append(bans, existing)
+		}
+	}
+	if b.id != "" {
+		bans = append(bans, b)
+	}
+	c.bans = bans
+}
+
+// banLifetime is how long a ban may still match an item: the longest
+// lifetime of the items stored so far, and at least the default one.
+func (c *Cache) banLifetime() time.Duration {
+	return max(time.Duration(c.maxLifetime.Load()), c.ttl+c.staleTTL)
+}
+
+// knownBan reports whether the ban recorded as id is applied already.
+func (c *Cache) knownBan(id string) bool {
+	c.bansMu.RLock()
+	defer c.bansMu.RUnlock()
+	for _, b := range c.bans {
+		if b.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// syncBans applies the bans recorded in redis by the other instances, at
+// most once per banSyncInterval.
+func (c *Cache) syncBans(ctx context.Context) {
+	if c.redis == nil || c.compileBan == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := c.banSync.Load()
+	if now-last < int64(banSyncInterval) || !c.banSync.CompareAndSwap(last, now) {
+		return
+	}
+
+	ids, err := c.redis.Bans(ctx)
+	if err != nil {
+		if !errors.Is(err, upstream.ErrCircuitOpen) {
+			slog.ErrorContext(ctx, "cache: reading bans from redis", "error", err)
+		}
+		return
+	}
+	for _, id := range ids {
+		if c.knownBan(id) {
+			continue
+		}
+		nanos, expr, _ := strings.Cut(id, " ")
+		created, err := strconv.ParseInt(nanos, 10, 64)
+		if err != nil {
+			slog.ErrorContext(ctx, "cache: invalid ban in redis", "ban", id, "error", err)
+			continue
+		}
+		match, err := c.compileBan(expr)
+		if err != nil {
+			slog.ErrorContext(ctx, "cache: invalid ban in redis", "ban", id, "error", err)
+			continue
+		}
+		c.addBan(ban{id: id, match: match, created: time.Unix(0, created)})
+	}
+}
+
+// banned reports whether a ban created after item was stored matches it.
+func (c *Cache) banned(item *Item) bool {
+	c.bansMu.RLock()
+	defer c.bansMu.RUnlock()
+	for _, b := range c.bans {
+		if item.StoredAt.After(b.created) {
+			continue
+		}
+		if b.match(item) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,14 +1,29 @@
 package cache
 
 import (
+	"caching-proxy/internal/compress"
+	"caching-proxy/internal/tracing"
+	"caching-proxy/internal/upstream"
 	"container/list"
 	"context"
-	"log"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/go-redis/redis/v8"
 )
 
+func init() {
+	// items are stored in redis as interface{} values, gob needs the concrete type registered
+	gob.Register(&Item{})
+}
+
 // Item represents the data stored in the cache.
 type Item struct {
 	Key                string
@@ -16,26 +31,108 @@ type Item struct {
 	ResponseHeaders    http.Header
 	ResponseStatusCode int
 	Expiration         time.Time
+	// StoredAt is when the item was stored, bans only apply to older items.
+	StoredAt time.Time
+	// Tags are the surrogate keys the item can be purged by, see RemoveTag.
+	Tags []string
+
+	// BodyEncoding is the content coding applied to ResponseBody at rest.
+	// An empty value means the body is stored as received from the origin.
+	BodyEncoding string
+
+	// Tier is the tier Get and GetStale found the item in, "memory" or "redis".
+	Tier string
+}
+
+// Body returns the response body as received from the origin, decompressing it
+// if it was compressed at rest.
+func (i *Item) Body() ([]byte, error) {
+	if i.BodyEncoding == "" {
+		return i.ResponseBody, nil
+	}
+	return compress.Decode(i.BodyEncoding, i.ResponseBody)
 }
 
+// The tiers an item can be found in.
+const (
+	TierMemory = "memory"
+	TierRedis  = "redis"
+)
+
+// The reasons items leave the in-memory tier, see Stats.Evictions.
+const (
+	evictedCapacity = iota
+	evictedExpired
+	evictedPurge
+	evictedBan
+	numEvictionReasons
+)
+
+var evictionReasons = [numEvictionReasons]string{"capacity", "expired", "purge", "ban"}
+
 // Cache represents a cache with a fixed capacity and TTL.
 type Cache struct {
-	mu        sync.RWMutex
+	mu        lock
 	itemsMap  map[string]*list.Element
 	itemsList *list.List
-	ttl       time.Duration
-	capacity  int
-	redis     *Redis
+	// uses counts the in-memory hits of every key since it was stored
+	uses map[string]int64
+	// tags indexes the in-memory keys by tag
+	tags     map[string]map[string]struct{}
+	ttl      time.Duration
+	staleTTL time.Duration
+	capacity int
+	redis    *Redis
+	// pending tracks the background redis writes
+	pending sync.WaitGroup
+
+	// bytes is the size of the bodies in the in-memory tier
+	bytes     int64
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions [numEvictionReasons]atomic.Int64
+
+	bansMu sync.RWMutex
+	bans   []ban
+	// compileBan turns the ban expressions into predicates
+	compileBan BanCompiler
+	// banSync is when the bans were last read from redis, in unix nanoseconds
+	banSync atomic.Int64
+	// maxLifetime is the longest time an item stored so far is kept, bans
+	// older than that cannot match anything anymore
+	maxLifetime atomic.Int64
+
+	compression        string
+	compressionMinSize int
+	compressionTypes   []string
 }
 
 type CacheConfig struct {
 	TTL      time.Duration
 	Capacity int
+	// StaleTTL is how long expired items are kept to be served by GetStale
+	// when the origin is unavailable. 0 drops items as soon as they expire.
+	StaleTTL time.Duration
 
 	RedisAddr     string
 	RedisDB       int
 	RedisPwd      string
 	RedisUsername string
+	// RedisBreaker stops sending commands to a failing redis, the lookups
+	// then miss and the writes are skipped. nil never opens.
+	RedisBreaker *upstream.Breaker
+
+	// CompileBan turns the expressions passed to Ban, and recorded in redis
+	// by the other instances, into predicates. nil disables bans.
+	CompileBan BanCompiler
+
+	// Compression is the content coding used to store bodies at rest ("gzip" or "zstd").
+	// An empty value disables compression.
+	Compression string
+	// CompressionMinSize is the minimum body size in bytes to be compressed.
+	CompressionMinSize int
+	// CompressionTypes lists the compressible media types, see compress.DefaultContentTypes.
+	CompressionTypes []string
 }
 
 // New creates a new Cache with the default capacity and TTL.
@@ -43,31 +140,56 @@ func New(config *CacheConfig) *Cache {
 	return &Cache{
 		itemsMap:  make(map[string]*list.Element),
 		itemsList: list.New(),
+		uses:      make(map[string]int64),
+		tags:      make(map[string]map[string]struct{}),
 		ttl:       config.TTL,
+		staleTTL:  config.StaleTTL,
 		capacity:  config.Capacity,
-		redis:     NewRedis(config.RedisDB, config.RedisAddr, config.RedisUsername, config.RedisPwd, config.TTL),
+		redis:     NewRedis(config.RedisDB, config.RedisAddr, config.RedisUsername, config.RedisPwd, config.RedisBreaker),
+
+		compileBan: config.CompileBan,
+
+		compression:        config.Compression,
+		compressionMinSize: config.CompressionMinSize,
+		compressionTypes:   config.CompressionTypes,
 	}
 }
 
 func (c *Cache) Get(ctx context.Context, key string) (*Item, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	return c.get(ctx, key, false)
+}
 
-	if element, ok := c.itemsMap[key]; ok {
-		item, ok := element.Value.(*Item)
-		if !ok {
-			return nil, false
-		}
+// GetStale is like Get but also returns items that expired less than the
+// stale TTL ago, for serving when the origin is unavailable.
+func (c *Cache) GetStale(ctx context.Context, key string) (*Item, bool) {
+	return c.get(ctx, key, true)
+}
 
-		// implement TTL
-		if item.Expiration.Before(time.Now()) {
-			c.itemsList.Remove(element)
-			delete(c.itemsMap, key)
-			return nil, false
+func (c *Cache) get(ctx context.Context, key string, stale bool) (*Item, bool) {
+	c.syncBans(ctx)
+	item, ok := c.lookup(ctx, key, stale)
+	if ok && c.banned(item) {
+		if _, err := c.remove(ctx, key, evictedBan); err != nil {
+			slog.ErrorContext(ctx, "cache: removing banned item", "key", key, "error", err)
 		}
-		// implement LRU, used item should be moved to the front
-		c.itemsList.MoveToFront(element)
-		return item, true
+		item, ok = nil, false
+	}
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return item, ok
+}
+
+// lookup returns a copy of the item of key with its tier set.
+func (c *Cache) lookup(ctx context.Context, key string, stale bool) (*Item, bool) {
+	_, span := tracing.Start(ctx, "cache memory lookup", tracing.KindInternal)
+	item, ok := c.getMemory(key, stale)
+	span.SetAttr("cache.hit", ok)
+	span.End()
+	if ok {
+		return item.in(TierMemory), true
 	}
 
 	// if no redis is configured, return here
@@ -76,52 +198,210 @@ func (c *Cache) Get(ctx context.Context, key string) (*Item, bool) {
 	}
 
 	// if the item is not in the cache, check if it is in the redis
-	log.Println("Looking for item in redis...")
-	if item, err := c.redis.Get(ctx, key); err != nil {
-		item, ok := item.(*Item)
-		if !ok {
-			return nil, false
+	slog.DebugContext(ctx, "cache: looking up redis", "key", key)
+	ctx, span = tracing.Start(ctx, "cache redis lookup", tracing.KindInternal)
+	defer span.End()
+	v, err := c.redis.Get(ctx, key)
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			span.SetError(err)
+			if !errors.Is(err, upstream.ErrCircuitOpen) {
+				slog.ErrorContext(ctx, "cache: looking up redis", "key", key, "error", err)
+			}
 		}
-
-		// set item in-memory cache to avoid multiple redis calls
-		c.Set(key, item)
-		return item, true
+		span.SetAttr("cache.hit", false)
+		return nil, false
 	}
-	return nil, false
+	item, ok = v.(*Item)
+	ok = ok && c.usable(item, time.Now(), stale)
+	span.SetAttr("cache.hit", ok)
+	if !ok {
+		return nil, false
+	}
+
+	// set item in-memory cache to avoid multiple redis calls
+	c.setMemory(key, item)
+	return item.in(TierRedis), true
+}
+
+// in returns a copy of i found in tier.
+func (i *Item) in(tier string) *Item {
+	found := *i
+	found.Tier = tier
+	return &found
 }
 
-func (c *Cache) Set(key string, item *Item) {
+// getMemory looks up key in the in-memory tier only.
+func (c *Cache) getMemory(key string, stale bool) (*Item, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// implement LRU, if the cache is full, remove the last item
-	if c.itemsList.Len() >= c.capacity {
-		back := c.itemsList.Back()
-		c.itemsList.Remove(back)
-		delete(c.itemsMap, back.Value.(*Item).Key)
+	element, ok := c.itemsMap[key]
+	if !ok {
+		return nil, false
+	}
+	item, ok := element.Value.(*Item)
+	if !ok {
+		return nil, false
 	}
 
-	element := c.itemsList.PushFront(item)
-	c.itemsMap[key] = element
+	// implement TTL, expired items are kept for the stale TTL
+	now := time.Now()
+	if !c.usable(item, now, true) {
+		c.evict(element, evictedExpired)
+		return nil, false
+	}
+	if !c.usable(item, now, stale) {
+		return nil, false
+	}
+	// implement LRU, used item should be moved to the front
+	c.itemsList.MoveToFront(element)
+	c.uses[key]++
+	return item, true
+}
 
-	if c.redis != nil {
+// Set stores item under key in memory and, in the background, in redis.
+// The redis write outlives ctx but keeps its values, such as the trace and
+// the request ID of the logs.
+func (c *Cache) Set(ctx context.Context, key string, item *Item) {
+	item = c.compress(ctx, item)
+	if item.StoredAt.IsZero() || item.Tier != "" || item.Key != key {
+		stored := *item
+		if stored.StoredAt.IsZero() {
+			stored.StoredAt = time.Now()
+		}
+		// the tier describes a lookup, it is not stored
+		stored.Tier = ""
+		// the in-memory tier removes items by their Key, see removeElement
+		stored.Key = key
+		item = &stored
+	}
+	if lifetime := item.Expiration.Sub(item.StoredAt) + c.staleTTL; lifetime > time.Duration(c.maxLifetime.Load()) {
+		c.maxLifetime.Store(int64(lifetime))
+	}
+	c.setMemory(key, item)
+
+	// routes may override the TTL, redis expires the item together with it
+	ttl := time.Until(item.Expiration) + c.staleTTL
+	if c.redis != nil && ttl > 0 {
 		// set item in redis asynchronously
+		c.pending.Add(1)
 		go func() {
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer c.pending.Done()
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
 			defer cancel()
-			if err := c.redis.Set(ctx, key, item); err != nil {
-				log.Println("Error setting item to redis:", err)
+			if err := c.redis.Set(ctx, key, item, ttl); err != nil {
+				if !errors.Is(err, upstream.ErrCircuitOpen) {
+					slog.ErrorContext(ctx, "cache: storing item in redis", "key", key, "error", err)
+				}
+				return
+			}
+			if err := c.redis.AddTags(ctx, key, item.Tags, ttl); err != nil {
+				slog.ErrorContext(ctx, "cache: indexing item tags in redis", "key", key, "error", err)
 			}
 		}()
 	}
 }
 
+// usable reports whether item can be served at now, either fresh or, if
+// stale is true, within the stale TTL.
+func (c *Cache) usable(item *Item, now time.Time, stale bool) bool {
+	expiration := item.Expiration
+	if stale {
+		expiration = expiration.Add(c.staleTTL)
+	}
+	return !expiration.Before(now)
+}
+
+// setMemory stores item in the in-memory tier only.
+func (c *Cache) setMemory(key string, item *Item) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// replacing an existing key must not count against the capacity
+	if element, ok := c.itemsMap[key]; ok {
+		c.removeElement(element)
+	}
+
+	// implement LRU, if the cache is full, remove the last item
+	if c.itemsList.Len() >= c.capacity {
+		c.evict(c.itemsList.Back(), evictedCapacity)
+	}
+
+	element := c.itemsList.PushFront(item)
+	c.itemsMap[key] = element
+	c.bytes += int64(len(item.ResponseBody))
+	for _, tag := range item.Tags {
+		if c.tags[tag] == nil {
+			c.tags[tag] = make(map[string]struct{})
+		}
+		c.tags[tag][item.Key] = struct{}{}
+	}
+}
+
+// removeElement drops an element of the in-memory tier. c.mu must be held.
+func (c *Cache) removeElement(element *list.Element) {
+	item := element.Value.(*Item)
+	c.itemsList.Remove(element)
+	delete(c.itemsMap, item.Key)
+	delete(c.uses, item.Key)
+	c.bytes -= int64(len(item.ResponseBody))
+	for _, tag := range item.Tags {
+		delete(c.tags[tag], item.Key)
+		if len(c.tags[tag]) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+}
+
+// evict drops an element of the in-memory tier for reason. c.mu must be held.
+func (c *Cache) evict(element *list.Element, reason int) {
+	c.removeElement(element)
+	c.evictions[reason].Add(1)
+}
+
+// compress returns a copy of item with its body compressed at rest, or item
+// itself when compression is disabled or not worthwhile for this response.
+func (c *Cache) compress(ctx context.Context, item *Item) *Item {
+	if c.compression == "" || item.BodyEncoding != "" {
+		return item
+	}
+	if len(item.ResponseBody) < c.compressionMinSize {
+		return item
+	}
+	// never re-compress what the origin already encoded
+	if item.ResponseHeaders.Get("Content-Encoding") != "" {
+		return item
+	}
+	if !compress.Compressible(item.ResponseHeaders.Get("Content-Type"), c.compressionTypes) {
+		return item
+	}
+
+	body, err := compress.Encode(c.compression, item.ResponseBody)
+	if err != nil {
+		slog.ErrorContext(ctx, "cache: compressing item body", "key", item.Key, "error", err)
+		return item
+	}
+	if len(body) >= len(item.ResponseBody) {
+		return item
+	}
+
+	compressed := *item
+	compressed.ResponseBody = body
+	compressed.BodyEncoding = c.compression
+	return &compressed
+}
+
 func (c *Cache) RemoveAll(ctx context.Context) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	c.evictions[evictedPurge].Add(int64(c.itemsList.Len()))
 	c.itemsMap = make(map[string]*list.Element)
 	c.itemsList.Init()
+	c.uses = make(map[string]int64)
+	c.tags = make(map[string]map[string]struct{})
+	c.bytes = 0
 
 	if c.redis != nil {
 		return c.redis.RemoveAll(ctx)
@@ -129,6 +409,99 @@ func (c *Cache) RemoveAll(ctx context.Context) error {
 	return nil
 }
 
+// Remove deletes key from both tiers and reports whether it was in memory.
+func (c *Cache) Remove(ctx context.Context, key string) (bool, error) {
+	return c.remove(ctx, key, evictedPurge)
+}
+
+func (c *Cache) remove(ctx context.Context, key string, reason int) (bool, error) {
+	c.mu.Lock()
+	element, ok := c.itemsMap[key]
+	if ok {
+		c.evict(element, reason)
+	}
+	c.mu.Unlock()
+
+	if c.redis != nil {
+		return ok, c.redis.Del(ctx, key)
+	}
+	return ok, nil
+}
+
+// RemovePrefix deletes every key starting with prefix from both tiers and
+// returns the number of keys removed from memory.
+func (c *Cache) RemovePrefix(ctx context.Context, prefix string) (int, error) {
+	c.mu.Lock()
+	var n int
+	for key, element := range c.itemsMap {
+		if strings.HasPrefix(key, prefix) {
+			c.evict(element, evictedPurge)
+			n++
+		}
+	}
+	c.mu.Unlock()
+
+	if c.redis != nil {
+		return n, c.redis.DelPrefix(ctx, prefix)
+	}
+	return n, nil
+}
+
+// RemoveTag deletes every key tagged with tag from both tiers and returns
+// the number of keys removed.
+func (c *Cache) RemoveTag(ctx context.Context, tag string) (int, error) {
+	c.mu.Lock()
+	var n int
+	for key := range c.tags[tag] {
+		if element, ok := c.itemsMap[key]; ok {
+			c.evict(element, evictedPurge)
+			n++
+		}
+	}
+	c.mu.Unlock()
+
+	if c.redis != nil {
+		// redis holds every key, including the ones evicted from memory
+		return c.redis.DelTag(ctx, tag)
+	}
+	return n, nil
+}
+
+// Close waits for the background redis writes to finish, or until ctx is
+// done, and closes the redis client.
+func (c *Cache) Close(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.pending.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("waiting for redis writes: %w", ctx.Err())
+	}
+	if c.redis != nil {
+		if cerr := c.redis.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// RedisReady reports whether the circuit breaker of redis lets commands
+// through, and its state. Without redis, it returns true and "disabled".
+func (c *Cache) RedisReady() (bool, string) {
+	if c.redis == nil {
+		return true, "disabled"
+	}
+	if c.redis.breaker == nil {
+		return true, upstream.BreakerClosed.String()
+	}
+	return c.redis.breaker.Ready(), c.redis.breaker.Status().State
+}
+
 func (c *Cache) TTL() time.Duration {
 	return c.ttl
 }
@@ -1,10 +1,15 @@
 package cache
 
 import (
+	"caching-proxy/internal/upstream"
 	"context"
+	"errors"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/go-redis/redis/v8"
 )
 
 const (
@@ -37,7 +42,7 @@ func TestCache_Get(t *testing.T) {
 		ResponseStatusCode: http.StatusOK,
 		Expiration:         time.Now().Add(1 * time.Hour),
 	}
-	cache.Set("key1", item)
+	cache.Set(ctx, "key1", item)
 
 	retrievedItem, found := cache.Get(ctx, "key1")
 	if !found {
@@ -58,7 +63,7 @@ func TestCache_Get(t *testing.T) {
 		ResponseStatusCode: http.StatusOK,
 		Expiration:         time.Now().Add(-1 * time.Hour),
 	}
-	cache.Set("key2", expiredItem)
+	cache.Set(ctx, "key2", expiredItem)
 
 	_, found = cache.Get(ctx, "key2")
 	if found {
@@ -77,7 +82,7 @@ func TestCache_Set(t *testing.T) {
 		ResponseStatusCode: http.StatusOK,
 		Expiration:         time.Now().Add(1 * time.Hour),
 	}
-	cache.Set("key1", item)
+	cache.Set(ctx, "key1", item)
 
 	retrievedItem, found := cache.Get(ctx, "key1")
 	if !found {
@@ -99,7 +104,7 @@ func TestCache_Set(t *testing.T) {
 		ResponseStatusCode: http.StatusOK,
 		Expiration:         time.Now().Add(1 * time.Hour),
 	}
-	cache.Set("key2", item2)
+	cache.Set(ctx, "key2", item2)
 
 	_, found = cache.Get(ctx, "key1")
 	if found {
@@ -117,6 +122,22 @@ func TestCache_Set(t *testing.T) {
 		t.Errorf("expected status code to be %d, got %d", http.StatusOK, retrievedItem.ResponseStatusCode)
 	}
 }
+func TestCache_SetMismatchedKey(t *testing.T) {
+	ctx := context.TODO()
+	cache := New(testConfig)
+	cache.capacity = 1
+
+	cache.Set(ctx, "key1", &Item{Key: "other", Expiration: time.Now().Add(time.Hour)})
+	cache.Set(ctx, "key2", &Item{Key: "key2", Expiration: time.Now().Add(time.Hour)})
+
+	if _, found := cache.Get(ctx, "key1"); found {
+		t.Errorf("expected the evicted item not to be found")
+	}
+	if item, found := cache.Get(ctx, "key2"); !found || item.Key != "key2" {
+		t.Errorf("expected the item stored under key2, got %v", item)
+	}
+}
+
 func TestCache_RemoveAll(t *testing.T) {
 	ctx := context.TODO()
 	cache := New(testConfig)
@@ -129,7 +150,7 @@ func TestCache_RemoveAll(t *testing.T) {
 		ResponseStatusCode: http.StatusOK,
 		Expiration:         time.Now().Add(1 * time.Hour),
 	}
-	cache.Set("key1", item1)
+	cache.Set(ctx, "key1", item1)
 
 	item2 := &Item{
 		Key:                "key2",
@@ -138,7 +159,7 @@ func TestCache_RemoveAll(t *testing.T) {
 		ResponseStatusCode: http.StatusOK,
 		Expiration:         time.Now().Add(1 * time.Hour),
 	}
-	cache.Set("key2", item2)
+	cache.Set(ctx, "key2", item2)
 
 	// Ensure items are in the cache
 	if _, found := cache.Get(ctx, "key1"); !found {
@@ -167,3 +188,301 @@ func TestCache_RemoveAll(t *testing.T) {
 		t.Errorf("expected itemsList to be empty, got %d items", cache.itemsList.Len())
 	}
 }
+
+func TestCache_SetCompression(t *testing.T) {
+	ctx := context.TODO()
+	cache := New(&CacheConfig{
+		TTL:                testTTL,
+		Capacity:           testCapacity,
+		Compression:        "gzip",
+		CompressionMinSize: 16,
+	})
+
+	body := []byte(strings.Repeat("compressible response body ", 50))
+
+	// Test case 1: compressible content type is stored compressed
+	cache.Set(ctx, "key1", &Item{
+		Key:                "key1",
+		ResponseBody:       body,
+		ResponseHeaders:    http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}},
+		ResponseStatusCode: http.StatusOK,
+		Expiration:         time.Now().Add(1 * time.Hour),
+	})
+
+	retrievedItem, found := cache.Get(ctx, "key1")
+	if !found {
+		t.Fatalf("expected item to be found")
+	}
+	if retrievedItem.BodyEncoding != "gzip" {
+		t.Errorf("expected body encoding to be 'gzip', got '%s'", retrievedItem.BodyEncoding)
+	}
+	if len(retrievedItem.ResponseBody) >= len(body) {
+		t.Errorf("expected stored body to be smaller than %d bytes, got %d", len(body), len(retrievedItem.ResponseBody))
+	}
+	decoded, err := retrievedItem.Body()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if string(decoded) != string(body) {
+		t.Errorf("expected decoded body to match the original")
+	}
+
+	// Test case 2: non-compressible content type is stored as is
+	cache.Set(ctx, "key2", &Item{
+		Key:                "key2",
+		ResponseBody:       body,
+		ResponseHeaders:    http.Header{"Content-Type": []string{"image/png"}},
+		ResponseStatusCode: http.StatusOK,
+		Expiration:         time.Now().Add(1 * time.Hour),
+	})
+	if retrievedItem, _ = cache.Get(ctx, "key2"); retrievedItem.BodyEncoding != "" {
+		t.Errorf("expected body encoding to be empty, got '%s'", retrievedItem.BodyEncoding)
+	}
+
+	// Test case 3: bodies below the minimum size are stored as is
+	cache.Set(ctx, "key3", &Item{
+		Key:                "key3",
+		ResponseBody:       []byte("tiny"),
+		ResponseHeaders:    http.Header{"Content-Type": []string{"text/plain"}},
+		ResponseStatusCode: http.StatusOK,
+		Expiration:         time.Now().Add(1 * time.Hour),
+	})
+	if retrievedItem, _ = cache.Get(ctx, "key3"); retrievedItem.BodyEncoding != "" {
+		t.Errorf("expected body encoding to be empty, got '%s'", retrievedItem.BodyEncoding)
+	}
+
+	// Test case 4: already encoded origin responses are never compressed again
+	cache.Set(ctx, "key4", &Item{
+		Key:                "key4",
+		ResponseBody:       body,
+		ResponseHeaders:    http.Header{"Content-Type": []string{"text/plain"}, "Content-Encoding": []string{"br"}},
+		ResponseStatusCode: http.StatusOK,
+		Expiration:         time.Now().Add(1 * time.Hour),
+	})
+	if retrievedItem, _ = cache.Get(ctx, "key4"); retrievedItem.BodyEncoding != "" {
+		t.Errorf("expected body encoding to be empty, got '%s'", retrievedItem.BodyEncoding)
+	}
+}
+
+func TestCache_GetStale(t *testing.T) {
+	ctx := context.TODO()
+	cache := New(&CacheConfig{TTL: testTTL, Capacity: testCapacity, StaleTTL: time.Hour})
+
+	cache.Set(ctx, "expired", &Item{
+		Key:          "expired",
+		ResponseBody: []byte("stale body"),
+		Expiration:   time.Now().Add(-time.Minute),
+	})
+	cache.Set(ctx, "gone", &Item{
+		Key:        "gone",
+		Expiration: time.Now().Add(-2 * time.Hour),
+	})
+
+	if _, found := cache.Get(ctx, "expired"); found {
+		t.Errorf("expected expired item to not be found by Get")
+	}
+	item, found := cache.GetStale(ctx, "expired")
+	if !found {
+		t.Fatalf("expected expired item to be found by GetStale")
+	}
+	if string(item.ResponseBody) != "stale body" {
+		t.Errorf("expected response body to be 'stale body', got '%s'", string(item.ResponseBody))
+	}
+	if _, found := cache.GetStale(ctx, "gone"); found {
+		t.Errorf("expected item past the stale TTL to not be found")
+	}
+}
+
+func TestCache_Close(t *testing.T) {
+	cache := New(testConfig)
+	cache.pending.Add(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := cache.Close(ctx); err == nil {
+		t.Errorf("expected an error while a redis write is pending")
+	}
+
+	cache.pending.Done()
+	if err := cache.Close(context.Background()); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestCache_RemoveAndStats(t *testing.T) {
+	ctx := context.TODO()
+	cache := New(&CacheConfig{TTL: testTTL, Capacity: 3})
+	for _, key := range []string{"a/1", "a/2", "b/1", "b/2"} {
+		cache.Set(ctx, key, &Item{Key: key, ResponseBody: []byte("12345"), Expiration: time.Now().Add(time.Hour)})
+	}
+
+	stats := cache.Stats()
+	if stats.Items != 3 || stats.Bytes != 15 || stats.Evictions["capacity"] != 1 {
+		t.Errorf("expected 3 items, 15 bytes and 1 eviction, got %+v", stats)
+	}
+	if keys, total := cache.Keys("", 0, 10); total != 3 || keys[0] != "b/2" {
+		t.Errorf("expected 3 keys, most recent first, got %v", keys)
+	}
+
+	if found, err := cache.Remove(ctx, "b/2"); !found || err != nil {
+		t.Errorf("expected b/2 to be removed, got %v %v", found, err)
+	}
+	if n, err := cache.RemovePrefix(ctx, "a/"); n != 1 || err != nil {
+		t.Errorf("expected 1 key to be removed, got %d %v", n, err)
+	}
+	if keys, _ := cache.Keys("", 0, 10); len(keys) != 1 || keys[0] != "b/1" {
+		t.Errorf("expected only b/1 to remain, got %v", keys)
+	}
+	if stats := cache.Stats(); stats.Bytes != 5 || stats.Evictions["purge"] != 2 {
+		t.Errorf("expected 5 bytes and 2 purged items, got %+v", stats)
+	}
+}
+
+func TestCache_Ban(t *testing.T) {
+	ctx := context.TODO()
+	cache := New(&CacheConfig{
+		TTL:      testTTL,
+		Capacity: testCapacity,
+		CompileBan: func(prefix string) (func(*Item) bool, error) {
+			return func(item *Item) bool { return strings.HasPrefix(item.Key, prefix) }, nil
+		},
+	})
+	cache.Set(ctx, "old", &Item{Key: "old", Expiration: time.Now().Add(time.Hour)})
+	cache.Set(ctx, "other", &Item{Key: "other", Expiration: time.Now().Add(time.Hour)})
+
+	if err := cache.Ban(ctx, "ol"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := cache.Get(ctx, "old"); found {
+		t.Errorf("expected item stored before the ban to be banned")
+	}
+	if _, found := cache.Get(ctx, "other"); !found {
+		t.Errorf("expected item not matching the ban to be found")
+	}
+
+	// bans only apply to items stored before them
+	time.Sleep(time.Millisecond)
+	cache.Set(ctx, "old", &Item{Key: "old", Expiration: time.Now().Add(time.Hour)})
+	if _, found := cache.Get(ctx, "old"); !found {
+		t.Errorf("expected item stored after the ban to be found")
+	}
+	if stats := cache.Stats(); stats.Bans != 1 {
+		t.Errorf("expected %d ban, got %d", 1, stats.Bans)
+	}
+}
+
+func TestCache_RemoveTag(t *testing.T) {
+	ctx := context.TODO()
+	cache := New(testConfig)
+	cache.Set(ctx, "a", &Item{Key: "a", Tags: []string{"product-1", "home"}, Expiration: time.Now().Add(time.Hour)})
+	cache.Set(ctx, "b", &Item{Key: "b", Tags: []string{"product-1"}, Expiration: time.Now().Add(time.Hour)})
+	cache.Set(ctx, "c", &Item{Key: "c", Tags: []string{"home"}, Expiration: time.Now().Add(time.Hour)})
+
+	if n, err := cache.RemoveTag(ctx, "product-1"); n != 2 || err != nil {
+		t.Errorf("expected 2 keys to be removed, got %d %v", n, err)
+	}
+	for key, expected := range map[string]bool{"a": false, "b": false, "c": true} {
+		if _, found := cache.Get(ctx, key); found != expected {
+			t.Errorf("%s: expected found %v, got %v", key, expected, found)
+		}
+	}
+	if n, _ := cache.RemoveTag(ctx, "home"); n != 1 {
+		t.Errorf("expected the index to forget removed keys, got %d removed", n)
+	}
+	if len(cache.tags) != 0 {
+		t.Errorf("expected an empty tag index, got %v", cache.tags)
+	}
+}
+
+func TestRedisHook(t *testing.T) {
+	ctx := context.Background()
+	hook := redisHook{}
+	before := redisErrors.With("get").Value()
+	for _, err := range []error{nil, redis.Nil, errors.New("connection refused")} {
+		cmd := redis.NewStringCmd(ctx, "get", "key")
+		cmd.SetErr(err)
+		hctx, _ := hook.BeforeProcess(ctx, cmd)
+		hook.AfterProcess(hctx, cmd)
+	}
+	if n := redisErrors.With("get").Value() - before; n != 1 {
+		t.Errorf("expected 1 error, missing keys excluded, got %v", n)
+	}
+}
+
+func TestRedisHook_Breaker(t *testing.T) {
+	ctx := context.Background()
+	breaker := upstream.NewBreaker("redis", upstream.BreakerConfig{
+		Window:      2,
+		MinRequests: 2,
+		ErrorRate:   0.5,
+		OpenTime:    time.Minute,
+	})
+	hook := redisHook{breaker: breaker}
+	cache := &Cache{redis: &Redis{breaker: breaker}}
+	if ready, state := cache.RedisReady(); !ready || state != "closed" {
+		t.Errorf("expected a ready closed breaker, got %v %q", ready, state)
+	}
+
+	for _, err := range []error{redis.Nil, errors.New("connection refused")} {
+		cmd := redis.NewStringCmd(ctx, "get", "key")
+		hctx, herr := hook.BeforeProcess(ctx, cmd)
+		if herr != nil {
+			t.Fatalf("expected the command to be allowed, got %v", herr)
+		}
+		cmd.SetErr(err)
+		hook.AfterProcess(hctx, cmd)
+	}
+
+	cmd := redis.NewStringCmd(ctx, "get", "key")
+	if _, err := hook.BeforeProcess(ctx, cmd); !errors.Is(err, upstream.ErrCircuitOpen) {
+		t.Errorf("expected the open breaker to reject the command, got %v", err)
+	}
+	if ready, state := cache.RedisReady(); ready || state != "open" {
+		t.Errorf("expected an open breaker, got %v %q", ready, state)
+	}
+}
+
+func TestCache_Debug(t *testing.T) {
+	ctx := context.Background()
+	cache := New(&CacheConfig{TTL: time.Minute, Capacity: 10})
+	now := time.Now()
+	cache.Set(ctx, "a", &Item{Key: "a", ResponseBody: make([]byte, 100), Expiration: now.Add(30 * time.Second)})
+	cache.Set(ctx, "b", &Item{Key: "b", ResponseBody: make([]byte, 2000), Expiration: now.Add(2 * time.Hour)})
+	cache.Set(ctx, "c", &Item{Key: "c", ResponseBody: make([]byte, 100), Expiration: now.Add(time.Hour)})
+	for _, key := range []string{"b", "b", "a", "b"} {
+		cache.Get(ctx, key)
+	}
+
+	hot := cache.HotKeys(2)
+	if len(hot) != 2 || hot[0].Key != "b" || hot[0].Uses != 3 || hot[1].Key != "a" || hot[1].Uses != 1 {
+		t.Errorf("unexpected hot keys %+v", hot)
+	}
+
+	lru := cache.LRU(1)
+	if len(lru.MostRecent) != 1 || lru.MostRecent[0].Key != "b" {
+		t.Errorf("expected b most recently used, got %+v", lru.MostRecent)
+	}
+	if len(lru.LeastRecent) != 1 || lru.LeastRecent[0].Key != "c" {
+		t.Errorf("expected c next to be evicted, got %+v", lru.LeastRecent)
+	}
+
+	h := cache.Histograms()
+	sizes := map[string]int{}
+	for _, b := range h.Sizes {
+		sizes[b.Le] = b.Count
+	}
+	if sizes["1024"] != 2 || sizes["4096"] != 1 || h.Sizes[len(h.Sizes)-1].Le != "+Inf" {
+		t.Errorf("unexpected size histogram %+v", h.Sizes)
+	}
+	ttls := map[string]int{}
+	for _, b := range h.TTLs {
+		ttls[b.Le] = b.Count
+	}
+	if ttls["60"] != 1 || ttls["3600"] != 1 || ttls["21600"] != 1 {
+		t.Errorf("unexpected TTL histogram %+v", h.TTLs)
+	}
+
+	if lock := cache.LockStats(); lock.Items != 3 || lock.Acquisitions == 0 {
+		t.Errorf("unexpected lock stats %+v", lock)
+	}
+}
@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+var (
+	// sizeBounds are the upper bounds in bytes of the body size buckets.
+	sizeBounds = []int64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+	// ttlBounds are the upper bounds of the remaining TTL buckets, the first
+	// one holds the expired items kept to be served stale.
+	ttlBounds = []time.Duration{0, time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour, 6 * time.Hour, 24 * time.Hour}
+)
+
+// KeyInfo describes an in-memory entry for debugging.
+type KeyInfo struct {
+	Key string `json:"key"`
+	// Uses is the number of hits since the entry was stored.
+	Uses       int64     `json:"uses"`
+	Size       int       `json:"size"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// LRUSample lists both ends of the in-memory LRU list.
+type LRUSample struct {
+	// MostRecent are the most recently used entries, most recent first.
+	MostRecent []KeyInfo `json:"most_recent"`
+	// LeastRecent are the next entries to be evicted, next first.
+	LeastRecent []KeyInfo `json:"least_recent"`
+}
+
+// Bucket counts the entries above the previous bound and up to Le, a number
+// or "+Inf".
+type Bucket struct {
+	Le    string `json:"le"`
+	Count int    `json:"count"`
+}
+
+// Histograms describe the distribution of the in-memory entries.
+type Histograms struct {
+	// Sizes buckets the entries by body size in bytes.
+	Sizes []Bucket `json:"sizes"`
+	// TTLs buckets the entries by remaining TTL in seconds, the "0" bucket
+	// holds the expired entries kept to be served stale.
+	TTLs []Bucket `json:"ttls"`
+}
+
+// LockStats counts the uses of the lock guarding the in-memory tier. The
+// tier is a single LRU, there are no shards to report separately.
+type LockStats struct {
+	// Items is the number of entries behind the lock.
+	Items int `json:"items"`
+	// Acquisitions is the number of times the lock was taken.
+	Acquisitions int64 `json:"acquisitions"`
+	// Contended is the number of times the lock was held by someone else.
+	Contended int64 `json:"contended"`
+	// WaitSeconds is the total time spent waiting for the lock.
+	WaitSeconds float64 `json:"wait_seconds"`
+}
+
+// info returns the debugging description of the item of key. c.mu must be held.
+func (c *Cache) info(item *Item) KeyInfo {
+	return KeyInfo{
+		Key:        item.Key,
+		Uses:       c.uses[item.Key],
+		Size:       len(item.ResponseBody),
+		Expiration: item.Expiration,
+	}
+}
+
+// HotKeys returns the n in-memory entries with the most hits, most used first.
+func (c *Cache) HotKeys(n int) []KeyInfo {
+	c.mu.Lock()
+	keys := make([]KeyInfo, 0, len(c.itemsMap))
+	for _, element := range c.itemsMap {
+		keys = append(keys, c.info(element.Value.(*Item)))
+	}
+	c.mu.Unlock()
+
+	slices.SortFunc(keys, func(a, b KeyInfo) int {
+		return cmp.Or(cmp.Compare(b.Uses, a.Uses), cmp.Compare(a.Key, b.Key))
+	})
+	return keys[:min(n, len(keys))]
+}
+
+// LRU returns up to n entries from each end of the LRU list.
+func (c *Cache) LRU(n int) LRUSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sample := LRUSample{MostRecent: []KeyInfo{}, LeastRecent: []KeyInfo{}}
+	for element := c.itemsList.Front(); element != nil && len(sample.MostRecent) < n; element = element.Next() {
+		sample.MostRecent = append(sample.MostRecent, c.info(element.Value.(*Item)))
+	}
+	for element := c.itemsList.Back(); element != nil && len(sample.LeastRecent) < n; element = element.Prev() {
+		sample.LeastRecent = append(sample.LeastRecent, c.info(element.Value.(*Item)))
+	}
+	return sample
+}
+
+// Histograms returns the size and TTL distributions of the in-memory entries.
+func (c *Cache) Histograms() Histograms {
+	sizes := make([]int, len(sizeBounds)+1)
+	ttls := make([]int, len(ttlBounds)+1)
+	now := time.Now()
+
+	c.mu.Lock()
+	for element := c.itemsList.Front(); element != nil; element = element.Next() {
+		item := element.Value.(*Item)
+		// the first bound not below the value, or the +Inf bucket
+		i, _ := slices.BinarySearch(sizeBounds, int64(len(item.ResponseBody)))
+		sizes[i]++
+		i, _ = slices.BinarySearch(ttlBounds, item.Expiration.Sub(now))
+		ttls[i]++
+	}
+	c.mu.Unlock()
+
+	h := Histograms{
+		Sizes: make([]Bucket, len(sizes)),
+		TTLs:  make([]Bucket, len(ttls)),
+	}
+	for i, count := range sizes {
+		le := "+Inf"
+		if i < len(sizeBounds) {
+			le = strconv.FormatInt(sizeBounds[i], 10)
+		}
+		h.Sizes[i] = Bucket{Le: le, Count: count}
+	}
+	for i, count := range ttls {
+		le := "+Inf"
+		if i < len(ttlBounds) {
+			le = strconv.FormatFloat(ttlBounds[i].Seconds(), 'f', -1, 64)
+		}
+		h.TTLs[i] = Bucket{Le: le, Count: count}
+	}
+	return h
+}
+
+// LockStats returns the counters of the lock of the in-memory tier.
+func (c *Cache) LockStats() LockStats {
+	c.mu.Lock()
+	items := c.itemsList.Len()
+	c.mu.Unlock()
+	return LockStats{
+		Items:        items,
+		Acquisitions: c.mu.acquisitions.Load(),
+		Contended:    c.mu.contended.Load(),
+		WaitSeconds:  time.Duration(c.mu.waitNanos.Load()).Seconds(),
+	}
+}
@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EntryInfo describes a cached entry without its body.
+type EntryInfo struct {
+	Key          string      `json:"key"`
+	Tier         string      `json:"tier"`
+	StatusCode   int         `json:"status_code"`
+	Headers      http.Header `json:"headers"`
+	Size         int         `json:"size"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+	Tags         []string    `json:"tags,omitempty"`
+	Expiration   time.Time   `json:"expiration"`
+	Expired      bool        `json:"expired"`
+}
+
+// Stats is a snapshot of the cache counters.
+type Stats struct {
+	Items    int   `json:"items"`
+	Bytes    int64 `json:"bytes"`
+	Capacity int   `json:"capacity"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+	// Evictions counts the items dropped from memory by reason: "capacity",
+	// "expired", "purge" or "ban".
+	Evictions map[string]int64 `json:"evictions"`
+	Bans      int              `json:"bans"`
+	Redis     bool             `json:"redis"`
+}
+
+// Entry returns the metadata of key, from memory or else redis, without
+// counting as a use of the entry.
+func (c *Cache) Entry(ctx context.Context, key string) (*EntryInfo, bool) {
+	tier := TierMemory
+	c.mu.Lock()
+	var item *Item
+	if element, ok := c.itemsMap[key]; ok {
+		item = element.Value.(*Item)
+	}
+	c.mu.Unlock()
+
+	if item == nil && c.redis != nil {
+		v, err := c.redis.Get(ctx, key)
+		if err != nil {
+			return nil, false
+		}
+		item, _ = v.(*Item)
+		tier = TierRedis
+	}
+	if item == nil {
+		return nil, false
+	}
+	return &EntryInfo{
+		Key:          key,
+		Tier:         tier,
+		StatusCode:   item.ResponseStatusCode,
+		Headers:      item.ResponseHeaders,
+		Size:         len(item.ResponseBody),
+		BodyEncoding: item.BodyEncoding,
+		Tags:         item.Tags,
+		Expiration:   item.Expiration,
+		Expired:      item.Expiration.Before(time.Now()),
+	}, true
+}
+
+// Keys returns the in-memory keys starting with prefix, most recently used
+// first, skipping offset keys and returning at most limit. It also returns
+// the number of matching keys.
+func (c *Cache) Keys(prefix string, offset, limit int) ([]string, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := []string{}
+	total := 0
+	for element := c.itemsList.Front(); element != nil; element = element.Next() {
+		key := element.Value.(*Item).Key
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if total >= offset && len(keys) < limit {
+			keys = append(keys, key)
+		}
+		total++
+	}
+	return keys, total
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *Cache) Stats() Stats {
+	c.bansMu.RLock()
+	bans := len(c.bans)
+	c.bansMu.RUnlock()
+
+	evictions := make(map[string]int64, numEvictionReasons)
+	for reason, name := range evictionReasons {
+		evictions[name] = c.evictions[reason].Load()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{
+		Items:     c.itemsList.Len(),
+		Bytes:     c.bytes,
+		Capacity:  c.capacity,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: evictions,
+		Bans:      bans,
+		Redis:     c.redis != nil,
+	}
+}
@@ -0,0 +1,31 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lock is a mutex counting how often it was acquired, how often it was held
+// by someone else at the time and how long was spent waiting for it.
+type lock struct {
+	mu           sync.Mutex
+	acquisitions atomic.Int64
+	contended    atomic.Int64
+	waitNanos    atomic.Int64
+}
+
+func (l *lock) Lock() {
+	l.acquisitions.Add(1)
+	if l.mu.TryLock() {
+		return
+	}
+	l.contended.Add(1)
+	start := time.Now()
+	l.mu.Lock()
+	l.waitNanos.Add(int64(time.Since(start)))
+}
+
+func (l *lock) Unlock() {
+	l.mu.Unlock()
+}
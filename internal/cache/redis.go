@@ -2,22 +2,40 @@ package cache
 
 import (
 	"bytes"
+	"caching-proxy/internal/metrics"
+	"caching-proxy/internal/servertiming"
+	"caching-proxy/internal/tracing"
+	"caching-proxy/internal/upstream"
 	"context"
 	"encoding/gob"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
+var (
+	redisDuration = metrics.Default.NewHistogram("caching_proxy_redis_operation_duration_seconds",
+		"Latency of the redis commands by command name.", nil, "op")
+	redisErrors = metrics.Default.NewCounter("caching_proxy_redis_errors_total",
+		"Failed redis commands by command name, not counting missing keys.", "op")
+)
+
 type Redis struct {
-	client *redis.Client
-	ttl    time.Duration
+	client  *redis.Client
+	breaker *upstream.Breaker
 }
 
-func NewRedis(db int, addr, username, password string, ttl time.Duration) *Redis {
+// NewRedis connects to redis at addr, or returns nil when addr is empty.
+// While breaker is open, the commands fail with upstream.ErrCircuitOpen
+// without reaching redis.
+func NewRedis(db int, addr, username, password string, breaker *upstream.Breaker) *Redis {
 	if addr == "" {
-		log.Println("Redis: NewRedis: No address provided, skipping redis config")
+		slog.Info("redis: no address provided, using the in-memory cache only")
 		return nil
 	}
 
@@ -27,14 +45,16 @@ func NewRedis(db int, addr, username, password string, ttl time.Duration) *Redis
 		Password: password,
 		DB:       db,
 	})
+	c.AddHook(redisHook{breaker: breaker})
 
 	status := c.Ping(context.Background())
 	if status.Err() != nil {
-		log.Fatal("Redis: NewRedis: Error connecting to redis:", status.Err())
+		slog.Error("redis: connecting", "addr", addr, "error", status.Err())
+		os.Exit(1)
 	}
 	return &Redis{
-		client: c,
-		ttl:    ttl,
+		client:  c,
+		breaker: breaker,
 	}
 }
 
@@ -47,23 +67,197 @@ func (r *Redis) Get(ctx context.Context, key string) (interface{}, error) {
 	var data interface{}
 	dec := gob.NewDecoder(bytes.NewReader(v))
 	if err := dec.Decode(&data); err != nil {
-		log.Println("Redis: Get: Error decoding value:", err)
-		return nil, err
+		return nil, fmt.Errorf("decoding value: %w", err)
 	}
 	return data, nil
 }
 
-func (r *Redis) Set(ctx context.Context, key string, value interface{}) error {
+// Set stores value under key, letting redis expire it after ttl.
+func (r *Redis) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
 	var b bytes.Buffer
 	enc := gob.NewEncoder(&b)
 	if err := enc.Encode(value); err != nil {
-		log.Println("Redis: Set: Error encoding value:", err)
+		slog.ErrorContext(ctx, "redis: encoding value", "key", key, "error", err)
 		return err
 	}
 
-	return r.client.Set(ctx, key, b.Bytes(), r.ttl).Err()
+	return r.client.Set(ctx, key, b.Bytes(), ttl).Err()
 }
 
 func (r *Redis) RemoveAll(ctx context.Context) error {
 	return r.client.FlushDB(ctx).Err()
 }
+
+// Del deletes key.
+func (r *Redis) Del(ctx context.Context, key string) error {
+	return r.client.Del(ctx, key).Err()
+}
+
+// DelPrefix deletes every key starting with prefix.
+func (r *Redis) DelPrefix(ctx context.Context, prefix string) error {
+	iter := r.client.Scan(ctx, 0, globEscape(prefix)+"*", 100).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == 100 {
+			if err := r.client.Del(ctx, keys...).Err(); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return r.client.Del(ctx, keys...).Err()
+	}
+	return nil
+}
+
+// globEscape escapes the redis glob pattern characters in s.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// tagKeyPrefix namespaces the sets of keys indexed under each tag. Cache
+// keys start with the request method, so they cannot collide.
+const tagKeyPrefix = "tag:"
+
+// addTagScript adds a key to a tag set and extends the set's expiration to
+// at least the key's, so the set lives as long as its longest-lived member.
+var addTagScript = redis.NewScript(`
+redis.call("SADD", KEYS[1], ARGV[1])
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// AddTags indexes key under each of tags for ttl.
+func (r *Redis) AddTags(ctx context.Context, key string, tags []string, ttl time.Duration) error {
+	for _, tag := range tags {
+		if err := addTagScript.Run(ctx, r.client, []string{tagKeyPrefix + tag}, key, ttl.Milliseconds()).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DelTag deletes every key indexed under tag and returns how many there were.
+func (r *Redis) DelTag(ctx context.Context, tag string) (int, error) {
+	keys, err := r.client.SMembers(ctx, tagKeyPrefix+tag).Result()
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), r.client.Del(ctx, append(keys, tagKeyPrefix+tag)...).Err()
+}
+
+// bansKey is the sorted set of the ban records, by creation time. Cache
+// keys start with the request method, so it cannot collide.
+const bansKey = "bans"
+
+// addBanScript records a ban, drops the ones older than its lifetime and
+// extends the set's expiration to at least that lifetime.
+var addBanScript = redis.NewScript(`
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", "(" .. (tonumber(ARGV[1]) - tonumber(ARGV[3])))
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[3]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// AddBan records the ban id created at created, for the other instances to
+// apply during lifetime.
+func (r *Redis) AddBan(ctx context.Context, id string, created time.Time, lifetime time.Duration) error {
+	return addBanScript.Run(ctx, r.client, []string{bansKey}, created.UnixMilli(), id, lifetime.Milliseconds()).Err()
+}
+
+// Bans returns the ban records, oldest first.
+func (r *Redis) Bans(ctx context.Context) ([]string, error) {
+	return r.client.ZRange(ctx, bansKey, 0, -1).Result()
+}
+
+// Close closes the connections to redis.
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+type redisStartKey struct{}
+type redisSpanKey struct{}
+
+// redisHook records the latency and the errors of every redis command, and
+// a span per command or pipeline. It rejects the commands while the circuit
+// breaker is open.
+type redisHook struct {
+	breaker *upstream.Breaker
+}
+
+func (h redisHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if err := h.breaker.Allow(); err != nil {
+		return ctx, err
+	}
+	return startRedis(ctx, cmd.Name()), nil
+}
+
+func (h redisHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.observe(ctx, cmd.Name(), cmd.Err())
+	return nil
+}
+
+func (h redisHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if err := h.breaker.Allow(); err != nil {
+		return ctx, err
+	}
+	return startRedis(ctx, "pipeline"), nil
+}
+
+func (h redisHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmd.Err() != nil && !errors.Is(cmd.Err(), redis.Nil) {
+			err = cmd.Err()
+		}
+	}
+	h.observe(ctx, "pipeline", err)
+	return nil
+}
+
+func startRedis(ctx context.Context, op string) context.Context {
+	ctx, span := tracing.Start(ctx, "redis "+op, tracing.KindClient)
+	span.SetAttr("db.system", "redis")
+	span.SetAttr("db.operation", op)
+	ctx = context.WithValue(ctx, redisSpanKey{}, span)
+	return context.WithValue(ctx, redisStartKey{}, time.Now())
+}
+
+// observe records the outcome of a command. Commands rejected by the
+// breaker carry no start time and are only counted as errors.
+func (h redisHook) observe(ctx context.Context, op string, err error) {
+	failed := err != nil && !errors.Is(err, redis.Nil)
+	if start, ok := ctx.Value(redisStartKey{}).(time.Time); ok {
+		redisDuration.With(op).ObserveSince(start)
+		servertiming.Since(ctx, "redis", start)
+		if ctx.Err() != nil {
+			// canceled by the caller, that says nothing about redis
+			h.breaker.Discard()
+		} else {
+			h.breaker.Record(failed, time.Since(start))
+		}
+	}
+	span, _ := ctx.Value(redisSpanKey{}).(*tracing.Span)
+	if failed {
+		redisErrors.With(op).Inc()
+		span.SetError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,181 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Gzip is the gzip content coding.
+	Gzip = "gzip"
+	// Zstd is the zstd content coding.
+	Zstd = "zstd"
+	// Brotli is the brotli content coding.
+	Brotli = "br"
+)
+
+// DefaultContentTypes lists the media types that are considered compressible
+// when no explicit list is configured. Entries ending in "/" match a whole type.
+var DefaultContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/ld+json",
+	"application/manifest+json",
+	"image/svg+xml",
+}
+
+// Supported reports whether alg is a content coding this package can produce.
+func Supported(alg string) bool {
+	switch alg {
+	case Gzip, Zstd, Brotli:
+		return true
+	}
+	return false
+}
+
+// NewWriter returns a writer that compresses everything written to it into w
+// using the given content coding. Callers must Close it to flush the stream.
+func NewWriter(alg string, w io.Writer) (io.WriteCloser, error) {
+	switch alg {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	case Brotli:
+		return brotli.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("compress: unsupported encoding %q", alg)
+	}
+}
+
+// Encode compresses b using the given content coding.
+func Encode(alg string, b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := NewWriter(alg, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decompresses b that was compressed with the given content coding.
+func Decode(alg string, b []byte) ([]byte, error) {
+	switch alg {
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case Zstd:
+		r, err := zstd.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case Brotli:
+		return io.ReadAll(brotli.NewReader(bytes.NewReader(b)))
+	default:
+		return nil, fmt.Errorf("compress: unsupported encoding %q", alg)
+	}
+}
+
+// Compressible reports whether a response with the given Content-Type header
+// value matches one of types. An empty types list falls back to DefaultContentTypes.
+func Compressible(contentType string, types []string) bool {
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if len(types) == 0 {
+		types = DefaultContentTypes
+	}
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+			return true
+		}
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Accepts reports whether the Accept-Encoding header value allows the given
+// content coding, honouring q-values and the "*" wildcard.
+func Accepts(acceptEncoding, alg string) bool {
+	return quality(acceptEncoding, alg) > 0
+}
+
+// Negotiate picks the content coding from algs preferred by the Accept-Encoding
+// header value. Ties on q-value are broken by the order of algs. It returns an
+// empty string when none of algs is acceptable.
+func Negotiate(acceptEncoding string, algs []string) string {
+	best, bestQ := "", 0.0
+	for _, alg := range algs {
+		q := quality(acceptEncoding, alg)
+		if q > bestQ {
+			best, bestQ = alg, q
+		}
+	}
+	return best
+}
+
+// quality returns the q-value the Accept-Encoding header value assigns to alg.
+func quality(acceptEncoding, alg string) float64 {
+	wildcard := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, q := parseCoding(part)
+		if name == alg {
+			return q
+		}
+		if name == "*" {
+			wildcard = q
+		}
+	}
+	return wildcard
+}
+
+// parseCoding splits an Accept-Encoding list element into its coding name and q-value.
+func parseCoding(s string) (string, float64) {
+	name, params, _ := strings.Cut(s, ";")
+	name = strings.ToLower(strings.TrimSpace(name))
+	q := 1.0
+	for _, p := range strings.Split(params, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || strings.ToLower(k) != "q" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return name, 0
+		}
+		q = f
+	}
+	return name, q
+}
@@ -0,0 +1,104 @@
+package compress
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	body := bytes.Repeat([]byte("hello compressible world "), 100)
+
+	for _, alg := range []string{Gzip, Zstd, Brotli} {
+		t.Run(alg, func(t *testing.T) {
+			encoded, err := Encode(alg, body)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if len(encoded) >= len(body) {
+				t.Errorf("expected encoded body to be smaller, got %d >= %d", len(encoded), len(body))
+			}
+			decoded, err := Decode(alg, encoded)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !bytes.Equal(decoded, body) {
+				t.Errorf("expected decoded body to match original")
+			}
+		})
+	}
+
+	if _, err := Encode("unknown", body); err == nil {
+		t.Errorf("expected error for unsupported encoding")
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		types       []string
+		expected    bool
+	}{
+		{name: "text with charset", contentType: "text/html; charset=utf-8", expected: true},
+		{name: "json", contentType: "application/json", expected: true},
+		{name: "image", contentType: "image/png", expected: false},
+		{name: "empty", contentType: "", expected: false},
+		{name: "custom list", contentType: "application/wasm", types: []string{"application/wasm"}, expected: true},
+		{name: "custom list excludes default", contentType: "text/plain", types: []string{"application/wasm"}, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Compressible(tt.contentType, tt.types); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		alg            string
+		expected       bool
+	}{
+		{name: "listed", acceptEncoding: "gzip, deflate, br", alg: Gzip, expected: true},
+		{name: "not listed", acceptEncoding: "deflate, br", alg: Gzip, expected: false},
+		{name: "q zero", acceptEncoding: "gzip;q=0, br", alg: Gzip, expected: false},
+		{name: "wildcard", acceptEncoding: "*", alg: Zstd, expected: true},
+		{name: "wildcard with explicit refusal", acceptEncoding: "*, zstd;q=0", alg: Zstd, expected: false},
+		{name: "empty", acceptEncoding: "", alg: Gzip, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Accepts(tt.acceptEncoding, tt.alg); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		algs           []string
+		expected       string
+	}{
+		{name: "first configured wins on tie", acceptEncoding: "gzip, br", algs: []string{Brotli, Gzip}, expected: Brotli},
+		{name: "higher q wins", acceptEncoding: "gzip, br;q=0.5", algs: []string{Brotli, Gzip}, expected: Gzip},
+		{name: "only one acceptable", acceptEncoding: "gzip", algs: []string{Brotli, Gzip}, expected: Gzip},
+		{name: "identity only", acceptEncoding: "identity", algs: []string{Brotli, Gzip}, expected: ""},
+		{name: "no header", acceptEncoding: "", algs: []string{Brotli, Gzip}, expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Negotiate(tt.acceptEncoding, tt.algs); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
@@ -1,17 +1,43 @@
 package config
 
 import (
-	"log"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// redactedValue replaces secrets in Redacted.
+const redactedValue = "REDACTED"
+
 const (
-	defaultCapacity = 100
-	defaultTTL      = 5 * time.Minute
+	defaultPort               = "8080"
+	defaultCapacity           = 100
+	defaultTTL                = 5 * time.Minute
+	defaultCompressionMinSize = 1024
+	defaultMaxObjectSize      = 10 << 20
+	defaultConnectTimeout     = 5 * time.Second
+	defaultTLSTimeout         = 5 * time.Second
+	defaultHeaderTimeout      = 30 * time.Second
+	defaultIdleConnTimeout    = 90 * time.Second
+	defaultMaxIdleConns       = 32
+	defaultRetryBackoff       = 50 * time.Millisecond
+	defaultRetryMaxBackoff    = time.Second
+	defaultRetryBudget        = 0.2
+	defaultRetryBurst         = 10
+	defaultBreakerWindow      = 20
+	defaultBreakerMinRequests = 10
+	defaultBreakerOpenTime    = 30 * time.Second
+	defaultShutdownTimeout    = 30 * time.Second
+	defaultWatchInterval      = 5 * time.Second
 )
 
 type Redis struct {
@@ -21,20 +47,350 @@ type Redis struct {
 	DB       int    `yaml:"db"`
 }
 
+// Compression holds the settings for compressing cached bodies at rest.
+type Compression struct {
+	// Algorithm is the content coding used at rest: "gzip", "zstd" or empty to disable.
+	Algorithm string `yaml:"algorithm"`
+
+	// MinSize is the minimum body size in bytes worth compressing.
+	MinSize int `yaml:"min_size"`
+
+	// ContentTypes lists the compressible media types. Entries ending in "/" match a whole type.
+	ContentTypes []string `yaml:"content_types"`
+}
+
+// Cache holds the cache-specific configuration settings.
+type Cache struct {
+	// Capacity defines the maximum number of items the cache can hold.
+	Capacity int `yaml:"capacity"`
+
+	// TTL specifies the duration for which an item should remain in the cache.
+	TTL YAMLDuration `yaml:"ttl"`
+
+	// Redis holds the Redis-specific configuration settings.
+	Redis Redis `yaml:"redis"`
+
+	// Compression holds the at-rest compression settings.
+	Compression Compression `yaml:"compression"`
+
+	// MaxObjectSize is the largest response body in bytes that is cached, 0 means no limit.
+	MaxObjectSize int64 `yaml:"max_object_size"`
+
+	// StaleTTL is how long expired responses are kept to be served while
+	// their origin is unavailable, 0 disables serving stale responses.
+	StaleTTL YAMLDuration `yaml:"stale_ttl"`
+
+	// RangeChunkSize enables fetching and caching uncached objects in chunks of
+	// this many bytes to answer range requests, 0 disables it.
+	RangeChunkSize int64 `yaml:"range_chunk_size"`
+
+	// Coalesce makes concurrent misses for the same object wait for the first
+	// one to fill the cache instead of all reaching the origin.
+	Coalesce bool `yaml:"coalesce"`
+}
+
+// ResponseCompression holds the settings for compressing responses sent to clients.
+type ResponseCompression struct {
+	// Encodings lists the content codings ("br", "gzip", "zstd") offered to clients
+	// in order of preference. An empty list disables response compression.
+	Encodings []string `yaml:"encodings"`
+
+	// MinSize is the minimum body size in bytes worth compressing.
+	MinSize int `yaml:"min_size"`
+
+	// ContentTypes lists the compressible media types. Entries ending in "/" match a whole type.
+	ContentTypes []string `yaml:"content_types"`
+}
+
+// Forwarding holds the settings for the forwarding headers sent to the origin.
+type Forwarding struct {
+	// TrustedProxies lists the IP addresses and CIDR prefixes of the peers
+	// whose X-Forwarded-* and Forwarded headers are kept and extended.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+// Server holds the settings of the proxy's HTTP server.
+type Server struct {
+	// Port is the port the proxy listens on.
+	Port string `yaml:"port"`
+
+	// ShutdownTimeout bounds draining the active requests on SIGTERM or SIGINT.
+	ShutdownTimeout YAMLDuration `yaml:"shutdown_timeout"`
+
+	// WatchInterval is how often the config file is checked for changes to
+	// reload, 0 disables watching. SIGHUP always reloads.
+	WatchInterval YAMLDuration `yaml:"watch_interval"`
+}
+
+// Admin holds the settings of the admin API.
+type Admin struct {
+	// Addr is the address the admin API listens on, e.g. "127.0.0.1:9090".
+	// An empty Addr disables the admin API.
+	Addr string `yaml:"addr"`
+
+	// Token is the bearer token every admin request must present.
+	Token string `yaml:"token"`
+
+	// Debug exposes pprof and the cache introspection endpoints under /debug/.
+	Debug bool `yaml:"debug"`
+}
+
+// Metrics holds the settings of the metrics listener.
+type Metrics struct {
+	// Addr is the address /metrics is served on without authentication,
+	// e.g. "127.0.0.1:9091". An empty Addr leaves the metrics on the admin
+	// API only.
+	Addr string `yaml:"addr"`
+}
+
+// Purge holds the settings of the PURGE and BAN methods on the proxy port.
+// Both lists empty disable them.
+type Purge struct {
+	// Allow lists the IP addresses and CIDR prefixes of the clients allowed to purge.
+	Allow []string `yaml:"allow"`
+
+	// Tokens lists the bearer tokens allowed to purge from any address.
+	Tokens []string `yaml:"tokens"`
+}
+
+// AccessLog holds the settings of the access log.
+type AccessLog struct {
+	// Output is "stdout", "stderr" or a file path, empty disables the access log.
+	Output string `yaml:"output"`
+
+	// Format is "combined" (the default) or "json".
+	Format string `yaml:"format"`
+
+	// SampleHits is the share of cache hits logged, from 0 to 1. Every other
+	// request is logged.
+	SampleHits float64 `yaml:"sample_hits"`
+}
+
+// Log holds the logging settings.
+type Log struct {
+	// Level is the minimum level logged: "debug", "info" (the default), "warn" or "error".
+	Level string `yaml:"level"`
+
+	// Format is "text" (the default) or "json".
+	Format string `yaml:"format"`
+
+	// Access holds the access log settings.
+	Access AccessLog `yaml:"access"`
+}
+
+// Tracing holds the settings of the tracing of requests.
+type Tracing struct {
+	// Endpoint is the OTLP/HTTP traces endpoint of a collector, e.g.
+	// "http://localhost:4318/v1/traces". An empty Endpoint disables tracing.
+	Endpoint string `yaml:"endpoint"`
+
+	// ServiceName is the service.name of the exported spans.
+	ServiceName string `yaml:"service_name"`
+
+	// SampleRatio is the share of the traces started by the proxy that are
+	// exported, from 0 to 1. Requests with a traceparent follow its decision.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// ServerTiming holds the settings of the Server-Timing response header,
+// which tells how long the cache, redis and the origin took.
+type ServerTiming struct {
+	// Enabled adds the header to every response.
+	Enabled bool `yaml:"enabled"`
+
+	// Tokens lists the values of the X-Debug-Token request header that add
+	// the header to a single response.
+	Tokens []string `yaml:"tokens"`
+}
+
+// Upstream holds the settings for the connections and requests to the origins.
+type Upstream struct {
+	// Origin is the origin server of the requests matching none of the
+	// routes, it may be empty when the routes match every request.
+	Origin string `yaml:"origin"`
+
+	// ConnectTimeout bounds establishing a connection, 0 means no timeout.
+	ConnectTimeout YAMLDuration `yaml:"connect_timeout"`
+
+	// TLSTimeout bounds the TLS handshake, 0 means no timeout.
+	TLSTimeout YAMLDuration `yaml:"tls_timeout"`
+
+	// HeaderTimeout bounds waiting for the response headers, 0 means no timeout.
+	HeaderTimeout YAMLDuration `yaml:"header_timeout"`
+
+	// Timeout bounds a whole origin request including the body, 0 means no timeout.
+	Timeout YAMLDuration `yaml:"timeout"`
+
+	// IdleConnTimeout is how long an idle keep-alive connection is kept open.
+	IdleConnTimeout YAMLDuration `yaml:"idle_conn_timeout"`
+
+	// MaxIdleConnsPerHost is the number of idle keep-alive connections kept per origin.
+	MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host"`
+
+	// Retries is the maximum number of retries of a failed idempotent request, 0 disables retries.
+	Retries int `yaml:"retries"`
+
+	// RetryBackoff is the base delay of the exponential backoff between retries.
+	RetryBackoff YAMLDuration `yaml:"retry_backoff"`
+
+	// RetryMaxBackoff caps the delay between retries.
+	RetryMaxBackoff YAMLDuration `yaml:"retry_max_backoff"`
+
+	// RetryBudget is the share of requests that may be retried, e.g. 0.2 for 20%.
+	RetryBudget float64 `yaml:"retry_budget"`
+
+	// RetryBurst is the number of retries allowed beyond the budget after a quiet period.
+	RetryBurst int `yaml:"retry_burst"`
+}
+
+// CircuitBreaker holds the settings of the circuit breaker of every origin.
+type CircuitBreaker struct {
+	// Window is the number of most recent requests the rates are computed over.
+	Window int `yaml:"window"`
+
+	// MinRequests is the number of requests in the window before the breaker may open.
+	MinRequests int `yaml:"min_requests"`
+
+	// ErrorRate is the share of failed requests, from 0 to 1, that opens the breaker.
+	// A zero ErrorRate and SlowCallRate disable the origin breakers, the redis
+	// breaker then opens at an error rate of 0.5.
+	ErrorRate float64 `yaml:"error_rate"`
+
+	// SlowCall is the latency above which a request counts as slow.
+	SlowCall YAMLDuration `yaml:"slow_call"`
+
+	// SlowCallRate is the share of slow requests, from 0 to 1, that opens the breaker.
+	SlowCallRate float64 `yaml:"slow_call_rate"`
+
+	// OpenTime is how long an open breaker rejects requests before probing the origin.
+	OpenTime YAMLDuration `yaml:"open_time"`
+
+	// HalfOpenRequests is the number of successful probes that close the breaker.
+	HalfOpenRequests int `yaml:"half_open_requests"`
+}
+
+// HeaderRules describes changes applied to a header.
+type HeaderRules struct {
+	// Set replaces the values of these fields.
+	Set map[string]string `yaml:"set"`
+
+	// Remove deletes these fields.
+	Remove []string `yaml:"remove"`
+}
+
+// HealthCheck holds the active health check settings of a route's origins.
+type HealthCheck struct {
+	// Path is requested on every origin, a 2xx or 3xx status means healthy.
+	Path string `yaml:"path"`
+
+	// Interval is the time between two checks, 0 disables health checks.
+	Interval YAMLDuration `yaml:"interval"`
+
+	// Timeout bounds a single check, 0 defaults to the interval capped at 5s.
+	Timeout YAMLDuration `yaml:"timeout"`
+
+	// HealthyThreshold is the number of consecutive successes to re-admit an origin.
+	HealthyThreshold int `yaml:"healthy_threshold"`
+
+	// UnhealthyThreshold is the number of consecutive failures to mark an origin unhealthy.
+	UnhealthyThreshold int `yaml:"unhealthy_threshold"`
+}
+
+// OutlierDetection holds the passive ejection settings of a route's origins.
+type OutlierDetection struct {
+	// ConsecutiveFailures is the number of 5xx responses or errors in a row
+	// that eject an origin, 0 disables outlier detection.
+	ConsecutiveFailures int `yaml:"consecutive_failures"`
+
+	// EjectionTime is how long an ejected origin receives no traffic.
+	EjectionTime YAMLDuration `yaml:"ejection_time"`
+}
+
+// Route maps requests matching a host pattern and a path prefix to an origin.
+type Route struct {
+	// Name identifies the route in metrics, it defaults to its host and path prefix.
+	Name string `yaml:"name"`
+
+	// Host is an exact host name or a "*.example.com" wildcard, empty matches every host.
+	Host string `yaml:"host"`
+
+	// PathPrefix is the prefix the request path must start with, empty matches every path.
+	PathPrefix string `yaml:"path_prefix"`
+
+	// Origin is the upstream server the matching requests are forwarded to.
+	Origin string `yaml:"origin"`
+
+	// Origins lists a pool of upstream servers to balance the requests over,
+	// in addition to Origin.
+	Origins []string `yaml:"origins"`
+
+	// Balancer is "round_robin" (the default), "least_conn" or "consistent_hash".
+	Balancer string `yaml:"balancer"`
+
+	// HealthCheck holds the active health check settings.
+	HealthCheck HealthCheck `yaml:"health_check"`
+
+	// OutlierDetection holds the passive ejection settings.
+	OutlierDetection OutlierDetection `yaml:"outlier_detection"`
+
+	// TTL overrides the cache TTL for this route, 0 keeps the cache TTL.
+	TTL YAMLDuration `yaml:"ttl"`
+
+	// CachePolicy is either "cache" (the default) or "bypass" to never cache.
+	CachePolicy string `yaml:"cache_policy"`
+
+	// RequestHeaders are applied to the requests forwarded to the origin.
+	RequestHeaders HeaderRules `yaml:"request_headers"`
+
+	// ResponseHeaders are applied to the responses sent to the client.
+	ResponseHeaders HeaderRules `yaml:"response_headers"`
+}
+
 // Config represents the configuration settings for the caching proxy.
 // It contains settings related to the cache, including its capacity and TTL (time-to-live).
 type Config struct {
+	// Server holds the HTTP server settings.
+	Server Server `yaml:"server"`
+
+	// Log holds the logging settings.
+	Log Log `yaml:"log"`
+
+	// Tracing holds the tracing settings.
+	Tracing Tracing `yaml:"tracing"`
+
+	// ServerTiming holds the Server-Timing header settings.
+	ServerTiming ServerTiming `yaml:"server_timing"`
+
+	// Admin holds the admin API settings.
+	Admin Admin `yaml:"admin"`
+
+	// Metrics holds the metrics listener settings.
+	Metrics Metrics `yaml:"metrics"`
+
+	// Purge holds the PURGE and BAN settings.
+	Purge Purge `yaml:"purge"`
+
 	// Cache holds the cache-specific configuration settings.
-	Cache struct {
-		// Capacity defines the maximum number of items the cache can hold.
-		Capacity int `yaml:"capacity"`
+	Cache Cache `yaml:"cache"`
+
+	// Compression holds the client-facing response compression settings.
+	Compression ResponseCompression `yaml:"compression"`
+
+	// Forwarding holds the forwarding headers settings.
+	Forwarding Forwarding `yaml:"forwarding"`
+
+	// Upstream holds the origin timeouts and retry settings.
+	Upstream Upstream `yaml:"upstream"`
 
-		// TTL specifies the duration for which an item should remain in the cache.
-		TTL YAMLDuration `yaml:"ttl"`
+	// CircuitBreaker holds the origin circuit breaker settings.
+	CircuitBreaker CircuitBreaker `yaml:"circuit_breaker"`
 
-		// Redis holds the Redis-specific configuration settings.
-		Redis Redis `yaml:"redis"`
-	} `yaml:"cache"`
+	// Routes maps requests to origins, the first matching route wins.
+	Routes []Route `yaml:"routes"`
+
+	// sources records the layer of the fields set by a file, the environment
+	// or a flag, by YAML path. The others keep their default.
+	sources map[string]Source
 }
 
 // NewConfig creates a new instance of Config with default cache settings.
@@ -44,51 +400,82 @@ func NewConfig() *Config {
 	cfg := &Config{}
 	cfg.Cache.Capacity = defaultCapacity
 	cfg.Cache.TTL = YAMLDuration(defaultTTL)
+	cfg.Cache.Compression.MinSize = defaultCompressionMinSize
+	cfg.Cache.MaxObjectSize = defaultMaxObjectSize
+	cfg.Compression.MinSize = defaultCompressionMinSize
+	cfg.Server.Port = defaultPort
+	cfg.Server.ShutdownTimeout = YAMLDuration(defaultShutdownTimeout)
+	cfg.Server.WatchInterval = YAMLDuration(defaultWatchInterval)
+	cfg.Log.Level = "info"
+	cfg.Log.Format = "text"
+	cfg.Log.Access.Format = "combined"
+	cfg.Log.Access.SampleHits = 1
+	cfg.Tracing.ServiceName = "caching-proxy"
+	cfg.Tracing.SampleRatio = 1
+	cfg.Upstream.ConnectTimeout = YAMLDuration(defaultConnectTimeout)
+	cfg.Upstream.TLSTimeout = YAMLDuration(defaultTLSTimeout)
+	cfg.Upstream.HeaderTimeout = YAMLDuration(defaultHeaderTimeout)
+	cfg.Upstream.IdleConnTimeout = YAMLDuration(defaultIdleConnTimeout)
+	cfg.Upstream.MaxIdleConnsPerHost = defaultMaxIdleConns
+	cfg.Upstream.RetryBackoff = YAMLDuration(defaultRetryBackoff)
+	cfg.Upstream.RetryMaxBackoff = YAMLDuration(defaultRetryMaxBackoff)
+	cfg.Upstream.RetryBudget = defaultRetryBudget
+	cfg.Upstream.RetryBurst = defaultRetryBurst
+	cfg.CircuitBreaker.Window = defaultBreakerWindow
+	cfg.CircuitBreaker.MinRequests = defaultBreakerMinRequests
+	cfg.CircuitBreaker.OpenTime = YAMLDuration(defaultBreakerOpenTime)
+	cfg.CircuitBreaker.HalfOpenRequests = 1
 	return cfg
 }
 
-// OverrideFromConfigYAML overrides the provided configuration with values from a YAML file.
-// It reads the YAML file specified by the 'file' parameter and unmarshals its content into a temporary Config struct.
-// If the YAML file contains non-zero values for certain fields, those values will override the corresponding fields in the provided 'cfg' parameter.
-// If the YAML file is not found, it logs a message and returns nil.
-//
-// Parameters:
-//   - cfg: A pointer to the Config struct to be overridden.
-//   - file: The path to the YAML file containing the configuration overrides.
-//
-// Returns:
-//   - error: An error if there is an issue reading the file or unmarshalling its content, otherwise nil.
+// Redacted returns a copy of the configuration with its secrets masked, safe
+// to show to operators.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	if redacted.Cache.Redis.Password != "" {
+		redacted.Cache.Redis.Password = redactedValue
+	}
+	if redacted.Admin.Token != "" {
+		redacted.Admin.Token = redactedValue
+	}
+	if len(redacted.Purge.Tokens) > 0 {
+		redacted.Purge.Tokens = []string{redactedValue}
+	}
+	if len(redacted.ServerTiming.Tokens) > 0 {
+		redacted.ServerTiming.Tokens = []string{redactedValue}
+	}
+	return &redacted
+}
+
+// OverrideFromConfigYAML overrides the fields of cfg set in the YAML file,
+// including those set to a zero value, and keeps the others. Keys that match
+// no field are rejected. If the file is not found, it logs a message and
+// returns nil.
 func OverrideFromConfigYAML(cfg *Config, file string) error {
 	b, err := os.ReadFile(file)
 	if err != nil {
-		log.Println("config.yaml not found")
+		slog.Info("config file not found, using the defaults", "file", file)
 		return nil
 	}
 
-	var fileCfg Config
-	if err = yaml.Unmarshal(b, &cfg); err != nil {
-		return err
+	// unknown keys are rejected, they are most likely misspelled settings
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err = dec.Decode(cfg); err != nil {
+		if errors.Is(err, io.EOF) {
+			// an empty file sets nothing
+			return nil
+		}
+		return fmt.Errorf("%s: %w", file, err)
 	}
 
-	if fileCfg.Cache.Capacity != 0 {
-		cfg.Cache.Capacity = fileCfg.Cache.Capacity
-	}
-	if fileCfg.Cache.TTL != 0 {
-		cfg.Cache.TTL = fileCfg.Cache.TTL
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
 	}
-	if fileCfg.Cache.Redis.Addr != "" {
-		cfg.Cache.Redis.Addr = fileCfg.Cache.Redis.Addr
+	for _, field := range setFields(&root, "") {
+		cfg.setSource(field, SourceFile)
 	}
-	if fileCfg.Cache.Redis.Username != "" {
-		cfg.Cache.Redis.Username = fileCfg.Cache.Redis.Username
-	}
-	if fileCfg.Cache.Redis.Password != "" {
-		cfg.Cache.Redis.Password = fileCfg.Cache.Redis.Password
-	}
-	if fileCfg.Cache.Redis.DB != 0 {
-		cfg.Cache.Redis.DB = fileCfg.Cache.Redis.DB
-	}
-
 	return nil
 }
 
@@ -101,40 +488,229 @@ func OverrideFromConfigYAML(cfg *Config, file string) error {
 // - REDIS_USERNAME: sets the Cache.Redis.Username field (expects a string value).
 // - REDIS_PASSWORD: sets the Cache.Redis.Password field (expects a string value).
 // - REDIS_DB: sets the Cache.Redis.DB field (expects an integer value).
+// - CACHE_COMPRESSION: sets the Cache.Compression.Algorithm field (expects "gzip", "zstd" or "").
+// - CACHE_COMPRESSION_MIN_SIZE: sets the Cache.Compression.MinSize field (expects an integer value).
+// - CACHE_MAX_OBJECT_SIZE: sets the Cache.MaxObjectSize field (expects an integer value in bytes).
+// - CACHE_RANGE_CHUNK_SIZE: sets the Cache.RangeChunkSize field (expects an integer value in bytes).
+// - COMPRESSION_ENCODINGS: sets the Compression.Encodings field (expects a comma-separated list, e.g., "br,gzip").
+// - TRUSTED_PROXIES: sets the Forwarding.TrustedProxies field (expects a comma-separated list, e.g., "10.0.0.0/8,127.0.0.1").
+// - UPSTREAM_CONNECT_TIMEOUT, UPSTREAM_HEADER_TIMEOUT, UPSTREAM_TIMEOUT: set the Upstream timeouts (expect duration strings).
+// - UPSTREAM_RETRIES: sets the Upstream.Retries field (expects an integer value).
+// - CACHE_STALE_TTL: sets the Cache.StaleTTL field (expects a duration string).
+// - SHUTDOWN_TIMEOUT: sets the Server.ShutdownTimeout field (expects a duration string).
+// - ADMIN_ADDR: sets the Admin.Addr field (expects a string value, e.g., "127.0.0.1:9090").
+// - ADMIN_TOKEN: sets the Admin.Token field (expects a string value).
+// - ADMIN_DEBUG: sets the Admin.Debug field (expects a boolean value).
+// - METRICS_ADDR: sets the Metrics.Addr field (expects a string value, e.g., "127.0.0.1:9091").
+// - PURGE_ALLOW: sets the Purge.Allow field (expects a comma-separated list, e.g., "10.0.0.0/8").
+// - PURGE_TOKENS: sets the Purge.Tokens field (expects a comma-separated list).
+// - CACHE_COALESCE: sets the Cache.Coalesce field (expects a boolean value).
+// - LOG_LEVEL: sets the Log.Level field (expects "debug", "info", "warn" or "error").
+// - LOG_FORMAT: sets the Log.Format field (expects "text" or "json").
+// - ACCESS_LOG: sets the Log.Access.Output field (expects "stdout", "stderr" or a file path).
+// - ACCESS_LOG_FORMAT: sets the Log.Access.Format field (expects "combined" or "json").
+// - ACCESS_LOG_SAMPLE_HITS: sets the Log.Access.SampleHits field (expects a number from 0 to 1).
+// - TRACING_ENDPOINT: sets the Tracing.Endpoint field (expects a URL, e.g., "http://localhost:4318/v1/traces").
+// - TRACING_SAMPLE_RATIO: sets the Tracing.SampleRatio field (expects a number from 0 to 1).
+// - CACHING_PROXY_PORT: sets the Server.Port field (expects a port number).
+// - CACHING_PROXY_ORIGIN: sets the Upstream.Origin field (expects a URL, e.g., "http://localhost:3000").
+// - SERVER_TIMING: sets the ServerTiming.Enabled field (expects a boolean value).
+// - SERVER_TIMING_TOKENS: sets the ServerTiming.Tokens field (expects a comma-separated list).
 //
 // If any of the environment variables contain invalid values, an error is returned.
 func OverrideFromEnvironment(cfg *Config) error {
-	if v, ok := os.LookupEnv("CACHE_CAPACITY"); ok {
+	if v, ok := cfg.lookupEnv("CACHING_PROXY_PORT", "server.port"); ok {
+		cfg.Server.Port = v
+	}
+	if v, ok := cfg.lookupEnv("CACHING_PROXY_ORIGIN", "upstream.origin"); ok {
+		cfg.Upstream.Origin = v
+	}
+	if v, ok := cfg.lookupEnv("CACHE_CAPACITY", "cache.capacity"); ok {
 		c, err := strconv.Atoi(v)
 		if err != nil {
-			return err
+			return envError("CACHE_CAPACITY", "cache.capacity", v, err)
 		}
 		cfg.Cache.Capacity = c
 	}
 
-	if v, ok := os.LookupEnv("CACHE_TTL"); ok {
+	if v, ok := cfg.lookupEnv("CACHE_TTL", "cache.ttl"); ok {
 		d, err := time.ParseDuration(v)
 		if err != nil {
-			return err
+			return envError("CACHE_TTL", "cache.ttl", v, err)
 		}
 		cfg.Cache.TTL = YAMLDuration(d)
 	}
 
-	if v, ok := os.LookupEnv("REDIS_ADDR"); ok {
+	if v, ok := cfg.lookupEnv("REDIS_ADDR", "cache.redis.addr"); ok {
 		cfg.Cache.Redis.Addr = v
 	}
-	if v, ok := os.LookupEnv("REDIS_USERNAME"); ok {
+	if v, ok := cfg.lookupEnv("REDIS_USERNAME", "cache.redis.username"); ok {
 		cfg.Cache.Redis.Username = v
 	}
-	if v, ok := os.LookupEnv("REDIS_PASSWORD"); ok {
+	if v, ok := cfg.lookupEnv("REDIS_PASSWORD", "cache.redis.password"); ok {
 		cfg.Cache.Redis.Password = v
 	}
-	if v, ok := os.LookupEnv("REDIS_DB"); ok {
+	if v, ok := cfg.lookupEnv("REDIS_DB", "cache.redis.db"); ok {
 		db, err := strconv.Atoi(v)
 		if err != nil {
-			return err
+			return envError("REDIS_DB", "cache.redis.db", v, err)
 		}
 		cfg.Cache.Redis.DB = db
 	}
+
+	if v, ok := cfg.lookupEnv("CACHE_COMPRESSION", "cache.compression.algorithm"); ok {
+		cfg.Cache.Compression.Algorithm = v
+	}
+	if v, ok := cfg.lookupEnv("CACHE_COMPRESSION_MIN_SIZE", "cache.compression.min_size"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return envError("CACHE_COMPRESSION_MIN_SIZE", "cache.compression.min_size", v, err)
+		}
+		cfg.Cache.Compression.MinSize = n
+	}
+	if v, ok := cfg.lookupEnv("CACHE_MAX_OBJECT_SIZE", "cache.max_object_size"); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return envError("CACHE_MAX_OBJECT_SIZE", "cache.max_object_size", v, err)
+		}
+		cfg.Cache.MaxObjectSize = n
+	}
+	if v, ok := cfg.lookupEnv("CACHE_RANGE_CHUNK_SIZE", "cache.range_chunk_size"); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return envError("CACHE_RANGE_CHUNK_SIZE", "cache.range_chunk_size", v, err)
+		}
+		cfg.Cache.RangeChunkSize = n
+	}
+	if v, ok := cfg.lookupEnv("COMPRESSION_ENCODINGS", "compression.encodings"); ok {
+		cfg.Compression.Encodings = splitList(v)
+	}
+	if v, ok := cfg.lookupEnv("TRUSTED_PROXIES", "forwarding.trusted_proxies"); ok {
+		cfg.Forwarding.TrustedProxies = splitList(v)
+	}
+	if v, ok := cfg.lookupEnv("ADMIN_ADDR", "admin.addr"); ok {
+		cfg.Admin.Addr = v
+	}
+	if v, ok := cfg.lookupEnv("ADMIN_TOKEN", "admin.token"); ok {
+		cfg.Admin.Token = v
+	}
+	if v, ok := cfg.lookupEnv("ADMIN_DEBUG", "admin.debug"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return envError("ADMIN_DEBUG", "admin.debug", v, err)
+		}
+		cfg.Admin.Debug = b
+	}
+	if v, ok := cfg.lookupEnv("METRICS_ADDR", "metrics.addr"); ok {
+		cfg.Metrics.Addr = v
+	}
+	if v, ok := cfg.lookupEnv("PURGE_ALLOW", "purge.allow"); ok {
+		cfg.Purge.Allow = splitList(v)
+	}
+	if v, ok := cfg.lookupEnv("PURGE_TOKENS", "purge.tokens"); ok {
+		cfg.Purge.Tokens = splitList(v)
+	}
+	for _, d := range []struct {
+		env, field string
+		value      *YAMLDuration
+	}{
+		{"UPSTREAM_CONNECT_TIMEOUT", "upstream.connect_timeout", &cfg.Upstream.ConnectTimeout},
+		{"UPSTREAM_HEADER_TIMEOUT", "upstream.header_timeout", &cfg.Upstream.HeaderTimeout},
+		{"UPSTREAM_TIMEOUT", "upstream.timeout", &cfg.Upstream.Timeout},
+		{"CACHE_STALE_TTL", "cache.stale_ttl", &cfg.Cache.StaleTTL},
+		{"SHUTDOWN_TIMEOUT", "server.shutdown_timeout", &cfg.Server.ShutdownTimeout},
+	} {
+		if v, ok := cfg.lookupEnv(d.env, d.field); ok {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return envError(d.env, d.field, v, err)
+			}
+			*d.value = YAMLDuration(parsed)
+		}
+	}
+	if v, ok := cfg.lookupEnv("UPSTREAM_RETRIES", "upstream.retries"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return envError("UPSTREAM_RETRIES", "upstream.retries", v, err)
+		}
+		cfg.Upstream.Retries = n
+	}
+	if v, ok := cfg.lookupEnv("CACHE_COALESCE", "cache.coalesce"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return envError("CACHE_COALESCE", "cache.coalesce", v, err)
+		}
+		cfg.Cache.Coalesce = b
+	}
+	if v, ok := cfg.lookupEnv("LOG_LEVEL", "log.level"); ok {
+		cfg.Log.Level = v
+	}
+	if v, ok := cfg.lookupEnv("LOG_FORMAT", "log.format"); ok {
+		cfg.Log.Format = v
+	}
+	if v, ok := cfg.lookupEnv("ACCESS_LOG", "log.access.output"); ok {
+		cfg.Log.Access.Output = v
+	}
+	if v, ok := cfg.lookupEnv("ACCESS_LOG_FORMAT", "log.access.format"); ok {
+		cfg.Log.Access.Format = v
+	}
+	if v, ok := cfg.lookupEnv("ACCESS_LOG_SAMPLE_HITS", "log.access.sample_hits"); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return envError("ACCESS_LOG_SAMPLE_HITS", "log.access.sample_hits", v, err)
+		}
+		cfg.Log.Access.SampleHits = f
+	}
+	if v, ok := cfg.lookupEnv("TRACING_ENDPOINT", "tracing.endpoint"); ok {
+		cfg.Tracing.Endpoint = v
+	}
+	if v, ok := cfg.lookupEnv("TRACING_SAMPLE_RATIO", "tracing.sample_ratio"); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return envError("TRACING_SAMPLE_RATIO", "tracing.sample_ratio", v, err)
+		}
+		cfg.Tracing.SampleRatio = f
+	}
+	if v, ok := cfg.lookupEnv("SERVER_TIMING", "server_timing.enabled"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return envError("SERVER_TIMING", "server_timing.enabled", v, err)
+		}
+		cfg.ServerTiming.Enabled = b
+	}
+	if v, ok := cfg.lookupEnv("SERVER_TIMING_TOKENS", "server_timing.tokens"); ok {
+		cfg.ServerTiming.Tokens = splitList(v)
+	}
 	return nil
 }
+
+// OverrideFromFlags overrides the fields of cfg with the command line flags
+// the user passed, the flags left to their default are ignored:
+//   - port: sets the Server.Port field.
+//   - origin: sets the Upstream.Origin field.
+func OverrideFromFlags(cfg *Config, fs *flag.FlagSet) {
+	if fs == nil {
+		return
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Server.Port = f.Value.String()
+			cfg.setSource("server.port", SourceFlag)
+		case "origin":
+			cfg.Upstream.Origin = f.Value.String()
+			cfg.setSource("upstream.origin", SourceFlag)
+		}
+	})
+}
+
+// splitList splits a comma-separated environment value, dropping empty elements.
+func splitList(v string) []string {
+	var list []string
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"os"
 	"testing"
 	"time"
@@ -25,11 +26,7 @@ cache:
     db: 1
 `,
 			expected: Config{
-				Cache: struct {
-					Capacity int          `yaml:"capacity"`
-					TTL      YAMLDuration `yaml:"ttl"`
-					Redis    Redis        `yaml:"redis"`
-				}{
+				Cache: Cache{
 					Capacity: 200,
 					TTL:      YAMLDuration(10 * time.Minute),
 					Redis: Redis{
@@ -50,11 +47,7 @@ cache:
     addr: "localhost:6380"
 `,
 			expected: Config{
-				Cache: struct {
-					Capacity int          `yaml:"capacity"`
-					TTL      YAMLDuration `yaml:"ttl"`
-					Redis    Redis        `yaml:"redis"`
-				}{
+				Cache: Cache{
 					Capacity: 150,
 					TTL:      YAMLDuration(0),
 					Redis: Redis{
@@ -79,11 +72,7 @@ cache:
     db: 0
 `,
 			expected: Config{
-				Cache: struct {
-					Capacity int          `yaml:"capacity"`
-					TTL      YAMLDuration `yaml:"ttl"`
-					Redis    Redis        `yaml:"redis"`
-				}{
+				Cache: Cache{
 					Capacity: 0,
 					TTL:      YAMLDuration(0),
 					Redis: Redis{
@@ -155,11 +144,7 @@ func TestOverrideFromEnvironment(t *testing.T) {
 				"REDIS_DB":       "1",
 			},
 			expected: Config{
-				Cache: struct {
-					Capacity int          `yaml:"capacity"`
-					TTL      YAMLDuration `yaml:"ttl"`
-					Redis    Redis        `yaml:"redis"`
-				}{
+				Cache: Cache{
 					Capacity: 200,
 					TTL:      YAMLDuration(10 * time.Minute),
 					Redis: Redis{
@@ -178,11 +163,7 @@ func TestOverrideFromEnvironment(t *testing.T) {
 				"REDIS_ADDR":     "localhost:6380",
 			},
 			expected: Config{
-				Cache: struct {
-					Capacity int          `yaml:"capacity"`
-					TTL      YAMLDuration `yaml:"ttl"`
-					Redis    Redis        `yaml:"redis"`
-				}{
+				Cache: Cache{
 					Capacity: 150,
 					TTL:      YAMLDuration(0),
 					Redis: Redis{
@@ -205,11 +186,7 @@ func TestOverrideFromEnvironment(t *testing.T) {
 				"REDIS_DB":       "0",
 			},
 			expected: Config{
-				Cache: struct {
-					Capacity int          `yaml:"capacity"`
-					TTL      YAMLDuration `yaml:"ttl"`
-					Redis    Redis        `yaml:"redis"`
-				}{
+				Cache: Cache{
 					Capacity: 0,
 					TTL:      YAMLDuration(0),
 					Redis: Redis{
@@ -259,3 +236,83 @@ func TestOverrideFromEnvironment(t *testing.T) {
 		})
 	}
 }
+
+func TestOverrideFromEnvironment_Invalid(t *testing.T) {
+	tests := []struct {
+		env, value, field, message string
+	}{
+		{"CACHE_CAPACITY", "ten", "cache.capacity", `invalid CACHE_CAPACITY "ten": invalid syntax`},
+		{"ADMIN_DEBUG", "maybe", "admin.debug", `invalid ADMIN_DEBUG "maybe": invalid syntax`},
+		{"UPSTREAM_TIMEOUT", "5", "upstream.timeout", `invalid UPSTREAM_TIMEOUT "5": time: missing unit in duration "5"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+
+			var fieldErr *FieldError
+			err := OverrideFromEnvironment(NewConfig())
+			if !errors.As(err, &fieldErr) {
+				t.Fatalf("expected a *FieldError, got %v", err)
+			}
+			if fieldErr.Field != tt.field || fieldErr.Message != tt.message {
+				t.Errorf("expected %s: %s, got %v", tt.field, tt.message, fieldErr)
+			}
+		})
+	}
+}
+
+func TestOverrideFromConfigYAML_Routes(t *testing.T) {
+	file, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(file.Name())
+
+	fileData := `
+routes:
+  - host: "*.example.com"
+    path_prefix: /api
+    origin: http://api:8080
+    ttl: 30s
+    cache_policy: bypass
+    request_headers:
+      set:
+        X-Route: api
+      remove:
+        - Cookie
+  - path_prefix: /static
+    origin: http://static:8080
+`
+	if _, err := file.Write([]byte(fileData)); err != nil {
+		t.Fatalf("failed to write to temp file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close temp file: %v", err)
+	}
+
+	var cfg Config
+	if err := OverrideFromConfigYAML(&cfg, file.Name()); err != nil {
+		t.Fatalf("OverrideFromConfigYAML() error = %v", err)
+	}
+
+	if len(cfg.Routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(cfg.Routes))
+	}
+	api := cfg.Routes[0]
+	if api.Host != "*.example.com" || api.PathPrefix != "/api" || api.Origin != "http://api:8080" {
+		t.Errorf("unexpected route matching settings: %+v", api)
+	}
+	if api.TTL != YAMLDuration(30*time.Second) {
+		t.Errorf("expected route ttl %v, got %v", YAMLDuration(30*time.Second), api.TTL)
+	}
+	if api.CachePolicy != "bypass" {
+		t.Errorf("expected cache policy %q, got %q", "bypass", api.CachePolicy)
+	}
+	if api.RequestHeaders.Set["X-Route"] != "api" || len(api.RequestHeaders.Remove) != 1 {
+		t.Errorf("unexpected request header rules: %+v", api.RequestHeaders)
+	}
+	if cfg.Routes[1].Origin != "http://static:8080" {
+		t.Errorf("expected origin %q, got %q", "http://static:8080", cfg.Routes[1].Origin)
+	}
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Source is the layer a configuration value comes from. Each layer
+// overrides the ones before it: defaults, then the file, the environment
+// and the command line flags.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// Source returns the layer the value of field, a YAML path such as
+// "cache.ttl" or "routes[0].origin", comes from.
+func (c *Config) Source(field string) Source {
+	for {
+		if source, ok := c.sources[field]; ok {
+			return source
+		}
+		// a list or a section set as a whole sets all of its fields
+		i := strings.LastIndexAny(field, ".[")
+		if i < 0 {
+			return SourceDefault
+		}
+		field = field[:i]
+	}
+}
+
+// reloadableFields are the settings a running proxy applies on reload.
+var reloadableFields = []string{"routes", "cache.ttl", "log.level"}
+
+// WithReloaded returns a copy of c with the routes, the cache TTL and the
+// log level of next, and their sources. The other settings of next only
+// apply after a restart.
+func (c *Config) WithReloaded(next *Config) *Config {
+	applied := *c
+	applied.Routes = next.Routes
+	applied.Cache.TTL = next.Cache.TTL
+	applied.Log.Level = next.Log.Level
+
+	applied.sources = make(map[string]Source, len(c.sources))
+	for field, source := range c.sources {
+		if !reloadable(field) {
+			applied.sources[field] = source
+		}
+	}
+	for field, source := range next.sources {
+		if reloadable(field) {
+			applied.sources[field] = source
+		}
+	}
+	return &applied
+}
+
+// reloadable reports whether field is one of reloadableFields or below one.
+func reloadable(field string) bool {
+	for _, f := range reloadableFields {
+		if field == f || strings.HasPrefix(field, f+".") || strings.HasPrefix(field, f+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) setSource(field string, source Source) {
+	if c.sources == nil {
+		c.sources = make(map[string]Source)
+	}
+	c.sources[field] = source
+}
+
+// lookupEnv is os.LookupEnv, recording the environment as the source of
+// field when the variable is set.
+func (c *Config) lookupEnv(name, field string) (string, bool) {
+	v, ok := os.LookupEnv(name)
+	if ok {
+		c.setSource(field, SourceEnv)
+	}
+	return v, ok
+}
+
+// envError returns the *FieldError of a value of the environment variable
+// name, setting field, that could not be parsed.
+func envError(name, field, value string, err error) error {
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		err = numErr.Err
+	}
+	return &FieldError{Field: field, Message: fmt.Sprintf("invalid %s %q: %s", name, value, err)}
+}
+
+// setFields returns the paths of the fields set in a YAML document. Lists
+// are set as a whole.
+func setFields(node *yaml.Node, prefix string) []string {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		var fields []string
+		for _, n := range node.Content {
+			fields = append(fields, setFields(n, prefix)...)
+		}
+		return fields
+	case yaml.MappingNode:
+		var fields []string
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			field := node.Content[i].Value
+			if prefix != "" {
+				field = prefix + "." + field
+			}
+			fields = append(fields, setFields(node.Content[i+1], field)...)
+		}
+		return fields
+	}
+	if prefix == "" {
+		return nil
+	}
+	return []string{prefix}
+}
+
+// PrintSources writes the effective value of every field, secrets
+// redacted, and the layer it comes from.
+func (c *Config) PrintSources(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tVALUE\tSOURCE")
+	for _, f := range fields(reflect.ValueOf(*c.Redacted()), "") {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", f.path, f.value, c.Source(f.path))
+	}
+	return tw.Flush()
+}
+
+type field struct {
+	path, value string
+}
+
+// fields flattens v into its fields, named by their YAML path.
+func fields(v reflect.Value, prefix string) []field {
+	switch v.Kind() {
+	case reflect.Struct:
+		var list []field
+		for i := 0; i < v.NumField(); i++ {
+			name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			list = append(list, fields(v.Field(i), name)...)
+		}
+		return list
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			var list []field
+			for i := 0; i < v.Len(); i++ {
+				list = append(list, fields(v.Index(i), prefix+"["+strconv.Itoa(i)+"]")...)
+			}
+			return list
+		}
+	}
+	return []field{{path: prefix, value: formatValue(v.Interface())}}
+}
+
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case YAMLDuration:
+		return time.Duration(v).String()
+	case string:
+		return strconv.Quote(v)
+	case []string:
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = strconv.Quote(s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLayers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	fileData := `
+server:
+  port: "8081"
+upstream:
+  origin: http://file:8080
+log:
+  access:
+    sample_hits: 0
+cache:
+  capacity: 50
+routes:
+  - origin: http://api:8080
+`
+	if err := os.WriteFile(file, []byte(fileData), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CACHING_PROXY_ORIGIN", "http://env:8080")
+	t.Setenv("CACHE_CAPACITY", "60")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("port", "8080", "")
+	fs.String("origin", "", "")
+	if err := fs.Parse([]string{"--port", "8082"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := NewConfig()
+	if err := OverrideFromConfigYAML(cfg, file); err != nil {
+		t.Fatalf("OverrideFromConfigYAML() error = %v", err)
+	}
+	if err := OverrideFromEnvironment(cfg); err != nil {
+		t.Fatalf("OverrideFromEnvironment() error = %v", err)
+	}
+	OverrideFromFlags(cfg, fs)
+
+	tests := []struct {
+		field  string
+		value  any
+		got    any
+		source Source
+	}{
+		{"server.port", "8082", cfg.Server.Port, SourceFlag},
+		{"upstream.origin", "http://env:8080", cfg.Upstream.Origin, SourceEnv},
+		{"cache.capacity", 60, cfg.Cache.Capacity, SourceEnv},
+		{"log.access.sample_hits", 0.0, cfg.Log.Access.SampleHits, SourceFile},
+		{"cache.ttl", YAMLDuration(defaultTTL), cfg.Cache.TTL, SourceDefault},
+		{"routes[0].origin", "http://api:8080", cfg.Routes[0].Origin, SourceFile},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.value {
+			t.Errorf("expected %s %v, got %v", tt.field, tt.value, tt.got)
+		}
+		if source := cfg.Source(tt.field); source != tt.source {
+			t.Errorf("expected %s to come from %s, got %s", tt.field, tt.source, source)
+		}
+	}
+}
+
+func TestPrintSources(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Admin.Token = "secret"
+	cfg.setSource("admin.token", SourceEnv)
+	cfg.Cache.TTL = YAMLDuration(time.Minute)
+	cfg.setSource("cache.ttl", SourceFile)
+
+	var buf bytes.Buffer
+	if err := cfg.PrintSources(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`(?m)^admin\.token +"REDACTED" +env$`,
+		`(?m)^cache\.ttl +1m0s +file$`,
+		`(?m)^server\.port +"8080" +default$`,
+	} {
+		if !regexp.MustCompile(expected).MatchString(buf.String()) {
+			t.Errorf("expected a line matching %q in:\n%s", expected, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("expected the admin token to be redacted")
+	}
+}
@@ -17,3 +17,7 @@ func (d *YAMLDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	*d = YAMLDuration(duration)
 	return nil
 }
+
+func (d YAMLDuration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
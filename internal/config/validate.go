@@ -0,0 +1,211 @@
+package config
+
+import (
+	"caching-proxy/internal/compress"
+	"caching-proxy/internal/upstream"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldError is a problem with the value of a single field.
+type FieldError struct {
+	// Field is the YAML path of the field, e.g. "routes[1].origin".
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// validator collects the problems found in a configuration.
+type validator struct {
+	errs []error
+}
+
+func (v *validator) errorf(field, format string, args ...any) {
+	v.errs = append(v.errs, &FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) positive(field string, n int64) {
+	if n <= 0 {
+		v.errorf(field, "must be positive, got %d", n)
+	}
+}
+
+func (v *validator) notNegative(field string, n int64) {
+	if n < 0 {
+		v.errorf(field, "must not be negative, got %d", n)
+	}
+}
+
+func (v *validator) duration(field string, d YAMLDuration) {
+	if d < 0 {
+		v.errorf(field, "must not be negative, got %s", time.Duration(d))
+	}
+}
+
+func (v *validator) ratio(field string, f float64) {
+	if f < 0 || f > 1 {
+		v.errorf(field, "must be between 0 and 1, got %g", f)
+	}
+}
+
+func (v *validator) oneOf(field, value string, allowed ...string) {
+	if !slices.Contains(allowed, value) {
+		v.errorf(field, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+	}
+}
+
+func (v *validator) prefixes(field string, list []string) {
+	for i, s := range list {
+		var err error
+		if strings.Contains(s, "/") {
+			_, err = netip.ParsePrefix(s)
+		} else {
+			_, err = netip.ParseAddr(s)
+		}
+		if err != nil {
+			v.errorf(fmt.Sprintf("%s[%d]", field, i), "must be an IP address or a CIDR prefix, got %q", s)
+		}
+	}
+}
+
+func (v *validator) encodings(field string, list []string) {
+	for i, enc := range list {
+		if !compress.Supported(enc) {
+			v.errorf(fmt.Sprintf("%s[%d]", field, i), "unsupported encoding %q", enc)
+		}
+	}
+}
+
+func (v *validator) origin(field, origin string) {
+	if _, err := upstream.ParseOrigin(origin); err != nil {
+		v.errorf(field, "%s", err)
+	}
+}
+
+// Validate checks every field of the configuration and returns all the
+// problems found, each a *FieldError, joined with errors.Join. It returns
+// nil for a valid configuration.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	if port, err := strconv.Atoi(c.Server.Port); err != nil || port < 0 || port > 65535 {
+		v.errorf("server.port", "must be a port number, got %q", c.Server.Port)
+	}
+	v.duration("server.shutdown_timeout", c.Server.ShutdownTimeout)
+	v.duration("server.watch_interval", c.Server.WatchInterval)
+
+	v.oneOf("log.level", c.Log.Level, "debug", "info", "warn", "error")
+	v.oneOf("log.format", c.Log.Format, "text", "json")
+	v.oneOf("log.access.format", c.Log.Access.Format, "combined", "json")
+	v.ratio("log.access.sample_hits", c.Log.Access.SampleHits)
+
+	if c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errorf("tracing.endpoint", "must be an http or https URL, got %q", c.Tracing.Endpoint)
+		}
+		if c.Tracing.ServiceName == "" {
+			v.errorf("tracing.service_name", "is required when tracing.endpoint is set")
+		}
+	}
+	v.ratio("tracing.sample_ratio", c.Tracing.SampleRatio)
+
+	for i, token := range c.ServerTiming.Tokens {
+		if token == "" {
+			v.errorf(fmt.Sprintf("server_timing.tokens[%d]", i), "must not be empty")
+		}
+	}
+
+	if c.Admin.Addr != "" && c.Admin.Token == "" {
+		v.errorf("admin.token", "is required when admin.addr is set")
+	}
+
+	v.prefixes("purge.allow", c.Purge.Allow)
+	for i, token := range c.Purge.Tokens {
+		if token == "" {
+			v.errorf(fmt.Sprintf("purge.tokens[%d]", i), "must not be empty")
+		}
+	}
+
+	v.positive("cache.capacity", int64(c.Cache.Capacity))
+	if c.Cache.TTL <= 0 {
+		v.errorf("cache.ttl", "must be positive, got %s", time.Duration(c.Cache.TTL))
+	}
+	v.notNegative("cache.redis.db", int64(c.Cache.Redis.DB))
+	if c.Cache.Compression.Algorithm != "" {
+		v.encodings("cache.compression.algorithm", []string{c.Cache.Compression.Algorithm})
+	}
+	v.notNegative("cache.compression.min_size", int64(c.Cache.Compression.MinSize))
+	v.notNegative("cache.max_object_size", c.Cache.MaxObjectSize)
+	v.duration("cache.stale_ttl", c.Cache.StaleTTL)
+	v.notNegative("cache.range_chunk_size", c.Cache.RangeChunkSize)
+
+	v.encodings("compression.encodings", c.Compression.Encodings)
+	v.notNegative("compression.min_size", int64(c.Compression.MinSize))
+
+	v.prefixes("forwarding.trusted_proxies", c.Forwarding.TrustedProxies)
+
+	if c.Upstream.Origin != "" {
+		v.origin("upstream.origin", c.Upstream.Origin)
+	}
+	v.duration("upstream.connect_timeout", c.Upstream.ConnectTimeout)
+	v.duration("upstream.tls_timeout", c.Upstream.TLSTimeout)
+	v.duration("upstream.header_timeout", c.Upstream.HeaderTimeout)
+	v.duration("upstream.timeout", c.Upstream.Timeout)
+	v.duration("upstream.idle_conn_timeout", c.Upstream.IdleConnTimeout)
+	v.notNegative("upstream.max_idle_conns_per_host", int64(c.Upstream.MaxIdleConnsPerHost))
+	v.notNegative("upstream.retries", int64(c.Upstream.Retries))
+	v.duration("upstream.retry_backoff", c.Upstream.RetryBackoff)
+	v.duration("upstream.retry_max_backoff", c.Upstream.RetryMaxBackoff)
+	if c.Upstream.RetryBudget < 0 {
+		v.errorf("upstream.retry_budget", "must not be negative, got %g", c.Upstream.RetryBudget)
+	}
+	v.notNegative("upstream.retry_burst", int64(c.Upstream.RetryBurst))
+
+	v.positive("circuit_breaker.window", int64(c.CircuitBreaker.Window))
+	v.notNegative("circuit_breaker.min_requests", int64(c.CircuitBreaker.MinRequests))
+	v.ratio("circuit_breaker.error_rate", c.CircuitBreaker.ErrorRate)
+	v.duration("circuit_breaker.slow_call", c.CircuitBreaker.SlowCall)
+	v.ratio("circuit_breaker.slow_call_rate", c.CircuitBreaker.SlowCallRate)
+	v.duration("circuit_breaker.open_time", c.CircuitBreaker.OpenTime)
+	v.positive("circuit_breaker.half_open_requests", int64(c.CircuitBreaker.HalfOpenRequests))
+
+	for i, r := range c.Routes {
+		field := fmt.Sprintf("routes[%d]", i)
+		if r.Origin == "" && len(r.Origins) == 0 {
+			v.errorf(field+".origin", "is required unless origins is set")
+		}
+		if r.Origin != "" {
+			v.origin(field+".origin", r.Origin)
+		}
+		for j, origin := range r.Origins {
+			v.origin(fmt.Sprintf("%s.origins[%d]", field, j), origin)
+		}
+		if r.Balancer != "" {
+			v.oneOf(field+".balancer", r.Balancer, upstream.RoundRobin, upstream.LeastConn, upstream.ConsistentHash)
+		}
+		if r.CachePolicy != "" {
+			v.oneOf(field+".cache_policy", r.CachePolicy, "cache", "bypass")
+		}
+		v.duration(field+".ttl", r.TTL)
+		if r.HealthCheck.Path != "" && !strings.HasPrefix(r.HealthCheck.Path, "/") {
+			v.errorf(field+".health_check.path", "must start with /, got %q", r.HealthCheck.Path)
+		}
+		v.duration(field+".health_check.interval", r.HealthCheck.Interval)
+		v.duration(field+".health_check.timeout", r.HealthCheck.Timeout)
+		v.notNegative(field+".health_check.healthy_threshold", int64(r.HealthCheck.HealthyThreshold))
+		v.notNegative(field+".health_check.unhealthy_threshold", int64(r.HealthCheck.UnhealthyThreshold))
+		v.notNegative(field+".outlier_detection.consecutive_failures", int64(r.OutlierDetection.ConsecutiveFailures))
+		v.duration(field+".outlier_detection.ejection_time", r.OutlierDetection.EjectionTime)
+	}
+
+	return errors.Join(v.errs...)
+}
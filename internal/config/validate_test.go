@@ -0,0 +1,120 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*Config)
+		expected []string
+	}{
+		{
+			name:   "defaults",
+			modify: func(*Config) {},
+		},
+		{
+			name: "cache",
+			modify: func(cfg *Config) {
+				cfg.Cache.Capacity = -1
+				cfg.Cache.TTL = 0
+				cfg.Cache.Redis.DB = -1
+			},
+			expected: []string{"cache.capacity", "cache.ttl", "cache.redis.db"},
+		},
+		{
+			name: "ratios and enums",
+			modify: func(cfg *Config) {
+				cfg.Log.Level = "verbose"
+				cfg.Tracing.SampleRatio = 2
+				cfg.Compression.Encodings = []string{"gzip", "deflate"}
+			},
+			expected: []string{"log.level", "tracing.sample_ratio", "compression.encodings[1]"},
+		},
+		{
+			name: "addresses",
+			modify: func(cfg *Config) {
+				cfg.Forwarding.TrustedProxies = []string{"10.0.0.0/8", "10.0.0.0/33"}
+				cfg.Purge.Allow = []string{"localhost"}
+				cfg.Admin.Addr = "127.0.0.1:9090"
+			},
+			expected: []string{"admin.token", "purge.allow[0]", "forwarding.trusted_proxies[1]"},
+		},
+		{
+			name: "routes",
+			modify: func(cfg *Config) {
+				cfg.Routes = []Route{
+					{Origin: "http://api:8080"},
+					{PathPrefix: "/static"},
+					{Origins: []string{"http://a", "http://b c"}, Balancer: "random", CachePolicy: "never", TTL: YAMLDuration(-time.Second)},
+					{Origin: "http://api:8080", HealthCheck: HealthCheck{Path: "/healthz", Interval: YAMLDuration(time.Second)}},
+				}
+			},
+			expected: []string{"routes[1].origin", "routes[2].origins[1]", "routes[2].balancer", "routes[2].cache_policy", "routes[2].ttl"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := NewConfig()
+			tt.modify(cfg)
+			err := cfg.Validate()
+
+			var fields []string
+			for _, e := range unwrapJoined(err) {
+				var fe *FieldError
+				if !errors.As(e, &fe) {
+					t.Fatalf("expected a *FieldError, got %v", e)
+				}
+				fields = append(fields, fe.Field)
+			}
+			if strings.Join(fields, " ") != strings.Join(tt.expected, " ") {
+				t.Errorf("expected errors for %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func unwrapJoined(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+func TestOverrideFromConfigYAML_UnknownField(t *testing.T) {
+	file, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write([]byte("cache:\n  capacity: 10\n  tll: 5m\n")); err != nil {
+		t.Fatalf("failed to write to temp file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close temp file: %v", err)
+	}
+
+	err = OverrideFromConfigYAML(NewConfig(), file.Name())
+	if err == nil || !strings.Contains(err.Error(), "tll") {
+		t.Errorf("expected an error naming the unknown field, got %v", err)
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	cfg := NewConfig()
+	if err := OverrideFromConfigYAML(cfg, "../../config_example.yaml"); err != nil {
+		t.Fatalf("OverrideFromConfigYAML() error = %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected the example config to be valid, got %v", err)
+	}
+}
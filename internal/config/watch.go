@@ -0,0 +1,33 @@
+package config
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Watch calls onChange whenever the modification time or the size of file
+// changes, checking every interval until ctx is done. A missing file is not
+// a change, so a file being replaced is only reported once it is back.
+func Watch(ctx context.Context, file string, interval time.Duration, onChange func()) {
+	last, _ := os.Stat(file)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+			last = info
+			onChange()
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("cache:\n  ttl: 1m\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan struct{}, 10)
+	go Watch(ctx, file, 10*time.Millisecond, func() { changes <- struct{}{} })
+
+	select {
+	case <-changes:
+		t.Fatal("expected no change before the file is written")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := os.WriteFile(file, []byte("cache:\n  ttl: 10m\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("expected the change to be reported")
+	}
+}
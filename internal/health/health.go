@@ -0,0 +1,63 @@
+// Package health answers the liveness and readiness probes of orchestrators.
+package health
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Status values of the components and of the whole process.
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// Component is a part of the proxy whose status is reported.
+type Component struct {
+	Name string
+	// Check reports whether the component is up, with an optional detail
+	// such as a circuit breaker state.
+	Check func() (up bool, detail string)
+}
+
+// ComponentStatus is the reported status of a component.
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report is the body of a probe response.
+type Report struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// Handler returns a handler answering 200 with a JSON report when every
+// component is up, and 503 otherwise.
+func Handler(components ...Component) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := Report{Status: StatusUp, Components: make(map[string]ComponentStatus, len(components))}
+		for _, c := range components {
+			up, detail := c.Check()
+			status := ComponentStatus{Status: StatusUp, Detail: detail}
+			if !up {
+				status.Status = StatusDown
+				report.Status = StatusDown
+			}
+			report.Components[c.Name] = status
+		}
+
+		code := http.StatusOK
+		if report.Status != StatusUp {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// probes must see the current status, not a cached one
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			slog.DebugContext(r.Context(), "health: writing report", "error", err)
+		}
+	}
+}
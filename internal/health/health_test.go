@@ -0,0 +1,55 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	up := Component{Name: "listener", Check: func() (bool, string) { return true, "" }}
+	down := Component{Name: "redis", Check: func() (bool, string) { return false, "open" }}
+
+	tests := []struct {
+		name       string
+		components []Component
+		code       int
+		status     string
+	}{
+		{"all up", []Component{up}, http.StatusOK, StatusUp},
+		{"one down", []Component{up, down}, http.StatusServiceUnavailable, StatusDown},
+		{"no components", nil, http.StatusOK, StatusUp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			Handler(tt.components...)(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if rr.Code != tt.code {
+				t.Errorf("expected status code %d, got %d", tt.code, rr.Code)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected content type %q, got %q", "application/json", ct)
+			}
+			var report Report
+			if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Status != tt.status {
+				t.Errorf("expected status %q, got %q", tt.status, report.Status)
+			}
+			if len(report.Components) != len(tt.components) {
+				t.Errorf("expected %d components, got %v", len(tt.components), report.Components)
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	Handler(up, down)(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var report Report
+	json.Unmarshal(rr.Body.Bytes(), &report)
+	if got := report.Components["redis"]; got != (ComponentStatus{Status: StatusDown, Detail: "open"}) {
+		t.Errorf("unexpected redis status %+v", got)
+	}
+}
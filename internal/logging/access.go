@@ -0,0 +1,159 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessEntry describes a request answered by the proxy.
+type AccessEntry struct {
+	Time       time.Time
+	RemoteAddr string
+	Method     string
+	URL        string
+	Proto      string
+	Status     int
+	// Bytes is the size of the response body sent to the client.
+	Bytes     int64
+	Duration  time.Duration
+	Referer   string
+	UserAgent string
+	// Cache is the cache result: "hit", "miss", "stale" or "bypass".
+	Cache string
+	// Tier is where a cached response was read from, "memory" or "redis".
+	Tier string
+	// Origin is the last origin server the request was forwarded to.
+	Origin    string
+	RequestID string
+}
+
+// AccessLog writes an entry per request, in the Combined Log Format extended
+// with the proxy's fields, or as JSON lines.
+type AccessLog struct {
+	json bool
+	// sampleHits is the share of cache hits logged, from 0 to 1
+	sampleHits float64
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAccessLog returns an access log writing to w in format, "combined" (the
+// default) or "json". Only a sampleHits share of the cache hits is logged,
+// every other request is.
+func NewAccessLog(w io.Writer, format string, sampleHits float64) (*AccessLog, error) {
+	if sampleHits < 0 || sampleHits > 1 {
+		return nil, fmt.Errorf("invalid access log hit sampling %v, expected a value from 0 to 1", sampleHits)
+	}
+	a := &AccessLog{w: w, sampleHits: sampleHits}
+	switch strings.ToLower(format) {
+	case "", "combined":
+	case "json":
+		a.json = true
+	default:
+		return nil, fmt.Errorf("unknown access log format %q, expected combined or json", format)
+	}
+	return a, nil
+}
+
+// Log writes e, unless it is a cache hit left out by sampling.
+func (a *AccessLog) Log(e AccessEntry) {
+	if e.Cache == "hit" && a.sampleHits < 1 && rand.Float64() >= a.sampleHits {
+		return
+	}
+	var line []byte
+	if a.json {
+		line = formatJSON(e)
+	} else {
+		line = formatCombined(e)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(line); err != nil {
+		slog.Error("writing access log", "error", err)
+	}
+}
+
+// formatCombined formats e like Apache's "combined" format followed by the
+// proxy's fields.
+func formatCombined(e AccessEntry) []byte {
+	host, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		host = e.RemoteAddr
+	}
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Appendf(nil, "%s - - [%s] %s %d %s %s %s cache=%s tier=%s origin=%s duration=%.3f request_id=%s\n",
+		orDash(host),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.URL+" "+e.Proto),
+		e.Status,
+		bytes,
+		strconv.Quote(orDash(e.Referer)),
+		strconv.Quote(orDash(e.UserAgent)),
+		orDash(e.Cache),
+		orDash(e.Tier),
+		strconv.Quote(e.Origin),
+		e.Duration.Seconds(),
+		strconv.Quote(e.RequestID),
+	)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+type jsonEntry struct {
+	Time       string  `json:"time"`
+	RemoteAddr string  `json:"remote_addr"`
+	Method     string  `json:"method"`
+	URL        string  `json:"url"`
+	Proto      string  `json:"proto"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	Cache      string  `json:"cache,omitempty"`
+	Tier       string  `json:"tier,omitempty"`
+	Origin     string  `json:"origin,omitempty"`
+	RequestID  string  `json:"request_id,omitempty"`
+}
+
+func formatJSON(e AccessEntry) []byte {
+	line, err := json.Marshal(jsonEntry{
+		Time:       e.Time.Format(time.RFC3339Nano),
+		RemoteAddr: e.RemoteAddr,
+		Method:     e.Method,
+		URL:        e.URL,
+		Proto:      e.Proto,
+		Status:     e.Status,
+		Bytes:      e.Bytes,
+		DurationMS: float64(e.Duration.Microseconds()) / 1000,
+		Referer:    e.Referer,
+		UserAgent:  e.UserAgent,
+		Cache:      e.Cache,
+		Tier:       e.Tier,
+		Origin:     e.Origin,
+		RequestID:  e.RequestID,
+	})
+	if err != nil {
+		// every field is a string or a number, this cannot happen
+		panic(err)
+	}
+	return append(line, '\n')
+}
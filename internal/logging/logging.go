@@ -0,0 +1,45 @@
+// Package logging sets up the structured logger of the proxy and writes its
+// access log.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// level is shared by the loggers returned by New, so SetLevel applies to
+// them after a config reload.
+var level slog.LevelVar
+
+// New returns a logger writing to w in format, "text" (the default) or
+// "json", and sets the level, see SetLevel. Records logged with a context
+// carrying a request ID include it, see WithRequestID.
+func New(w io.Writer, format, lvl string) (*slog.Logger, error) {
+	if err := SetLevel(lvl); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: &level}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(contextHandler{slog.NewTextHandler(w, opts)}), nil
+	case "json":
+		return slog.New(contextHandler{slog.NewJSONHandler(w, opts)}), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+}
+
+// SetLevel sets the minimum level of the loggers returned by New: "debug",
+// "info" (the default), "warn" or "error".
+func SetLevel(lvl string) error {
+	if lvl == "" {
+		lvl = "info"
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(lvl)); err != nil {
+		return fmt.Errorf("unknown log level %q, expected debug, info, warn or error", lvl)
+	}
+	level.Set(l)
+	return nil
+}
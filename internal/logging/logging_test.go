@@ -0,0 +1,141 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", "warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "key", "value")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected a single JSON line, got %q", buf.String())
+	}
+	if line["msg"] != "shown" || line["key"] != "value" {
+		t.Errorf("unexpected log line %v", line)
+	}
+
+	if err := SetLevel("debug"); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Errorf("expected SetLevel to apply to existing loggers")
+	}
+
+	if _, err := New(&buf, "xml", "info"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+	if _, err := New(&buf, "text", "verbose"); err == nil {
+		t.Errorf("expected an error for an unknown level")
+	}
+}
+
+func TestNew_RequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "text", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.With("component", "cache").InfoContext(WithRequestID(context.Background(), "abc123"), "lookup")
+	logger.Info("no request")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+	if !strings.Contains(lines[0], "component=cache request_id=abc123") {
+		t.Errorf("expected the request ID in %q", lines[0])
+	}
+	if strings.Contains(lines[1], "request_id") {
+		t.Errorf("expected no request ID in %q", lines[1])
+	}
+}
+
+var testEntry = AccessEntry{
+	Time:       time.Date(2024, 3, 1, 12, 30, 45, 0, time.UTC),
+	RemoteAddr: "192.0.2.1:54321",
+	Method:     "GET",
+	URL:        "/products?id=1",
+	Proto:      "HTTP/1.1",
+	Status:     200,
+	Bytes:      512,
+	Duration:   12500 * time.Microsecond,
+	UserAgent:  `curl/8.0 "test"`,
+	Cache:      "hit",
+	Tier:       "redis",
+	RequestID:  "abc123",
+}
+
+func TestAccessLog_Combined(t *testing.T) {
+	var buf bytes.Buffer
+	a, err := NewAccessLog(&buf, "combined", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Log(testEntry)
+
+	expected := `192.0.2.1 - - [01/Mar/2024:12:30:45 +0000] "GET /products?id=1 HTTP/1.1" 200 512 "-" "curl/8.0 \"test\"" cache=hit tier=redis origin="" duration=0.013 request_id="abc123"` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestAccessLog_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	a, err := NewAccessLog(&buf, "json", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Log(testEntry)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected a JSON line, got %q", buf.String())
+	}
+	for field, expected := range map[string]interface{}{
+		"method":      "GET",
+		"url":         "/products?id=1",
+		"status":      float64(200),
+		"bytes":       float64(512),
+		"duration_ms": 12.5,
+		"cache":       "hit",
+		"tier":        "redis",
+		"request_id":  "abc123",
+	} {
+		if line[field] != expected {
+			t.Errorf("expected %s %v, got %v", field, expected, line[field])
+		}
+	}
+}
+
+func TestAccessLog_SampleHits(t *testing.T) {
+	var buf bytes.Buffer
+	a, err := NewAccessLog(&buf, "combined", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Log(testEntry)
+	miss := testEntry
+	miss.Cache = "miss"
+	a.Log(miss)
+
+	if lines := strings.Count(buf.String(), "\n"); lines != 1 || !strings.Contains(buf.String(), "cache=miss") {
+		t.Errorf("expected only the miss to be logged, got %q", buf.String())
+	}
+
+	if _, err := NewAccessLog(&buf, "combined", 1.5); err == nil {
+		t.Errorf("expected an error for a sampling rate above 1")
+	}
+}
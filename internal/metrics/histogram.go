@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	buckets []float64
+	// counts holds the observations per bucket, the last one being +Inf
+	counts []atomic.Uint64
+	sum    value
+}
+
+// Histogram samples observations, such as latencies, into buckets.
+type Histogram struct {
+	h *histogram
+}
+
+// Observe records v.
+func (h Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.h.buckets, v)
+	h.h.counts[i].Add(1)
+	h.h.sum.Add(v)
+}
+
+// ObserveSince records the time elapsed since start, in seconds.
+func (h Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	vec     vec[histogram]
+	buckets []float64
+}
+
+// With returns the histogram of labelValues, in the order of the label names.
+func (h *HistogramVec) With(labelValues ...string) Histogram {
+	return Histogram{h: h.vec.get(labelValues, func(hist *histogram) {
+		hist.buckets = h.buckets
+		hist.counts = make([]atomic.Uint64, len(h.buckets)+1)
+	})}
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	writeHeader(w, h.vec.name, h.vec.help, h.vec.typ)
+	for _, s := range h.vec.sorted() {
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.v.counts[i].Load()
+			writeSample(w, h.vec.name+"_bucket", h.vec.labels, s.labelValues, "le", formatFloat(upper), float64(cumulative))
+		}
+		cumulative += s.v.counts[len(h.buckets)].Load()
+		writeSample(w, h.vec.name+"_bucket", h.vec.labels, s.labelValues, "le", "+Inf", float64(cumulative))
+		writeSample(w, h.vec.name+"_sum", h.vec.labels, s.labelValues, "", "", s.v.sum.Load())
+		writeSample(w, h.vec.name+"_count", h.vec.labels, s.labelValues, "", "", float64(cumulative))
+	}
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
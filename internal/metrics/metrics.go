@@ -0,0 +1,298 @@
+// Package metrics implements counters, gauges and histograms exposed in the
+// Prometheus text format, without depending on the Prometheus client.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// contentType is the media type of the Prometheus text format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the histogram bucket upper bounds for latencies in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry the packages of the proxy register their metrics in.
+var Default = NewRegistry()
+
+// Handler serves the metrics of the Default registry.
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// metric is a family of series sharing a name, written together.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics and writes them in the Prometheus text format.
+type Registry struct {
+	mu      sync.Mutex
+	names   map[string]bool
+	metrics []metric
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// register adds m under name. Like duplicate routes of http.ServeMux, a
+// duplicate name is a programming error and panics.
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// NewCounter registers a counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec[Counter](name, help, "counter", labels)}
+	r.register(name, c)
+	return c
+}
+
+// NewGauge registers a gauge with the given label names.
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: newVec[Gauge](name, help, "gauge", labels)}
+	r.register(name, g)
+	return g
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds,
+// DefaultBuckets if nil, and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{vec: newVec[histogram](name, help, "histogram", labels), buckets: buckets}
+	r.register(name, h)
+	return h
+}
+
+// NewCounterFunc registers a counter whose values are read from collect at
+// every scrape, for counts kept elsewhere. collect calls observe once per
+// series, with a value for each label name.
+func (r *Registry) NewCounterFunc(name, help string, labels []string, collect func(observe func(v float64, labelValues ...string))) {
+	r.register(name, &funcMetric{name: name, help: help, typ: "counter", labels: labels, collect: collect})
+}
+
+// NewGaugeFunc is like NewCounterFunc for a gauge.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(observe func(v float64, labelValues ...string))) {
+	r.register(name, &funcMetric{name: name, help: help, typ: "gauge", labels: labels, collect: collect})
+}
+
+// WriteTo writes every metric in the Prometheus text format, in registration order.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler serves the metrics of the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		if _, err := r.WriteTo(w); err != nil {
+			slog.Error("metrics: writing response", "error", err)
+		}
+	})
+}
+
+// vec holds the series of a metric, one per combination of label values.
+type vec[T any] struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.RWMutex
+	series map[string]*series[T]
+}
+
+type series[T any] struct {
+	labelValues []string
+	v           T
+}
+
+func newVec[T any](name, help, typ string, labels []string) vec[T] {
+	return vec[T]{name: name, help: help, typ: typ, labels: labels, series: make(map[string]*series[T])}
+}
+
+// get returns the series of labelValues, creating it with init on first use.
+func (v *vec[T]) get(labelValues []string, init func(*T)) *T {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return &s.v
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.series[key]; ok {
+		return &s.v
+	}
+	s = &series[T]{labelValues: append([]string(nil), labelValues...)}
+	if init != nil {
+		init(&s.v)
+	}
+	v.series[key] = s
+	return &s.v
+}
+
+// sorted returns the series ordered by label values, so the output is stable.
+func (v *vec[T]) sorted() []*series[T] {
+	v.mu.RLock()
+	list := make([]*series[T], 0, len(v.series))
+	for _, s := range v.series {
+		list = append(list, s)
+	}
+	v.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].labelValues, list[j].labelValues
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+	return list
+}
+
+// value is a float64 updated atomically.
+type value struct {
+	bits atomic.Uint64
+}
+
+func (v *value) Add(delta float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (v *value) Set(f float64) {
+	v.bits.Store(math.Float64bits(f))
+}
+
+func (v *value) Load() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	v value
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Add adds delta, which must not be negative, to the counter.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.v.Add(delta)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() float64 {
+	return c.v.Load()
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	vec vec[Counter]
+}
+
+// With returns the counter of labelValues, in the order of the label names.
+func (c *CounterVec) With(labelValues ...string) *Counter {
+	return c.vec.get(labelValues, nil)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	writeHeader(w, c.vec.name, c.vec.help, c.vec.typ)
+	for _, s := range c.vec.sorted() {
+		writeSample(w, c.vec.name, c.vec.labels, s.labelValues, "", "", s.v.Value())
+	}
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	v value
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) {
+	g.v.Set(v)
+}
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc() {
+	g.v.Add(1)
+}
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec() {
+	g.v.Add(-1)
+}
+
+// Add adds delta to the gauge.
+func (g *Gauge) Add(delta float64) {
+	g.v.Add(delta)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	return g.v.Load()
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	vec vec[Gauge]
+}
+
+// With returns the gauge of labelValues, in the order of the label names.
+func (g *GaugeVec) With(labelValues ...string) *Gauge {
+	return g.vec.get(labelValues, nil)
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	writeHeader(w, g.vec.name, g.vec.help, g.vec.typ)
+	for _, s := range g.vec.sorted() {
+		writeSample(w, g.vec.name, g.vec.labels, s.labelValues, "", "", s.v.Value())
+	}
+}
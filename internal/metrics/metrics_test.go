@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("requests_total", "Requests served.", "route", "code")
+	inFlight := r.NewGauge("in_flight", "Requests in flight.")
+	latency := r.NewHistogram("latency_seconds", "Request latency.", []float64{0.5, 0.1}, "route")
+	r.NewGaugeFunc("items", "Items\nstored.", nil, func(observe func(float64, ...string)) {
+		observe(42)
+	})
+	r.NewCounterFunc("evictions_total", "Evictions.", []string{"reason"}, func(observe func(float64, ...string)) {
+		observe(3, "capacity")
+		observe(1, "ban")
+	})
+
+	requests.With("static", "200").Inc()
+	requests.With("static", "200").Add(2)
+	requests.With(`a"b\c`, "404").Inc()
+	inFlight.With().Inc()
+	inFlight.With().Inc()
+	inFlight.With().Dec()
+	latency.With("static").Observe(0.05)
+	latency.With("static").Observe(0.1)
+	latency.With("static").Observe(0.3)
+	latency.With("static").Observe(2)
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="a\"b\\c",code="404"} 1
+requests_total{route="static",code="200"} 3
+# HELP in_flight Requests in flight.
+# TYPE in_flight gauge
+in_flight 1
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="static",le="0.1"} 2
+latency_seconds_bucket{route="static",le="0.5"} 3
+latency_seconds_bucket{route="static",le="+Inf"} 4
+latency_seconds_sum{route="static"} 2.45
+latency_seconds_count{route="static"} 4
+# HELP items Items\nstored.
+# TYPE items gauge
+items 42
+# HELP evictions_total Evictions.
+# TYPE evictions_total counter
+evictions_total{reason="capacity"} 3
+evictions_total{reason="ban"} 1
+`
+	if b.String() != expected {
+		t.Errorf("expected output\n%s\ngot\n%s", expected, b.String())
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("hits_total", "Hits.").With().Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("expected the Prometheus text content type, got %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "hits_total 1\n") {
+		t.Errorf("expected hits_total 1 in %q", rec.Body.String())
+	}
+}
+
+func TestRegistry_DuplicateName(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("hits_total", "Hits.")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a panic registering a duplicate name")
+		}
+	}()
+	r.NewGauge("hits_total", "Hits.")
+}
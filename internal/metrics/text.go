@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// funcMetric reads its series from a callback at every scrape.
+type funcMetric struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	collect func(observe func(v float64, labelValues ...string))
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	writeHeader(w, f.name, f.help, f.typ)
+	f.collect(func(v float64, labelValues ...string) {
+		if len(labelValues) != len(f.labels) {
+			panic("metrics: wrong number of label values for " + f.name)
+		}
+		writeSample(w, f.name, f.labels, labelValues, "", "", v)
+	})
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	w.WriteString("# HELP " + name + " " + helpEscaper.Replace(help) + "\n")
+	w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// writeSample writes a line of the text format. extraLabel, if not empty, is
+// appended to the labels, such as the "le" label of histogram buckets.
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, extraLabel, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label + `="` + labelEscaper.Replace(labelValues[i]) + `"`)
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraLabel + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+// countingWriter counts the bytes written to w, for WriteTo.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheName identifies this proxy in the Cache-Status field.
+const cacheName = "caching-proxy"
+
+// The reasons a request is forwarded to the origin, see RFC 9211 section 2.2.
+const (
+	fwdURIMiss = "uri-miss"
+	fwdStale   = "stale"
+	fwdRequest = "request"
+	fwdBypass  = "bypass"
+)
+
+// cacheStatus describes how the cache handled a request, sent to the client
+// as the Cache-Status field of RFC 9211.
+type cacheStatus struct {
+	// hit is set when the response was served from the cache.
+	hit bool
+	// fwd is why the request was forwarded to the origin, empty on a hit.
+	fwd string
+	// fwdStatus is the status code the origin answered with, 0 if it did not.
+	fwdStatus int
+	// ttl is the remaining freshness lifetime of the response, negative when
+	// stale. It is only sent when hasTTL is set.
+	ttl    time.Duration
+	hasTTL bool
+	// stored is set when the forwarded response is stored in the cache.
+	stored bool
+	// collapsed is set when the request waited for another one to fill the cache.
+	collapsed bool
+	// key is the cache key, empty when the cache is not used.
+	key string
+	// tier is where the response was read from, "memory" or "redis".
+	tier string
+}
+
+// cachedStatus returns the status of a response served from item.
+func cachedStatus(item *cache.Item, now time.Time) cacheStatus {
+	return cacheStatus{
+		hit:    true,
+		ttl:    item.Expiration.Sub(now),
+		hasTTL: true,
+		key:    item.Key,
+		tier:   item.Tier,
+	}
+}
+
+// xCache returns the X-Cache value matching the status.
+func (cs cacheStatus) xCache() string {
+	switch {
+	case cs.hit || cs.collapsed:
+		return "hit"
+	case cs.fwd == fwdStale:
+		return "stale"
+	}
+	return "miss"
+}
+
+// result returns the cache result reported in the metrics and the access log.
+func (cs cacheStatus) result() string {
+	if cs.fwd == fwdBypass {
+		return "bypass"
+	}
+	return cs.xCache()
+}
+
+// String formats the status as a Cache-Status field value.
+func (cs cacheStatus) String() string {
+	var b strings.Builder
+	b.WriteString(cacheName)
+	if cs.hit {
+		b.WriteString("; hit")
+	}
+	if cs.fwd != "" {
+		b.WriteString("; fwd=" + cs.fwd)
+	}
+	if cs.fwdStatus != 0 {
+		b.WriteString("; fwd-status=" + strconv.Itoa(cs.fwdStatus))
+	}
+	if cs.hasTTL {
+		// rounded down, so a response is not announced fresher than it is
+		fmt.Fprintf(&b, "; ttl=%d", int64(math.Floor(cs.ttl.Seconds())))
+	}
+	if cs.stored {
+		b.WriteString("; stored")
+	}
+	if cs.collapsed {
+		b.WriteString("; collapsed")
+	}
+	if cs.key != "" {
+		b.WriteString("; key=" + sfString(cs.key))
+	}
+	if cs.tier != "" {
+		b.WriteString("; detail=" + cs.tier)
+	}
+	return b.String()
+}
+
+// setCacheStatus adds the Cache-Status and X-Cache fields of the response to
+// r, after those of the caches closer to the origin.
+func setCacheStatus(w http.ResponseWriter, r *http.Request, cs cacheStatus) {
+	w.Header().Add("X-Cache", cs.xCache())
+	setErrorCacheStatus(w, r, cs)
+}
+
+// setErrorCacheStatus is like setCacheStatus for the errors answered when no
+// response could be served, which have no X-Cache field.
+func setErrorCacheStatus(w http.ResponseWriter, r *http.Request, cs cacheStatus) {
+	w.Header().Add("Cache-Status", cs.String())
+	exchangeOf(r.Context()).cache = cs
+}
+
+// sfString formats s as a structured field string (RFC 8941), percent-encoding
+// the bytes a string cannot hold.
+func sfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// age returns the Age of a response served from item at now, see RFC 9111
+// section 4.2.3, and false when the item does not say when it was stored.
+func age(item *cache.Item, now time.Time) (time.Duration, bool) {
+	if item.StoredAt.IsZero() {
+		return 0, false
+	}
+	var initial time.Duration
+	if date, err := http.ParseTime(item.ResponseHeaders.Get("Date")); err == nil {
+		initial = max(item.StoredAt.Sub(date), 0)
+	}
+	if v, err := strconv.ParseInt(item.ResponseHeaders.Get("Age"), 10, 64); err == nil && v >= 0 {
+		initial = max(initial, time.Duration(v)*time.Second)
+	}
+	return initial + max(now.Sub(item.StoredAt), 0), true
+}
+
+// setAge sets the Age field of a response served from item.
+func setAge(h http.Header, item *cache.Item, now time.Time) {
+	if a, ok := age(item, now); ok {
+		h.Set("Age", strconv.FormatInt(int64(a/time.Second), 10))
+	}
+}
+
+// noCache reports whether the client asked for a response validated with the
+// origin, with Cache-Control: no-cache or, lacking Cache-Control, Pragma: no-cache.
+func noCache(r *http.Request) bool {
+	cc := r.Header.Values("Cache-Control")
+	if len(cc) == 0 {
+		return strings.EqualFold(strings.TrimSpace(r.Header.Get("Pragma")), "no-cache")
+	}
+	for _, v := range cc {
+		for _, directive := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if strings.EqualFold(name, "no-cache") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheStatus_String(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   cacheStatus
+		expected string
+	}{
+		{
+			name:     "hit",
+			status:   cacheStatus{hit: true, ttl: 90500 * time.Millisecond, hasTTL: true, key: "GETexample.com/a", tier: "redis"},
+			expected: `caching-proxy; hit; ttl=90; key="GETexample.com/a"; detail=redis`,
+		},
+		{
+			name:     "stored miss",
+			status:   cacheStatus{fwd: fwdURIMiss, fwdStatus: 200, ttl: time.Minute, hasTTL: true, stored: true, key: "GETexample.com/a"},
+			expected: `caching-proxy; fwd=uri-miss; fwd-status=200; ttl=60; stored; key="GETexample.com/a"`,
+		},
+		{
+			name:     "collapsed",
+			status:   cacheStatus{fwd: fwdURIMiss, fwdStatus: 200, collapsed: true, key: "GETexample.com/a", tier: "memory"},
+			expected: `caching-proxy; fwd=uri-miss; fwd-status=200; collapsed; key="GETexample.com/a"; detail=memory`,
+		},
+		{
+			name:     "stale",
+			status:   cacheStatus{fwd: fwdStale, ttl: -500 * time.Millisecond, hasTTL: true, key: "GETexample.com/a"},
+			expected: `caching-proxy; fwd=stale; ttl=-1; key="GETexample.com/a"`,
+		},
+		{
+			name:     "bypass",
+			status:   cacheStatus{fwd: fwdBypass, fwdStatus: 204},
+			expected: `caching-proxy; fwd=bypass; fwd-status=204`,
+		},
+		{
+			name:     "escaped key",
+			status:   cacheStatus{fwd: fwdRequest, key: "GETexample.com/\"café\""},
+			expected: `caching-proxy; fwd=request; key="GETexample.com/\"caf%C3%A9\""`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.status.String(); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestAge(t *testing.T) {
+	now := time.Now()
+	stored := now.Add(-10 * time.Second)
+	tests := []struct {
+		name     string
+		item     *cache.Item
+		expected time.Duration
+		ok       bool
+	}{
+		{name: "not stored", item: &cache.Item{ResponseHeaders: http.Header{}}, ok: false},
+		{name: "resident time", item: &cache.Item{ResponseHeaders: http.Header{}, StoredAt: stored}, expected: 10 * time.Second, ok: true},
+		{
+			name: "origin clock ahead",
+			item: &cache.Item{
+				ResponseHeaders: http.Header{"Date": []string{stored.Add(time.Hour).UTC().Format(http.TimeFormat)}},
+				StoredAt:        stored,
+			},
+			expected: 10 * time.Second, ok: true,
+		},
+		{
+			name:     "age from upstream cache",
+			item:     &cache.Item{ResponseHeaders: http.Header{"Age": []string{"30"}}, StoredAt: stored},
+			expected: 40 * time.Second, ok: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := age(tt.item, now)
+			if ok != tt.ok || got.Truncate(time.Second) != tt.expected {
+				t.Errorf("expected %v %v, got %v %v", tt.expected, tt.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestNoCache(t *testing.T) {
+	tests := []struct {
+		header   http.Header
+		expected bool
+	}{
+		{header: http.Header{}, expected: false},
+		{header: http.Header{"Cache-Control": []string{"max-age=0"}}, expected: false},
+		{header: http.Header{"Cache-Control": []string{"max-age=0, No-Cache"}}, expected: true},
+		{header: http.Header{"Pragma": []string{"no-cache"}}, expected: true},
+		{header: http.Header{"Pragma": []string{"no-cache"}, "Cache-Control": []string{"max-age=60"}}, expected: false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header = tt.header
+		if got := noCache(r); got != tt.expected {
+			t.Errorf("expected %v for %v, got %v", tt.expected, tt.header, got)
+		}
+	}
+}
+
+func TestProxyHandler_CacheStatus(t *testing.T) {
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello from origin"))
+	}))
+	defer originServer.Close()
+
+	c := cache.New(&cache.CacheConfig{TTL: time.Minute, Capacity: 10})
+	proxy := &Proxy{
+		Origin:     originServer.URL,
+		HttpClient: originServer.Client(),
+		Cache:      c,
+	}
+
+	tests := []struct {
+		name                string
+		header              http.Header
+		expectedCache       string
+		expectedCacheStatus string
+		expectAge           bool
+	}{
+		{
+			name:                "miss",
+			expectedCache:       "miss",
+			expectedCacheStatus: `caching-proxy; fwd=uri-miss; fwd-status=200; ttl=60; key="GETexample.com/status"`,
+		},
+		{
+			name:                "hit",
+			expectedCache:       "hit",
+			expectedCacheStatus: `caching-proxy; hit; ttl=59; key="GETexample.com/status"; detail=memory`,
+			expectAge:           true,
+		},
+		{
+			name:                "no-cache",
+			header:              http.Header{"Cache-Control": []string{"no-cache"}},
+			expectedCache:       "miss",
+			expectedCacheStatus: `caching-proxy; fwd=request; fwd-status=200; ttl=60; key="GETexample.com/status"`,
+		},
+		{
+			name:                "pragma no-cache",
+			header:              http.Header{"Pragma": []string{"no-cache"}},
+			expectedCache:       "miss",
+			expectedCacheStatus: `caching-proxy; fwd=request; fwd-status=200; ttl=60; key="GETexample.com/status"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/status", nil)
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, r)
+
+			if got := w.Header().Get("X-Cache"); got != tt.expectedCache {
+				t.Errorf("expected X-Cache %q, got %q", tt.expectedCache, got)
+			}
+			if got := w.Header().Get("Cache-Status"); got != tt.expectedCacheStatus {
+				t.Errorf("expected Cache-Status %q, got %q", tt.expectedCacheStatus, got)
+			}
+			if got := w.Header().Get("Age"); (got == "0") != tt.expectAge {
+				t.Errorf("expected Age %v, got %q", tt.expectAge, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"context"
+	"sync"
+)
+
+// flights tracks the cache misses being fetched from the origin.
+type flights struct {
+	mu sync.Mutex
+	m  map[string]chan struct{}
+}
+
+// join returns a channel closed once the request already fetching key is
+// done, or nil if there is none. In that case the caller fetches key and
+// must call done afterwards.
+func (f *flights) join(key string) (wait <-chan struct{}, done func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ch, ok := f.m[key]; ok {
+		return ch, nil
+	}
+	if f.m == nil {
+		f.m = make(map[string]chan struct{})
+	}
+	ch := make(chan struct{})
+	f.m[key] = ch
+	return nil, func() {
+		f.mu.Lock()
+		delete(f.m, key)
+		f.mu.Unlock()
+		close(ch)
+	}
+}
+
+// coalesce waits for a request already fetching key from the origin, if any,
+// and returns the response it cached. Otherwise, or when that response could
+// not be cached, the caller fetches key itself and must call done once the
+// response is cached.
+func (p *Proxy) coalesce(ctx context.Context, key string) (item *cache.Item, ok bool, done func()) {
+	wait, done := p.flights.join(key)
+	if wait == nil {
+		return nil, false, done
+	}
+
+	coalescedInFlight.With().Inc()
+	defer coalescedInFlight.With().Dec()
+	select {
+	case <-wait:
+	case <-ctx.Done():
+		return nil, false, func() {}
+	}
+	item, ok = p.cacheGet(ctx, key)
+	return item, ok, func() {}
+}
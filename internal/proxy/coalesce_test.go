@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyHandler_Coalesce(t *testing.T) {
+	const clients = 5
+	var requests atomic.Int32
+	release := make(chan struct{})
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Write([]byte("Hello from origin"))
+	}))
+	defer originServer.Close()
+
+	proxy := &Proxy{
+		Origin:     originServer.URL,
+		HttpClient: originServer.Client(),
+		Cache:      &MockCache{items: make(map[string]*cache.Item)},
+		Coalesce:   true,
+	}
+	proxyServer := httptest.NewServer(proxy.Handler())
+	defer proxyServer.Close()
+
+	waiting := coalescedInFlight.With().Value()
+	var wg sync.WaitGroup
+	results := make(chan string, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(proxyServer.URL + "/coalesced")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			results <- resp.Header.Get("X-Cache") + " " + string(body)
+			if resp.Header.Get("X-Cache") == "hit" {
+				got := resp.Header.Get("Cache-Status")
+				if !strings.HasPrefix(got, "caching-proxy; fwd=uri-miss; fwd-status=200;") || !strings.Contains(got, "; collapsed;") {
+					t.Errorf("expected a collapsed forward in Cache-Status, got %q", got)
+				}
+			}
+		}()
+	}
+
+	// let the first request reach the origin and the others queue behind it
+	deadline := time.Now().Add(time.Second)
+	for coalescedInFlight.With().Value()-waiting < clients-1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := coalescedInFlight.With().Value() - waiting; n != clients-1 {
+		t.Errorf("expected %d requests waiting, got %v", clients-1, n)
+	}
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected 1 origin request, got %d", n)
+	}
+	counts := map[string]int{}
+	for res := range results {
+		counts[res]++
+	}
+	if counts["miss Hello from origin"] != 1 || counts["hit Hello from origin"] != clients-1 {
+		t.Errorf("expected 1 miss and %d hits, got %v", clients-1, counts)
+	}
+	if n := coalescedInFlight.With().Value() - waiting; n != 0 {
+		t.Errorf("expected no request left waiting, got %v", n)
+	}
+}
+
+func TestProxyHandler_CoalesceUncacheable(t *testing.T) {
+	var requests atomic.Int32
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("too large to cache"))
+	}))
+	defer originServer.Close()
+
+	proxy := &Proxy{
+		Origin:        originServer.URL,
+		HttpClient:    originServer.Client(),
+		Cache:         &MockCache{items: make(map[string]*cache.Item)},
+		MaxObjectSize: 1,
+		Coalesce:      true,
+	}
+
+	// a request waiting for an uncacheable response goes to the origin itself
+	waiting := coalescedInFlight.With().Value()
+	wait, done := proxy.flights.join("GET" + "example.com/large")
+	if wait != nil {
+		t.Fatalf("expected the first request to lead")
+	}
+	served := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		proxy.Handler()(rec, httptest.NewRequest(http.MethodGet, "http://example.com/large", nil))
+		served <- rec
+	}()
+	deadline := time.Now().Add(time.Second)
+	for coalescedInFlight.With().Value() == waiting && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	done()
+	rec := <-served
+	if rec.Body.String() != "too large to cache" {
+		t.Errorf("expected body %q, got %q", "too large to cache", rec.Body.String())
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected 1 origin request, got %d", n)
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"caching-proxy/internal/compress"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Compression configures how the proxy compresses responses for clients.
+type Compression struct {
+	// Encodings lists the content codings offered to clients in order of preference.
+	Encodings []string
+	// MinSize is the minimum body size in bytes worth compressing.
+	MinSize int
+	// ContentTypes lists the compressible media types, see compress.DefaultContentTypes.
+	ContentTypes []string
+}
+
+// encodeBody negotiates the representation sent to the client. body is the
+// response body as cached, encoded with bodyEncoding at rest (empty for
+// identity). header is the outgoing response header and is updated with the
+// Content-Encoding, Content-Length and Vary of the returned body.
+func (p *Proxy) encodeBody(r *http.Request, header http.Header, body []byte, bodyEncoding string) ([]byte, error) {
+	// the origin already encoded this response, pass it through untouched
+	if header.Get("Content-Encoding") != "" {
+		return body, nil
+	}
+
+	acceptEncoding := r.Header.Get("Accept-Encoding")
+	if bodyEncoding != "" {
+		addVary(header, "Accept-Encoding")
+		if compress.Accepts(acceptEncoding, bodyEncoding) {
+			setEncoding(header, bodyEncoding, len(body))
+			return body, nil
+		}
+		decoded, err := compress.Decode(bodyEncoding, body)
+		if err != nil {
+			return nil, err
+		}
+		body = decoded
+	}
+
+	if !p.compressible(header, int64(len(body))) {
+		return body, nil
+	}
+	addVary(header, "Accept-Encoding")
+
+	encoding := compress.Negotiate(acceptEncoding, p.Compression.Encodings)
+	if encoding == "" {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+		return body, nil
+	}
+	encoded, err := compress.Encode(encoding, body)
+	if err != nil {
+		return nil, err
+	}
+	setEncoding(header, encoding, len(encoded))
+	return encoded, nil
+}
+
+// encodeWriter is the streaming counterpart of encodeBody. It wraps w so that
+// an identity body of contentLength bytes (-1 if unknown) is compressed for the
+// client when negotiable, updating header accordingly. The returned close
+// function flushes the encoder and must be called once the body is written.
+func (p *Proxy) encodeWriter(r *http.Request, header http.Header, contentLength int64, w io.Writer) (io.Writer, func() error, error) {
+	noop := func() error { return nil }
+	// a HEAD response has no body to encode, it keeps the origin's Content-Length
+	if r.Method == http.MethodHead || header.Get("Content-Encoding") != "" || !p.compressible(header, contentLength) {
+		return w, noop, nil
+	}
+	addVary(header, "Accept-Encoding")
+
+	encoding := compress.Negotiate(r.Header.Get("Accept-Encoding"), p.Compression.Encodings)
+	if encoding == "" {
+		return w, noop, nil
+	}
+	enc, err := compress.NewWriter(encoding, w)
+	if err != nil {
+		return nil, nil, err
+	}
+	setEncoding(header, encoding, -1)
+	return enc, enc.Close, nil
+}
+
+// compressible reports whether an identity body of size bytes (-1 if unknown)
+// with the given header should be compressed for clients.
+func (p *Proxy) compressible(header http.Header, size int64) bool {
+	if p.Compression == nil || len(p.Compression.Encodings) == 0 {
+		return false
+	}
+	if size == 0 || (size > 0 && size < int64(p.Compression.MinSize)) {
+		return false
+	}
+	return compress.Compressible(header.Get("Content-Type"), p.Compression.ContentTypes)
+}
+
+// setEncoding marks header as describing a body of size n encoded with
+// encoding. A negative n means the encoded size is not known upfront.
+func setEncoding(header http.Header, encoding string, n int) {
+	header.Set("Content-Encoding", encoding)
+	if n < 0 {
+		header.Del("Content-Length")
+	} else {
+		header.Set("Content-Length", strconv.Itoa(n))
+	}
+	// a strong validator identifies the identity bytes, it no longer matches the encoded ones
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// addVary adds field to the Vary header unless it is already listed.
+func addVary(header http.Header, field string) {
+	for _, v := range header.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f == "*" || strings.EqualFold(f, field) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", field)
+}
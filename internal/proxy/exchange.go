@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"caching-proxy/internal/logging"
+	"caching-proxy/internal/servertiming"
+	"caching-proxy/internal/tracing"
+	"context"
+	"net/http"
+	"time"
+)
+
+// exchange collects what happened while answering a request, for the
+// metrics and the access log.
+type exchange struct {
+	start time.Time
+	// route is nil for PURGE and BAN requests
+	route *Route
+	cache cacheStatus
+	// origin is the last origin server the request was forwarded to
+	origin string
+}
+
+type exchangeKey struct{}
+
+// exchangeOf returns the exchange of the request ctx belongs to, or a
+// throwaway one outside of Handler.
+func exchangeOf(ctx context.Context) *exchange {
+	if ex, ok := ctx.Value(exchangeKey{}).(*exchange); ok {
+		return ex
+	}
+	return &exchange{}
+}
+
+// responseRecorder records the status code and the body size of a response,
+// and returns the request ID and the Server-Timing header to the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	requestID string
+	start     time.Time
+	// timings is nil unless the response gets a Server-Timing header
+	timings *servertiming.Timings
+	status  int
+	bytes   int64
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		// replaces the ID of the request a cached response was fetched for
+		rec.Header().Set("X-Request-ID", rec.requestID)
+		if rec.timings != nil {
+			rec.Header().Set("Server-Timing", rec.timings.Header(time.Since(rec.start)))
+		}
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets the streamed origin responses reach the client as they arrive.
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// finish records the answered request in the metrics, the trace and the
+// access log.
+func (p *Proxy) finish(rec *responseRecorder, r *http.Request, ex *exchange) {
+	status := rec.status
+	if status == 0 {
+		// net/http sends a 200 when the handler writes nothing
+		status = http.StatusOK
+	}
+	if ex.route != nil {
+		observe(ex.route, ex.cache, status)
+	}
+	span := tracing.SpanFromContext(r.Context())
+	span.SetAttr("http.response.status_code", status)
+	if ex.route != nil {
+		span.SetAttr("cache.result", ex.cache.result())
+	}
+	if ex.cache.tier != "" {
+		span.SetAttr("cache.tier", ex.cache.tier)
+	}
+	span.End()
+	if p.AccessLog == nil {
+		return
+	}
+	var result string
+	if ex.route != nil {
+		result = ex.cache.result()
+	}
+	p.AccessLog.Log(logging.AccessEntry{
+		Time:       ex.start,
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		URL:        r.URL.RequestURI(),
+		Proto:      r.Proto,
+		Status:     status,
+		Bytes:      rec.bytes,
+		Duration:   time.Since(ex.start),
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		Cache:      result,
+		Tier:       ex.cache.tier,
+		Origin:     ex.origin,
+		RequestID:  rec.requestID,
+	})
+}
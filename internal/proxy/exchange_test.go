@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"bytes"
+	"caching-proxy/internal/cache"
+	"caching-proxy/internal/logging"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyHandler_AccessLog(t *testing.T) {
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello from origin"))
+	}))
+	defer originServer.Close()
+
+	var buf bytes.Buffer
+	accessLog, err := logging.NewAccessLog(&buf, "json", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{
+		Origin:     originServer.URL,
+		HttpClient: originServer.Client(),
+		Cache:      &MockCache{items: make(map[string]*cache.Item)},
+		AccessLog:  accessLog,
+	}
+
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, "/access-log?q=1", nil)
+		req.Header.Set("X-Request-ID", "abc")
+		proxy.Handler()(httptest.NewRecorder(), req)
+	}
+
+	type entry struct {
+		Method    string `json:"method"`
+		URL       string `json:"url"`
+		Status    int    `json:"status"`
+		Bytes     int64  `json:"bytes"`
+		Cache     string `json:"cache"`
+		Tier      string `json:"tier"`
+		Origin    string `json:"origin"`
+		RequestID string `json:"request_id"`
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 access log entries, got %d: %q", len(lines), buf.String())
+	}
+	expected := []entry{
+		{http.MethodGet, "/access-log?q=1", http.StatusOK, 17, "miss", "", originServer.URL, "abc"},
+		{http.MethodGet, "/access-log?q=1", http.StatusOK, 17, "hit", "", "", "abc"},
+	}
+	for i, line := range lines {
+		var got entry
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		}
+		if got != expected[i] {
+			t.Errorf("entry %d: expected %+v, got %+v", i, expected[i], got)
+		}
+	}
+}
@@ -1,127 +1,499 @@
 package proxy
 
 import (
+	"bytes"
 	"caching-proxy/internal/cache"
+	"caching-proxy/internal/logging"
+	"caching-proxy/internal/servertiming"
+	"caching-proxy/internal/tracing"
+	"caching-proxy/internal/upstream"
+	"cmp"
 	"context"
-	"fmt"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type CacheInterface interface {
 	Get(ctx context.Context, key string) (*cache.Item, bool)
-	Set(key string, item *cache.Item)
+	// GetStale also returns recently expired items, see cache.Cache.GetStale.
+	GetStale(ctx context.Context, key string) (*cache.Item, bool)
+	Set(ctx context.Context, key string, item *cache.Item)
+	Remove(ctx context.Context, key string) (bool, error)
+	// RemoveTag deletes the items tagged with tag, see cache.Cache.RemoveTag.
+	RemoveTag(ctx context.Context, tag string) (int, error)
+	// Ban invalidates the stored items matching expr, see cache.Cache.Ban
+	// and CompileBan.
+	Ban(ctx context.Context, expr string) error
 	TTL() time.Duration
 }
 
 type Proxy struct {
+	// Origin is the default upstream for requests that match none of the Routes.
 	Origin     string
 	HttpClient *http.Client
 	Cache      CacheInterface
+	// Routes maps requests to origins, the first matching route wins. Reload
+	// replaces them at runtime.
+	Routes []*Route
+	// Compression enables compressing responses for clients, nil disables it.
+	Compression *Compression
+	// MaxObjectSize is the largest body in bytes that is cached, 0 means no limit.
+	MaxObjectSize int64
+	// Retry configures retries of failed idempotent origin requests.
+	Retry RetryPolicy
+	// Breakers holds the circuit breaker of every origin, nil disables them.
+	Breakers *upstream.Breakers
+	// TrustedProxies lists the peers whose forwarding headers are kept and extended.
+	TrustedProxies []netip.Prefix
+	// RangeChunkSize enables fetching and caching uncached objects in chunks of
+	// this many bytes to answer single range requests, 0 disables it.
+	RangeChunkSize int64
+	// Purge allows PURGE and BAN requests, nil forwards them like any other method.
+	Purge *PurgePolicy
+	// Coalesce makes concurrent cache misses for the same GET request wait
+	// for the first one to fill the cache instead of all reaching the origin.
+	Coalesce bool
+
+	// AccessLog records every request, nil disables it.
+	AccessLog *logging.AccessLog
+	// ServerTiming adds a Server-Timing header to every response. Without
+	// it, only the requests presenting one of DebugTokens in X-Debug-Token
+	// get one.
+	ServerTiming bool
+	DebugTokens  []string
+
+	routing atomic.Pointer[routing]
+	flights flights
 }
 
 // Handler returns a http.HandlerFunc that forwards the request to origin server and forwards the response to client
 func (p *Proxy) Handler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("incoming new request:", r.Method, r.Host, r.URL.Path)
-		ctx := r.Context()
-		cacheKey := r.Method + r.Host + r.URL.Path
+		ex := &exchange{start: time.Now()}
+		id := requestID(r)
+		ctx := logging.WithRequestID(r.Context(), id)
+		ctx, span := tracing.Start(tracing.Extract(ctx, r.Header), r.Method, tracing.KindServer)
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("server.address", r.Host)
+		span.SetAttr("url.path", r.URL.Path)
+		span.SetAttr("http.request.header.x-request-id", id)
+		rec := &responseRecorder{ResponseWriter: w, requestID: id, start: ex.start}
+		if p.serverTiming(r) {
+			rec.timings = &servertiming.Timings{}
+			ctx = servertiming.NewContext(ctx, rec.timings)
+		}
+		r = r.WithContext(context.WithValue(ctx, exchangeKey{}, ex))
+		w.Header().Set("X-Request-ID", id)
+		defer p.finish(rec, r, ex)
+		w = rec
+
+		slog.DebugContext(r.Context(), "incoming request", "method", r.Method, "host", r.Host, "path", r.URL.Path)
+		if p.servePurge(w, r) {
+			return
+		}
+		ctx = r.Context()
+		cacheKey := cacheKey(r)
+
+		rt := p.route(r)
+		ex.route = rt
+		if rt.Bypass {
+			p.serveOrigin(w, r, rt, "", cacheStatus{fwd: fwdBypass})
+			return
+		}
+		if noCache(r) {
+			p.serveOrigin(w, r, rt, cacheKey, cacheStatus{fwd: fwdRequest, key: cacheKey})
+			return
+		}
 
 		// check cache
-		if item, ok := p.Cache.Get(ctx, cacheKey); ok {
-			for k, v := range item.ResponseHeaders {
-				for _, vv := range v {
-					w.Header().Add(k, vv)
-				}
-			}
-			w.Header().Add("X-Cache", "hit")
-			w.WriteHeader(item.ResponseStatusCode)
-			if _, err := w.Write(item.ResponseBody); err != nil {
-				log.Println("error: writing cache response to client", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		if item, ok := p.cacheGet(ctx, cacheKey); ok {
+			p.serveCached(w, r, rt, item, cachedStatus(item, time.Now()))
+			return
+		}
+		if p.Coalesce && r.Method == http.MethodGet && !isRangeRequest(r) {
+			item, ok, done := p.coalesce(ctx, cacheKey)
+			if ok {
+				// the response was forwarded on behalf of this request too
+				status := cachedStatus(item, time.Now())
+				status.hit, status.fwd, status.fwdStatus, status.collapsed = false, fwdURIMiss, item.ResponseStatusCode, true
+				p.serveCached(w, r, rt, item, status)
 				return
 			}
-			return
+			defer done()
 		}
 
-		originURL, err := parseOriginURL(p.Origin)
-		if err != nil {
-			log.Println("error: parsing origin url", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if isRangeRequest(r) && p.RangeChunkSize > 0 && p.serveChunked(w, r, rt, cacheKey) {
 			return
 		}
+		p.serveOrigin(w, r, rt, cacheKey, cacheStatus{fwd: fwdURIMiss, key: cacheKey})
+	}
+}
 
-		// request to origin server
-		url := originURL + r.URL.Path
-		if r.URL.RawQuery != "" {
-			url += "?" + r.URL.RawQuery
-		}
+// cacheKey returns the key the response to r is cached under. HEAD requests
+// share the GET entry, since they only differ in the missing body.
+func cacheKey(r *http.Request) string {
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	return method + r.Host + r.URL.Path
+}
 
-		log.Println("forwarding request to origin server:", url)
-		req, err := http.NewRequest(r.Method, url, io.NopCloser(r.Body))
-		req.Header = r.Header.Clone()
+// serveCached writes a response stored in the cache to the client.
+func (p *Proxy) serveCached(w http.ResponseWriter, r *http.Request, rt *Route, item *cache.Item, status cacheStatus) {
+	if isRangeRequest(r) && item.ResponseStatusCode == http.StatusOK {
+		body, err := item.Body()
 		if err != nil {
-			log.Println("error: new request forward", err)
+			slog.ErrorContext(r.Context(), "decoding cached body", "key", item.Key, "error", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		originResponse, err := p.HttpClient.Do(req)
-		if err != nil {
-			log.Println("error: request to origin server", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		serveRange(w, r, rt, item, body, status)
+		return
+	}
+
+	copyResponseHeader(w.Header(), item.ResponseHeaders, rt)
+	body, err := p.encodeBody(r, w.Header(), item.ResponseBody, item.BodyEncoding)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "encoding cached body", "key", item.Key, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setCacheStatus(w, r, status)
+	setAge(w.Header(), item, time.Now())
+	w.WriteHeader(item.ResponseStatusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, span := tracing.Start(r.Context(), "response write", tracing.KindInternal)
+	defer span.End()
+	if _, err := w.Write(body); err != nil {
+		span.SetError(err)
+		slog.DebugContext(r.Context(), "writing cached response to client", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// serveOrigin forwards the request to the origin server, streams the response
+// to the client and caches it, unless cacheKey is empty. Range requests fetch
+// the full representation so the range can be answered from it and later
+// ranges served from the cache. status tells why the request is forwarded.
+func (p *Proxy) serveOrigin(w http.ResponseWriter, r *http.Request, rt *Route, cacheKey string, status cacheStatus) {
+	req, err := p.newOriginRequest(r, rt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "building origin request", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rangeRequest := isRangeRequest(r) && cacheKey != ""
+	if rangeRequest {
+		req.Header.Del("Range")
+		req.Header.Del("If-Range")
+	}
+
+	originResponse, err := p.do(rt, cacheKey, req)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request to origin", "error", err)
+		if p.serveStale(w, r, rt, cacheKey, err) {
 			return
 		}
-		defer originResponse.Body.Close()
+		setErrorCacheStatus(w, r, status)
+		http.Error(w, err.Error(), originErrorStatus(err))
+		return
+	}
+	defer originResponse.Body.Close()
 
-		body, err := io.ReadAll(originResponse.Body)
+	if r.Method == http.MethodHead {
+		// a HEAD response has no body, it must never populate the GET entry
+		p.streamResponse(w, r, rt, originResponse, "", status)
+		return
+	}
+	if !rangeRequest {
+		p.streamResponse(w, r, rt, originResponse, cacheKey, status)
+		return
+	}
+	p.serveFromComplete(w, r, rt, cacheKey, originResponse, status)
+}
+
+// serveStale answers r with the expired cached response for cacheKey when
+// err shows the origin is unavailable. It returns false without writing
+// anything when there is no such response.
+func (p *Proxy) serveStale(w http.ResponseWriter, r *http.Request, rt *Route, cacheKey string, err error) bool {
+	if cacheKey == "" || originErrorStatus(err) != http.StatusServiceUnavailable {
+		return false
+	}
+	item, ok := p.cacheGetStale(r.Context(), cacheKey)
+	if !ok {
+		return false
+	}
+	slog.WarnContext(r.Context(), "origin unavailable, serving stale response", "key", cacheKey)
+	status := cachedStatus(item, time.Now())
+	status.hit, status.fwd = false, fwdStale
+	p.serveCached(w, r, rt, item, status)
+	return true
+}
+
+// newOriginRequest builds the request forwarded to the origin server of rt for r.
+func (p *Proxy) newOriginRequest(r *http.Request, rt *Route) (*http.Request, error) {
+	// the origin server is only picked when the request is sent, see do
+	var body io.Reader
+	if r.Body != nil && r.Body != http.NoBody {
+		body = io.NopCloser(r.Body)
+	}
+	// the request is canceled together with the client request
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, r.URL.RequestURI(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	removeHopByHopHeaders(req.Header)
+	req.Header.Del(debugTokenHeader)
+	if id := logging.RequestID(r.Context()); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	p.setForwardedHeaders(req.Header, r)
+	rt.RequestHeaders.apply(req.Header)
+	if p.Compression != nil {
+		// let the transport negotiate and transparently decode, so that the
+		// cache keeps an identity copy every client encoding can be derived from
+		req.Header.Del("Accept-Encoding")
+	}
+	return req, nil
+}
+
+// streamResponse streams the origin response to the client while a copy is
+// captured for the cache. An empty cacheKey disables caching.
+func (p *Proxy) streamResponse(w http.ResponseWriter, r *http.Request, rt *Route, originResponse *http.Response, cacheKey string, status cacheStatus) {
+	copyResponseHeader(w.Header(), originResponse.Header, rt)
+	dst, closeEncoder, err := p.encodeWriter(r, w.Header(), originResponse.ContentLength, flushWriter{w})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "encoding origin response body", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	capture := newCaptureBuffer(p.MaxObjectSize, originResponse.ContentLength)
+	if cacheKey == "" {
+		capture.overflow = true
+	}
+	ttl := p.ttl(rt)
+	status.fwdStatus = originResponse.StatusCode
+	status.ttl, status.hasTTL = ttl, !capture.overflow
+	// stored is left out: the body may still turn out too large to store, or
+	// be cut short, after the header is sent
+	setCacheStatus(w, r, status)
+	w.WriteHeader(originResponse.StatusCode)
+
+	_, span := tracing.Start(r.Context(), "response write", tracing.KindInternal)
+	readErr, writeErr := stream(io.MultiWriter(dst, capture), originResponse.Body)
+	span.SetError(cmp.Or(readErr, writeErr))
+	span.End()
+	if readErr != nil {
+		// the status line is already sent, abort so the client sees a truncated response
+		slog.ErrorContext(r.Context(), "reading origin response body", "error", readErr)
+		panic(http.ErrAbortHandler)
+	}
+	if writeErr != nil {
+		slog.DebugContext(r.Context(), "writing origin response to client", "error", writeErr)
+		return
+	}
+	if err := closeEncoder(); err != nil {
+		slog.DebugContext(r.Context(), "writing origin response to client", "error", err)
+		return
+	}
+
+	// save into cache, unless the body was too large to keep
+	if cacheKey == "" {
+		return
+	}
+	if capture.overflow {
+		slog.DebugContext(r.Context(), "not caching response, body exceeds max object size", "key", cacheKey, "max_object_size", p.MaxObjectSize)
+		return
+	}
+	p.Cache.Set(r.Context(), cacheKey, &cache.Item{
+		Key:                cacheKey,
+		ResponseBody:       capture.Bytes(),
+		ResponseHeaders:    originResponse.Header,
+		ResponseStatusCode: originResponse.StatusCode,
+		Expiration:         time.Now().Add(ttl),
+		Tags:               responseTags(originResponse.Header),
+	})
+	exchangeOf(r.Context()).cache.stored = true
+}
+
+// readItem reads the whole origin response into a cache item without sending
+// anything to the client. When the body exceeds the max object size, it
+// returns a nil item and the complete body instead: what was read so far
+// followed by the rest of the response.
+func (p *Proxy) readItem(rt *Route, cacheKey string, originResponse *http.Response) (*cache.Item, io.Reader, error) {
+	limit := p.MaxObjectSize
+	if limit > 0 && originResponse.ContentLength > limit {
+		// the origin announced a body that can never be cached, do not buffer it at all
+		return nil, originResponse.Body, nil
+	}
+	var src io.Reader = originResponse.Body
+	if limit > 0 {
+		src = io.LimitReader(src, limit+1)
+	}
+	var buf bytes.Buffer
+	if originResponse.ContentLength > 0 {
+		buf.Grow(int(originResponse.ContentLength))
+	}
+	if _, err := buf.ReadFrom(src); err != nil {
+		return nil, nil, err
+	}
+	if limit > 0 && int64(buf.Len()) > limit {
+		return nil, io.MultiReader(&buf, originResponse.Body), nil
+	}
+	return &cache.Item{
+		Key:                cacheKey,
+		ResponseBody:       buf.Bytes(),
+		ResponseHeaders:    originResponse.Header,
+		ResponseStatusCode: originResponse.StatusCode,
+		Expiration:         time.Now().Add(p.ttl(rt)),
+		Tags:               responseTags(originResponse.Header),
+	}, nil, nil
+}
+
+// do sends req to an origin server of rt, picked by the route's pool. key
+// identifies the requested object for consistent hashing. Failed idempotent
+// requests are retried on another origin server according to the retry
+// policy. The hop-by-hop fields of the response are removed, so they are
+// neither cached nor forwarded to the client.
+func (p *Proxy) do(rt *Route, key string, req *http.Request) (*http.Response, error) {
+	path, query := req.URL.Path, req.URL.RawQuery
+	retryable := p.Retry.Attempts > 0 && isIdempotent(req.Method) && (req.Body == nil || req.Body == http.NoBody)
+	if p.Retry.Budget != nil {
+		p.Retry.Budget.Request()
+	}
+
+	var previous *upstream.Member
+	for attempt := 0; ; attempt++ {
+		origin, member, err := p.pickOrigin(rt, key, previous)
 		if err != nil {
-			log.Println("error: reading origin response body", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
+		}
+		breaker := p.Breakers.Get(origin.String())
+		if err := breaker.Allow(); err != nil {
+			if member != nil {
+				rt.Pool.Release(member)
+			}
+			return nil, err
 		}
+		setTarget(req, origin, path, query)
 
-		// save into cache
-		p.Cache.Set(cacheKey, &cache.Item{
-			ResponseBody:       body,
-			ResponseHeaders:    originResponse.Header,
-			ResponseStatusCode: originResponse.StatusCode,
-			Expiration:         time.Now().Add(p.Cache.TTL()),
-		})
+		slog.DebugContext(req.Context(), "forwarding request to origin", "url", req.URL.String())
+		ctx, span := tracing.Start(req.Context(), "origin "+req.Method, tracing.KindClient)
+		span.SetAttr("server.address", origin.Host)
+		span.SetAttr("url.full", req.URL.String())
+		span.SetAttr("http.request.resend_count", attempt)
+		tracing.Inject(ctx, req.Header)
+		start := time.Now()
+		resp, err := p.HttpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			span.SetError(err)
+		} else {
+			span.SetAttr("http.response.status_code", resp.StatusCode)
+		}
+		span.End()
+		servertiming.Since(req.Context(), "origin", start)
+		originDuration.With(origin.String()).ObserveSince(start)
+		observeOrigin(origin.String(), resp, err)
+		exchangeOf(req.Context()).origin = origin.String()
+		failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+		if member != nil {
+			rt.Pool.Done(member, failed)
+		}
+		if req.Context().Err() != nil {
+			// the client went away, that says nothing about the origin
+			breaker.Discard()
+		} else {
+			breaker.Record(failed, time.Since(start))
+		}
 
-		// response to client
-		for k, v := range originResponse.Header {
-			for _, vv := range v {
-				w.Header().Add(k, vv)
+		if !retryable || attempt >= p.Retry.Attempts || !shouldRetry(req, resp, err) || !p.Retry.allow() {
+			if err != nil {
+				return nil, err
 			}
+			removeHopByHopHeaders(resp.Header)
+			return resp, nil
 		}
-		w.Header().Add("X-Cache", "miss")
-		w.WriteHeader(originResponse.StatusCode)
-		if _, err := w.Write(body); err != nil {
-			log.Println("error: writing origin response to client", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+
+		if err != nil {
+			slog.InfoContext(req.Context(), "retrying request to origin", "origin", origin.String(), "error", err)
+		} else {
+			slog.InfoContext(req.Context(), "retrying request to origin", "origin", origin.String(), "status", resp.StatusCode)
+			drainBody(resp)
+		}
+		if err := sleep(req.Context(), upstream.Backoff(attempt, p.Retry.Backoff, p.Retry.MaxBackoff)); err != nil {
+			return nil, err
 		}
+		previous = member
 	}
 }
 
-func parseOriginURL(origin string) (string, error) {
-	// if origin is hostname:port, add default scheme http for url.Parse recognize it as url
-	if !strings.Contains(origin, "://") && strings.Contains(origin, ":") {
-		origin = "http://" + origin
+// originErrorStatus returns the status code answering a failed origin request.
+func originErrorStatus(err error) int {
+	if errors.Is(err, upstream.ErrNoHealthyMember) || errors.Is(err, upstream.ErrCircuitOpen) {
+		return http.StatusServiceUnavailable
 	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
 
-	parsedOrigin, err := url.Parse(origin)
-	if err != nil {
-		return "", fmt.Errorf("invalid origin: %s", err)
+// pickOrigin returns the origin server for the next request of rt, avoiding
+// previous if possible. The returned member is nil when rt has no pool,
+// otherwise the caller must report the outcome to the pool.
+func (p *Proxy) pickOrigin(rt *Route, key string, previous *upstream.Member) (*url.URL, *upstream.Member, error) {
+	if rt.Pool != nil {
+		m, err := rt.Pool.PickExcept(key, previous)
+		if err != nil {
+			return nil, nil, err
+		}
+		return m.URL, m, nil
 	}
 
-	if parsedOrigin.Scheme == "" {
-		parsedOrigin.Scheme = "http"
+	if rt.Origin == "" {
+		return nil, nil, errNoOrigin
+	}
+	origin, err := upstream.ParseOrigin(rt.Origin)
+	if err != nil {
+		return nil, nil, err
 	}
+	return origin, nil, nil
+}
+
+// setTarget points req at path and query on the origin server.
+func setTarget(req *http.Request, origin *url.URL, path, query string) {
+	target := *origin
+	target.Path = strings.TrimSuffix(origin.Path, "/") + path
+	target.RawPath = ""
+	target.RawQuery = query
+	req.URL = &target
+	req.Host = ""
+}
 
-	return parsedOrigin.String(), nil
+// copyResponseHeader adds every value of src but the cache tags to the client
+// response header dst, applies the response header rules of rt and appends
+// this proxy to its Via field.
+func copyResponseHeader(dst, src http.Header, rt *Route) {
+	for k, v := range src {
+		for _, vv := range v {
+			dst.Add(k, vv)
+		}
+	}
+	removeTagHeaders(dst)
+	rt.ResponseHeaders.apply(dst)
+	addVia(dst, 1, 1)
 }
@@ -2,28 +2,82 @@ package proxy
 
 import (
 	"caching-proxy/internal/cache"
+	"caching-proxy/internal/compress"
 	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 type MockCache struct {
+	mu    sync.Mutex
 	items map[string]*cache.Item
 }
 
 func (m *MockCache) Get(_ context.Context, key string) (*cache.Item, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	item, ok := m.items[key]
 	return item, ok
 }
 
-func (m *MockCache) Set(key string, item *cache.Item) {
+func (m *MockCache) GetStale(ctx context.Context, key string) (*cache.Item, bool) {
+	return m.Get(ctx, key)
+}
+
+func (m *MockCache) Set(ctx context.Context, key string, item *cache.Item) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.items[key] = item
 }
 
+func (m *MockCache) Remove(_ context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.items[key]
+	delete(m.items, key)
+	return ok, nil
+}
+
+func (m *MockCache) RemoveTag(_ context.Context, tag string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for key, item := range m.items {
+		if slices.Contains(item.Tags, tag) {
+			delete(m.items, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MockCache) Ban(ctx context.Context, expr string) error {
+	match, err := CompileBan(expr)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, item := range m.items {
+		if match(item) {
+			delete(m.items, key)
+		}
+	}
+	return nil
+}
+
+func (m *MockCache) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.items)
+}
+
 func (m *MockCache) TTL() time.Duration {
 	return 1 * time.Minute
 }
@@ -94,48 +148,422 @@ func TestProxyHandler(t *testing.T) {
 		})
 	}
 }
-func TestParseOriginURL(t *testing.T) {
+func TestProxyHandler_CompressedHit(t *testing.T) {
+	body := strings.Repeat("Hello from cache ", 20)
+	compressed, err := compress.Encode(compress.Gzip, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		acceptEncoding   string
+		expectedEncoding string
+		expectedBody     string
+	}{
+		{
+			name:             "client accepts stored encoding",
+			acceptEncoding:   "gzip, br",
+			expectedEncoding: "gzip",
+			expectedBody:     string(compressed),
+		},
+		{
+			name:             "client does not accept stored encoding",
+			acceptEncoding:   "br",
+			expectedEncoding: "",
+			expectedBody:     body,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			w := httptest.NewRecorder()
+
+			proxy := &Proxy{
+				Cache: &MockCache{
+					items: map[string]*cache.Item{
+						http.MethodGet + req.Host + "/test": {
+							ResponseBody:       compressed,
+							ResponseHeaders:    http.Header{"Content-Type": []string{"text/plain"}},
+							ResponseStatusCode: http.StatusOK,
+							Expiration:         time.Now().Add(time.Minute),
+							BodyEncoding:       compress.Gzip,
+						},
+					},
+				},
+			}
+
+			proxy.Handler().ServeHTTP(w, req)
+
+			resp := w.Result()
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.expectedBody {
+				t.Errorf("expected body %q, got %q", tt.expectedBody, string(got))
+			}
+			if resp.Header.Get("Content-Encoding") != tt.expectedEncoding {
+				t.Errorf("expected Content-Encoding %q, got %q", tt.expectedEncoding, resp.Header.Get("Content-Encoding"))
+			}
+			if resp.Header.Get("Vary") != "Accept-Encoding" {
+				t.Errorf("expected Vary %q, got %q", "Accept-Encoding", resp.Header.Get("Vary"))
+			}
+		})
+	}
+}
+
+func TestProxyHandler_Compression(t *testing.T) {
+	body := strings.Repeat("Hello from origin ", 20)
+
 	tests := []struct {
-		name        string
-		origin      string
-		expectedURL string
-		expectError bool
+		name             string
+		acceptEncoding   string
+		originEncoding   string
+		contentType      string
+		expectedEncoding string
+		expectedVary     string
 	}{
 		{
-			name:        "valid URL with scheme",
-			origin:      "http://example.com",
-			expectedURL: "http://example.com",
-			expectError: false,
+			name:             "client accepts brotli",
+			acceptEncoding:   "gzip, br",
+			contentType:      "text/plain",
+			expectedEncoding: "br",
+			expectedVary:     "Accept-Encoding",
 		},
 		{
-			name:        "valid URL without scheme",
-			origin:      "example.com",
-			expectedURL: "http://example.com",
-			expectError: false,
+			name:             "client accepts gzip only",
+			acceptEncoding:   "gzip",
+			contentType:      "text/plain",
+			expectedEncoding: "gzip",
+			expectedVary:     "Accept-Encoding",
 		},
 		{
-			name:        "valid URL without scheme and port",
-			origin:      "example:80",
-			expectedURL: "http://example:80",
-			expectError: false,
+			name:             "client accepts identity only",
+			acceptEncoding:   "",
+			contentType:      "text/plain",
+			expectedEncoding: "",
+			expectedVary:     "Accept-Encoding",
+		},
+		{
+			name:             "non compressible content type",
+			acceptEncoding:   "gzip, br",
+			contentType:      "image/png",
+			expectedEncoding: "",
+			expectedVary:     "",
+		},
+		{
+			name:             "already encoded by origin",
+			acceptEncoding:   "gzip, br",
+			originEncoding:   "zstd",
+			contentType:      "text/plain",
+			expectedEncoding: "zstd",
+			expectedVary:     "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				if tt.originEncoding != "" {
+					w.Header().Set("Content-Encoding", tt.originEncoding)
+				}
+				if _, err := w.Write([]byte(body)); err != nil {
+					t.Fatalf("failed to write response: %v", err)
+				}
+			}))
+			defer originServer.Close()
+
+			mockCache := &MockCache{items: make(map[string]*cache.Item)}
+			proxy := &Proxy{
+				Origin:     originServer.URL,
+				HttpClient: originServer.Client(),
+				Cache:      mockCache,
+				Compression: &Compression{
+					Encodings: []string{compress.Brotli, compress.Gzip},
+				},
+			}
+
+			// the first request is a miss, the second one is served from the cache
+			for _, expectedCache := range []string{"miss", "hit"} {
+				req := httptest.NewRequest(http.MethodGet, "/test", nil)
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+				w := httptest.NewRecorder()
+				proxy.Handler().ServeHTTP(w, req)
+
+				resp := w.Result()
+				got, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.Header.Get("X-Cache") != expectedCache {
+					t.Errorf("expected X-Cache %q, got %q", expectedCache, resp.Header.Get("X-Cache"))
+				}
+				if resp.Header.Get("Content-Encoding") != tt.expectedEncoding {
+					t.Errorf("expected Content-Encoding %q, got %q", tt.expectedEncoding, resp.Header.Get("Content-Encoding"))
+				}
+				if resp.Header.Get("Vary") != tt.expectedVary {
+					t.Errorf("expected Vary %q, got %q", tt.expectedVary, resp.Header.Get("Vary"))
+				}
+				if tt.expectedEncoding != "" && tt.originEncoding == "" {
+					got, err = compress.Decode(tt.expectedEncoding, got)
+					if err != nil {
+						t.Fatalf("failed to decode body: %v", err)
+					}
+				}
+				if string(got) != body {
+					t.Errorf("expected body %q, got %q", body, string(got))
+				}
+			}
+
+			// the cache always keeps the identity copy of the response
+			item := mockCache.items[http.MethodGet+"example.com/test"]
+			if tt.originEncoding == "" && string(item.ResponseBody) != body {
+				t.Errorf("expected cached body to be the identity copy, got %q", string(item.ResponseBody))
+			}
+		})
+	}
+}
+
+func TestProxyHandler_Streaming(t *testing.T) {
+	release := make(chan struct{})
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write([]byte("first chunk,")); err != nil {
+			t.Errorf("failed to write response: %v", err)
+			return
+		}
+		w.(http.Flusher).Flush()
+		// hold the rest of the body until the client has seen the first chunk
+		<-release
+		if _, err := w.Write([]byte("second chunk")); err != nil {
+			t.Errorf("failed to write response: %v", err)
+		}
+	}))
+	defer originServer.Close()
+
+	mockCache := &MockCache{items: make(map[string]*cache.Item)}
+	proxy := &Proxy{
+		Origin:     originServer.URL,
+		HttpClient: originServer.Client(),
+		Cache:      mockCache,
+	}
+	proxyServer := httptest.NewServer(proxy.Handler())
+	defer proxyServer.Close()
+
+	resp, err := http.Get(proxyServer.URL + "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	first := make([]byte, len("first chunk,"))
+	if _, err := io.ReadFull(resp.Body, first); err != nil {
+		t.Fatalf("failed to read first chunk: %v", err)
+	}
+	if mockCache.Len() != 0 {
+		t.Errorf("expected nothing cached before the body is complete")
+	}
+	close(release)
+
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first)+string(rest) != "first chunk,second chunk" {
+		t.Errorf("expected body %q, got %q", "first chunk,second chunk", string(first)+string(rest))
+	}
+}
+
+func TestProxyHandler_StreamingNotCached(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxObjectSize int64
+		origin        http.HandlerFunc
+		expectedBody  string
+		expectError   bool
+	}{
+		{
+			name:          "body exceeds max object size",
+			maxObjectSize: 8,
+			origin: func(w http.ResponseWriter, r *http.Request) {
+				// no Content-Length, the limit is only hit while streaming
+				w.(http.Flusher).Flush()
+				if _, err := w.Write([]byte("Hello from origin")); err != nil {
+					t.Errorf("failed to write response: %v", err)
+				}
+			},
+			expectedBody: "Hello from origin",
 		},
 		{
-			name:        "invalid URL",
-			origin:      "://example.com",
-			expectedURL: "",
+			name: "origin connection drops mid-stream",
+			origin: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "100")
+				if _, err := w.Write([]byte("partial")); err != nil {
+					t.Errorf("failed to write response: %v", err)
+					return
+				}
+				w.(http.Flusher).Flush()
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Errorf("failed to hijack connection: %v", err)
+					return
+				}
+				conn.Close()
+			},
 			expectError: true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result, err := parseOriginURL(tt.origin)
+			originServer := httptest.NewServer(tt.origin)
+			defer originServer.Close()
+
+			mockCache := &MockCache{items: make(map[string]*cache.Item)}
+			handlerDone := make(chan struct{})
+			proxy := &Proxy{
+				Origin:        originServer.URL,
+				HttpClient:    originServer.Client(),
+				Cache:         mockCache,
+				MaxObjectSize: tt.maxObjectSize,
+			}
+			proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(handlerDone)
+				proxy.Handler().ServeHTTP(w, r)
+			}))
+			defer proxyServer.Close()
+
+			resp, err := http.Get(proxyServer.URL + "/test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
 			if (err != nil) != tt.expectError {
 				t.Errorf("expected error: %v, got: %v", tt.expectError, err)
 			}
-			if result != tt.expectedURL {
-				t.Errorf("expected URL: %s, got: %s", tt.expectedURL, result)
+			if !tt.expectError && string(body) != tt.expectedBody {
+				t.Errorf("expected body %q, got %q", tt.expectedBody, string(body))
+			}
+			if strings.Contains(resp.Header.Get("Cache-Status"), "stored") {
+				t.Errorf("expected Cache-Status not to announce a stored response, got %q", resp.Header.Get("Cache-Status"))
+			}
+
+			<-handlerDone
+			if mockCache.Len() != 0 {
+				t.Errorf("expected response not to be cached")
 			}
 		})
 	}
 }
+
+func TestProxyHandler_Head(t *testing.T) {
+	var originMethods []string
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originMethods = append(originMethods, r.Method)
+		w.Header().Set("Origin-Header", "ok")
+		w.Header().Set("Content-Length", "17")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte("Hello from origin")); err != nil {
+			t.Fatalf("failed to write response: %v", err)
+		}
+	}))
+	defer originServer.Close()
+
+	t.Run("HEAD miss does not populate the GET entry", func(t *testing.T) {
+		originMethods = nil
+		mockCache := &MockCache{items: make(map[string]*cache.Item)}
+		proxy := &Proxy{
+			Origin:     originServer.URL,
+			HttpClient: originServer.Client(),
+			Cache:      mockCache,
+		}
+
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/test", nil))
+
+		resp := w.Result()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp.Header.Get("X-Cache") != "miss" {
+			t.Errorf("expected X-Cache %q, got %q", "miss", resp.Header.Get("X-Cache"))
+		}
+		if mockCache.Len() != 0 {
+			t.Errorf("expected HEAD response not to be cached")
+		}
+		if strings.Join(originMethods, ",") != http.MethodHead {
+			t.Errorf("expected origin to receive %q, got %q", http.MethodHead, originMethods)
+		}
+	})
+
+	t.Run("HEAD miss is not encoded", func(t *testing.T) {
+		proxy := &Proxy{
+			Origin:      originServer.URL,
+			HttpClient:  originServer.Client(),
+			Cache:       &MockCache{items: make(map[string]*cache.Item)},
+			Compression: &Compression{Encodings: []string{"gzip"}, ContentTypes: []string{"text/"}},
+		}
+
+		req := httptest.NewRequest(http.MethodHead, "/test-encoded", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, req)
+
+		resp := w.Result()
+		if resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("expected no Content-Encoding, got %q", resp.Header.Get("Content-Encoding"))
+		}
+		if resp.Header.Get("Content-Length") != "17" {
+			t.Errorf("expected Content-Length %q, got %q", "17", resp.Header.Get("Content-Length"))
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("expected no body, got %q", w.Body.String())
+		}
+	})
+
+	t.Run("HEAD hit is served from the GET entry", func(t *testing.T) {
+		originMethods = nil
+		proxy := &Proxy{
+			Origin:     originServer.URL,
+			HttpClient: originServer.Client(),
+			Cache:      &MockCache{items: make(map[string]*cache.Item)},
+		}
+
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+		if w.Result().Header.Get("X-Cache") != "miss" {
+			t.Fatalf("expected GET to be a miss")
+		}
+
+		w = httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/test", nil))
+
+		resp := w.Result()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if len(body) != 0 {
+			t.Errorf("expected no body, got %q", string(body))
+		}
+		if resp.Header.Get("X-Cache") != "hit" {
+			t.Errorf("expected X-Cache %q, got %q", "hit", resp.Header.Get("X-Cache"))
+		}
+		if resp.Header.Get("Origin-Header") != "ok" {
+			t.Errorf("expected header %q: %q, got %q", "Origin-Header", "ok", resp.Header.Get("Origin-Header"))
+		}
+		if resp.Header.Get("Content-Length") != "17" {
+			t.Errorf("expected Content-Length %q, got %q", "17", resp.Header.Get("Content-Length"))
+		}
+		if strings.Join(originMethods, ",") != http.MethodGet {
+			t.Errorf("expected origin to only receive %q, got %q", http.MethodGet, originMethods)
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/textproto"
+	"strings"
+)
+
+// viaPseudonym identifies this proxy in Via headers.
+const viaPseudonym = "caching-proxy"
+
+// hopByHopHeaders are the connection-specific fields a proxy must not forward,
+// see RFC 9110 section 7.6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ParseTrustedProxies parses a list of IP addresses and CIDR prefixes.
+func ParseTrustedProxies(list []string) ([]netip.Prefix, error) {
+	return parsePrefixes(list, "trusted proxy")
+}
+
+// parsePrefixes parses a list of IP addresses and CIDR prefixes, naming
+// what they are in errors.
+func parsePrefixes(list []string, what string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %s", what, s, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %s", what, s, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// removeHopByHopHeaders deletes the hop-by-hop fields from h, including any
+// field listed in Connection and every Proxy-* field.
+func removeHopByHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, f := range strings.Split(v, ",") {
+			if f = textproto.TrimString(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+	for _, f := range hopByHopHeaders {
+		h.Del(f)
+	}
+	for f := range h {
+		if strings.HasPrefix(f, "Proxy-") {
+			delete(h, f)
+		}
+	}
+}
+
+// setForwardedHeaders adds the X-Forwarded-*, Forwarded and Via fields for r
+// to the header of the request forwarded to the origin. Forwarding fields sent
+// by the client are only kept when it is a trusted proxy.
+func (p *Proxy) setForwardedHeaders(h http.Header, r *http.Request) {
+	clientIP := remoteIP(r)
+	if !p.trusted(clientIP) {
+		h.Del("X-Forwarded-For")
+		h.Del("X-Forwarded-Proto")
+		h.Del("X-Forwarded-Host")
+		h.Del("Forwarded")
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	if clientIP.IsValid() {
+		forwardedFor := clientIP.String()
+		if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+			forwardedFor = strings.Join(prior, ", ") + ", " + forwardedFor
+		}
+		h.Set("X-Forwarded-For", forwardedFor)
+	}
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", r.Host)
+	}
+
+	element := "proto=" + proto + ";host=" + quoteForwarded(r.Host)
+	if clientIP.IsValid() {
+		element = "for=" + forwardedNode(clientIP) + ";" + element
+	}
+	if prior := h.Values("Forwarded"); len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	h.Set("Forwarded", element)
+
+	addVia(h, r.ProtoMajor, r.ProtoMinor)
+}
+
+// trusted reports whether ip belongs to one of the trusted proxies.
+func (p *Proxy) trusted(ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	for _, prefix := range p.TrustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addVia appends this proxy to the Via field for a message received with the
+// given protocol version.
+func addVia(h http.Header, major, minor int) {
+	version := fmt.Sprintf("%d.%d", major, minor)
+	if major >= 2 {
+		version = fmt.Sprintf("%d", major)
+	}
+	h.Add("Via", version+" "+viaPseudonym)
+}
+
+// remoteIP returns the address of the peer that sent r.
+func remoteIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// forwardedNode formats ip as a Forwarded node, quoting IPv6 addresses.
+func forwardedNode(ip netip.Addr) string {
+	if ip.Is6() {
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
+
+// quoteForwarded quotes a Forwarded parameter value when it is not a token.
+func quoteForwarded(v string) string {
+	if strings.ContainsAny(v, ":[]\" ") {
+		return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+	}
+	return v
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":          []string{"keep-alive, X-Custom-Hop"},
+		"Keep-Alive":          []string{"timeout=5"},
+		"Upgrade":             []string{"websocket"},
+		"Proxy-Authorization": []string{"Basic abc"},
+		"Proxy-Connection":    []string{"keep-alive"},
+		"X-Custom-Hop":        []string{"1"},
+		"Content-Type":        []string{"text/plain"},
+		"Cache-Control":       []string{"max-age=60"},
+	}
+
+	removeHopByHopHeaders(h)
+
+	for _, k := range []string{"Connection", "Keep-Alive", "Upgrade", "Proxy-Authorization", "Proxy-Connection", "X-Custom-Hop"} {
+		if _, ok := h[k]; ok {
+			t.Errorf("expected header %q to be removed", k)
+		}
+	}
+	for _, k := range []string{"Content-Type", "Cache-Control"} {
+		if h.Get(k) == "" {
+			t.Errorf("expected header %q to be kept", k)
+		}
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name              string
+		remoteAddr        string
+		header            http.Header
+		expectedFor       string
+		expectedProto     string
+		expectedHost      string
+		expectedForwarded string
+	}{
+		{
+			name:              "untrusted client headers are replaced",
+			remoteAddr:        "203.0.113.7:4000",
+			header:            http.Header{"X-Forwarded-For": []string{"1.2.3.4"}, "X-Forwarded-Host": []string{"evil.example"}, "Forwarded": []string{"for=1.2.3.4"}},
+			expectedFor:       "203.0.113.7",
+			expectedProto:     "http",
+			expectedHost:      "example.com",
+			expectedForwarded: "for=203.0.113.7;proto=http;host=example.com",
+		},
+		{
+			name:              "trusted proxy headers are extended",
+			remoteAddr:        "10.1.2.3:4000",
+			header:            http.Header{"X-Forwarded-For": []string{"198.51.100.1"}, "X-Forwarded-Proto": []string{"https"}, "X-Forwarded-Host": []string{"www.example.com"}, "Forwarded": []string{"for=198.51.100.1;proto=https"}},
+			expectedFor:       "198.51.100.1, 10.1.2.3",
+			expectedProto:     "https",
+			expectedHost:      "www.example.com",
+			expectedForwarded: "for=198.51.100.1;proto=https, for=10.1.2.3;proto=http;host=example.com",
+		},
+		{
+			name:              "ipv6 client",
+			remoteAddr:        "[2001:db8::1]:4000",
+			header:            http.Header{},
+			expectedFor:       "2001:db8::1",
+			expectedProto:     "http",
+			expectedHost:      "example.com",
+			expectedForwarded: `for="[2001:db8::1]";proto=http;host=example.com`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/test", nil)
+			r.RemoteAddr = tt.remoteAddr
+			h := tt.header.Clone()
+
+			proxy := &Proxy{TrustedProxies: trusted}
+			proxy.setForwardedHeaders(h, r)
+
+			if h.Get("X-Forwarded-For") != tt.expectedFor {
+				t.Errorf("expected X-Forwarded-For %q, got %q", tt.expectedFor, h.Get("X-Forwarded-For"))
+			}
+			if h.Get("X-Forwarded-Proto") != tt.expectedProto {
+				t.Errorf("expected X-Forwarded-Proto %q, got %q", tt.expectedProto, h.Get("X-Forwarded-Proto"))
+			}
+			if h.Get("X-Forwarded-Host") != tt.expectedHost {
+				t.Errorf("expected X-Forwarded-Host %q, got %q", tt.expectedHost, h.Get("X-Forwarded-Host"))
+			}
+			if h.Get("Forwarded") != tt.expectedForwarded {
+				t.Errorf("expected Forwarded %q, got %q", tt.expectedForwarded, h.Get("Forwarded"))
+			}
+			if h.Get("Via") != "1.1 caching-proxy" {
+				t.Errorf("expected Via %q, got %q", "1.1 caching-proxy", h.Get("Via"))
+			}
+		})
+	}
+}
+
+func TestProxyHandler_HopByHopHeaders(t *testing.T) {
+	var originHeader http.Header
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originHeader = r.Header.Clone()
+		w.Header().Set("Connection", "X-Origin-Hop")
+		w.Header().Set("X-Origin-Hop", "1")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("Origin-Header", "ok")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer originServer.Close()
+
+	mockCache := &MockCache{items: make(map[string]*cache.Item)}
+	proxy := &Proxy{
+		Origin:     originServer.URL,
+		HttpClient: originServer.Client(),
+		Cache:      mockCache,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic abc")
+	w := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(w, req)
+
+	for _, k := range []string{"X-Client-Hop", "Proxy-Authorization"} {
+		if originHeader.Get(k) != "" {
+			t.Errorf("expected header %q not to be forwarded to the origin", k)
+		}
+	}
+	if originHeader.Get("Via") != "1.1 caching-proxy" {
+		t.Errorf("expected Via %q, got %q", "1.1 caching-proxy", originHeader.Get("Via"))
+	}
+
+	resp := w.Result()
+	for _, k := range []string{"X-Origin-Hop", "Proxy-Authenticate"} {
+		if resp.Header.Get(k) != "" {
+			t.Errorf("expected header %q not to be forwarded to the client", k)
+		}
+		if item := mockCache.items[http.MethodGet+"example.com/test"]; item.ResponseHeaders.Get(k) != "" {
+			t.Errorf("expected header %q not to be cached", k)
+		}
+	}
+	if resp.Header.Get("Origin-Header") != "ok" {
+		t.Errorf("expected header %q: %q, got %q", "Origin-Header", "ok", resp.Header.Get("Origin-Header"))
+	}
+	if resp.Header.Get("Via") != "1.1 caching-proxy" {
+		t.Errorf("expected Via %q, got %q", "1.1 caching-proxy", resp.Header.Get("Via"))
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := ParseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	proxy := &Proxy{TrustedProxies: prefixes}
+	for _, ip := range []string{"127.0.0.1", "10.20.30.40", "::1"} {
+		if !proxy.trusted(netip.MustParseAddr(ip)) {
+			t.Errorf("expected %s to be trusted", ip)
+		}
+	}
+	if proxy.trusted(netip.MustParseAddr("192.168.1.1")) {
+		t.Errorf("expected 192.168.1.1 not to be trusted")
+	}
+
+	if _, err := ParseTrustedProxies([]string{"not-an-ip"}); err == nil {
+		t.Errorf("expected error for invalid address")
+	}
+}
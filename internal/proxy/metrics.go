@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"caching-proxy/internal/metrics"
+	"net/http"
+	"strconv"
+)
+
+var (
+	cacheResults = metrics.Default.NewCounter("caching_proxy_cache_requests_total",
+		"Requests by route and cache result: hit, miss, stale or bypass.", "route", "result")
+	responses = metrics.Default.NewCounter("caching_proxy_responses_total",
+		"Responses sent to clients by route and status code.", "route", "code")
+	originDuration = metrics.Default.NewHistogram("caching_proxy_origin_request_duration_seconds",
+		"Time until the origin sent the response headers, by origin.", nil, "origin")
+	originResponses = metrics.Default.NewCounter("caching_proxy_origin_responses_total",
+		`Origin responses by origin and status code, "error" when none was received.`, "origin", "code")
+	coalescedInFlight = metrics.Default.NewGauge("caching_proxy_coalesced_requests_in_flight",
+		"Requests waiting for another request for the same object to fill the cache.")
+)
+
+// observeOrigin records the outcome of a request sent to origin.
+func observeOrigin(origin string, resp *http.Response, err error) {
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	originResponses.With(origin, code).Inc()
+}
+
+// observe records a request of rt answered with status.
+func observe(rt *Route, cs cacheStatus, status int) {
+	route := rt.label()
+	cacheResults.With(route, cs.result()).Inc()
+	responses.With(route, strconv.Itoa(status)).Inc()
+}
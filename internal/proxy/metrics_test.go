@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyHandler_Metrics(t *testing.T) {
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("Hello from origin"))
+	}))
+	defer originServer.Close()
+
+	proxy := &Proxy{
+		Origin:     originServer.URL,
+		HttpClient: originServer.Client(),
+		Cache:      &MockCache{items: make(map[string]*cache.Item)},
+		Routes: []*Route{
+			{Name: "api", PathPrefix: "/api/", Origin: originServer.URL, Bypass: true},
+		},
+	}
+
+	counter := func(c interface{ Value() float64 }) func() float64 {
+		before := c.Value()
+		return func() float64 { return c.Value() - before }
+	}
+	hits := counter(cacheResults.With("default", "hit"))
+	misses := counter(cacheResults.With("default", "miss"))
+	bypassed := counter(cacheResults.With("api", "bypass"))
+	ok := counter(responses.With("default", "200"))
+	notFound := counter(responses.With("default", "404"))
+	originOK := counter(originResponses.With(originServer.URL, "200"))
+
+	for _, path := range []string{"/metrics-test", "/metrics-test", "/missing", "/api/users"} {
+		proxy.Handler()(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	tests := []struct {
+		name     string
+		got      float64
+		expected float64
+	}{
+		{"hits", hits(), 1},
+		{"misses", misses(), 2},
+		{"bypassed", bypassed(), 1},
+		{"200 responses", ok(), 2},
+		{"404 responses", notFound(), 1},
+		{"origin 200 responses", originOK(), 2},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.expected {
+			t.Errorf("expected %v %s, got %v", tt.expected, tt.name, tt.got)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+const (
+	// MethodPurge removes the cached response of the request URL.
+	MethodPurge = "PURGE"
+	// MethodBan invalidates every cached response matching the ban headers.
+	MethodBan = "BAN"
+)
+
+// cachedMethods are the methods whose responses may appear in cache keys.
+var cachedMethods = []string{
+	http.MethodGet,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
+// PurgePolicy allows clients to send PURGE and BAN requests.
+type PurgePolicy struct {
+	// Allow lists the client addresses allowed to purge.
+	Allow []netip.Prefix
+	// Tokens lists the bearer tokens allowed to purge from any address.
+	Tokens []string
+}
+
+// NewPurgePolicy returns the policy allowing the given addresses and tokens,
+// or nil when both are empty.
+func NewPurgePolicy(allow, tokens []string) (*PurgePolicy, error) {
+	if len(allow) == 0 && len(tokens) == 0 {
+		return nil, nil
+	}
+	prefixes, err := parsePrefixes(allow, "purge address")
+	if err != nil {
+		return nil, err
+	}
+	return &PurgePolicy{Allow: prefixes, Tokens: tokens}, nil
+}
+
+// allowed reports whether r may purge.
+func (pp *PurgePolicy) allowed(r *http.Request) bool {
+	ip := remoteIP(r)
+	for _, prefix := range pp.Allow {
+		if ip.IsValid() && prefix.Contains(ip) {
+			return true
+		}
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	for _, t := range pp.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// servePurge answers PURGE and BAN requests. It returns false for any other
+// method or when purging is disabled.
+func (p *Proxy) servePurge(w http.ResponseWriter, r *http.Request) bool {
+	if p.Purge == nil || (r.Method != MethodPurge && r.Method != MethodBan) {
+		return false
+	}
+	if !p.Purge.allowed(r) {
+		slog.WarnContext(r.Context(), "rejecting invalidation request", "method", r.Method, "remote_addr", r.RemoteAddr)
+		http.Error(w, "purging not allowed", http.StatusForbidden)
+		return true
+	}
+
+	if r.Method == MethodPurge {
+		// PURGE removes the response a GET of the same URL would be served
+		get := *r
+		get.Method = http.MethodGet
+		key := cacheKey(&get)
+		_, err := p.Cache.Remove(r.Context(), key)
+		if err == nil && p.RangeChunkSize > 0 {
+			// the chunks fetched for range requests belong to the same object
+			_, err = p.Cache.RemoveTag(r.Context(), chunksTag(key))
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "purging", "key", key, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+		slog.InfoContext(r.Context(), "purged", "key", key)
+		fmt.Fprintln(w, "purged")
+		return true
+	}
+
+	expr, err := newBanExpr(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	if err := p.Cache.Ban(r.Context(), expr); err != nil {
+		// the ban still applies to the lookups of this instance
+		slog.ErrorContext(r.Context(), "recording ban", "host", r.Host, "path", r.URL.Path, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	slog.InfoContext(r.Context(), "added ban", "host", r.Host, "path", r.URL.Path, "url", r.Header.Values("X-Ban-Url"), "headers", r.Header.Values("X-Ban-Header"))
+	fmt.Fprintln(w, "ban added")
+	return true
+}
+
+// banExpr is a BAN request in the form recorded in redis, so every
+// instance sharing it applies the ban.
+type banExpr struct {
+	Host string `json:"host"`
+	Path string `json:"path"`
+	URL  string `json:"url,omitempty"`
+	// Headers are "Name: regexp" pairs
+	Headers []string `json:"headers,omitempty"`
+}
+
+// newBanExpr returns the expression of a BAN request, see CompileBan.
+func newBanExpr(r *http.Request) (string, error) {
+	e := banExpr{Host: r.Host, Path: r.URL.Path, URL: r.Header.Get("X-Ban-Url"), Headers: r.Header.Values("X-Ban-Header")}
+	if _, err := e.compile(); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(e)
+	return string(b), err
+}
+
+// CompileBan returns the predicate of a ban expression recorded by a BAN
+// request. The ban applies to the host the request was sent to, and to the
+// paths matching the X-Ban-Url regular expression or else starting with the
+// request path. Every X-Ban-Header "Name: regexp" must also match a header
+// of the cached response.
+func CompileBan(expr string) (func(*cache.Item) bool, error) {
+	var e banExpr
+	if err := json.Unmarshal([]byte(expr), &e); err != nil {
+		return nil, fmt.Errorf("invalid ban %q: %s", expr, err)
+	}
+	return e.compile()
+}
+
+func (e banExpr) compile() (func(*cache.Item) bool, error) {
+	var url *regexp.Regexp
+	if e.URL != "" {
+		re, err := regexp.Compile(e.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid X-Ban-Url: %s", err)
+		}
+		url = re
+	}
+
+	headers := map[string]*regexp.Regexp{}
+	for _, v := range e.Headers {
+		name, expr, ok := strings.Cut(v, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid X-Ban-Header %q, expected \"Name: regexp\"", v)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(expr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid X-Ban-Header %q: %s", v, err)
+		}
+		headers[http.CanonicalHeaderKey(strings.TrimSpace(name))] = re
+	}
+
+	host, prefix := e.Host, e.Path
+	return func(item *cache.Item) bool {
+		path, ok := keyPath(item.Key, host)
+		if !ok {
+			return false
+		}
+		if url != nil {
+			if !url.MatchString(path) {
+				return false
+			}
+		} else if !strings.HasPrefix(path, prefix) {
+			return false
+		}
+		for name, re := range headers {
+			if !re.MatchString(item.ResponseHeaders.Get(name)) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// keyPath returns the path of a cache key for a request to host, see cacheKey.
+func keyPath(key, host string) (string, bool) {
+	for _, method := range cachedMethods {
+		if path, ok := strings.CutPrefix(key, method+host); ok && strings.HasPrefix(path, "/") {
+			path, _, _ = strings.Cut(path, "#")
+			return path, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newPurgeTestProxy() *Proxy {
+	c := cache.New(&cache.CacheConfig{TTL: time.Minute, Capacity: 10, CompileBan: CompileBan})
+	for key, contentType := range map[string]string{
+		"GETexample.com/products/1":          "text/html",
+		"GETexample.com/products/1.png":      "image/png",
+		"GETexample.com/products/1#chunk=0":  "image/png",
+		"GETexample.com/about":               "text/html",
+		"GETother.example.com/products/1":    "text/html",
+		"POSTexample.com/products/search":    "application/json",
+		"GETexample.com/productsarchive/old": "text/html",
+	} {
+		var tags []string
+		if object, _, ok := strings.Cut(key, "#chunk="); ok {
+			tags = []string{chunksTag(object)}
+		}
+		c.Set(context.TODO(), key, &cache.Item{
+			Key:                key,
+			ResponseHeaders:    http.Header{"Content-Type": []string{contentType}},
+			ResponseStatusCode: http.StatusOK,
+			Expiration:         time.Now().Add(time.Minute),
+			Tags:               tags,
+		})
+	}
+	return &Proxy{
+		Cache:          c,
+		RangeChunkSize: 1024,
+		Purge: &PurgePolicy{
+			Allow:  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			Tokens: []string{"cms-token"},
+		},
+	}
+}
+
+func TestProxyHandler_PurgeAuthorization(t *testing.T) {
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		authorization  string
+		expectedStatus int
+	}{
+		{name: "allowed address", remoteAddr: "10.1.2.3:1234", expectedStatus: http.StatusOK},
+		{name: "allowed token", remoteAddr: "192.0.2.1:1234", authorization: "Bearer cms-token", expectedStatus: http.StatusOK},
+		{name: "wrong token", remoteAddr: "192.0.2.1:1234", authorization: "Bearer guess", expectedStatus: http.StatusForbidden},
+		{name: "unknown address", remoteAddr: "192.0.2.1:1234", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newPurgeTestProxy()
+			req := httptest.NewRequest(MethodPurge, "http://example.com/products/1", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			_, found := proxy.Cache.Get(context.Background(), "GETexample.com/products/1")
+			if found != (tt.expectedStatus != http.StatusOK) {
+				t.Errorf("expected entry to be purged: %v, got found %v", tt.expectedStatus == http.StatusOK, found)
+			}
+		})
+	}
+}
+
+func TestProxyHandler_Purge(t *testing.T) {
+	proxy := newPurgeTestProxy()
+	req := httptest.NewRequest(MethodPurge, "http://example.com/products/1", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	proxy.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	for key, expected := range map[string]bool{
+		"GETexample.com/products/1":         false,
+		"GETexample.com/products/1#chunk=0": false,
+		"GETexample.com/products/1.png":     true,
+	} {
+		if _, found := proxy.Cache.Get(context.Background(), key); found != expected {
+			t.Errorf("%s: expected found %v, got %v", key, expected, found)
+		}
+	}
+}
+
+func TestProxyHandler_Ban(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		header   http.Header
+		expected map[string]bool
+	}{
+		{
+			name: "path prefix",
+			path: "/products/",
+			expected: map[string]bool{
+				"GETexample.com/products/1":          false,
+				"GETexample.com/products/1.png":      false,
+				"POSTexample.com/products/search":    false,
+				"GETexample.com/productsarchive/old": true,
+				"GETexample.com/about":               true,
+				"GETother.example.com/products/1":    true,
+			},
+		},
+		{
+			name:   "url regexp",
+			path:   "/",
+			header: http.Header{"X-Ban-Url": []string{`\.png$`}},
+			expected: map[string]bool{
+				"GETexample.com/products/1.png":     false,
+				"GETexample.com/products/1#chunk=0": true,
+				"GETexample.com/products/1":         true,
+			},
+		},
+		{
+			name:   "response header",
+			path:   "/",
+			header: http.Header{"X-Ban-Header": []string{"content-type: ^text/"}},
+			expected: map[string]bool{
+				"GETexample.com/products/1":       false,
+				"GETexample.com/about":            false,
+				"GETexample.com/products/1.png":   true,
+				"POSTexample.com/products/search": true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newPurgeTestProxy()
+			req := httptest.NewRequest(MethodBan, "http://example.com"+tt.path, nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+			}
+
+			for key, expected := range tt.expected {
+				if _, found := proxy.Cache.Get(context.Background(), key); found != expected {
+					t.Errorf("%s: expected found %v, got %v", key, expected, found)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyHandler_BanInvalid(t *testing.T) {
+	proxy := newPurgeTestProxy()
+	req := httptest.NewRequest(MethodBan, "http://example.com/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Ban-Url", "(")
+	w := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
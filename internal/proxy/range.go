@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"bytes"
+	"caching-proxy/internal/cache"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rangeNotSupportedError is returned when the origin does not answer a range
+// request with a partial response. The body of its response is left open, so
+// the request can be answered from it.
+type rangeNotSupportedError struct {
+	resp *http.Response
+}
+
+func (e *rangeNotSupportedError) Error() string {
+	return "origin does not support range requests"
+}
+
+// isRangeRequest reports whether r asks for a part of the representation.
+func isRangeRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.Header.Get("Range") != ""
+}
+
+// serveRange answers a range request from item with its complete identity
+// body. It handles single and multiple ranges, If-Range and unsatisfiable ranges.
+func serveRange(w http.ResponseWriter, r *http.Request, rt *Route, item *cache.Item, body []byte, status cacheStatus) {
+	copyResponseHeader(w.Header(), item.ResponseHeaders, rt)
+	// ServeContent computes the length of whatever part it sends
+	w.Header().Del("Content-Length")
+	w.Header().Set("Accept-Ranges", "bytes")
+	setCacheStatus(w, r, status)
+	setAge(w.Header(), item, time.Now())
+
+	var modtime time.Time
+	if lm := item.ResponseHeaders.Get("Last-Modified"); lm != "" {
+		if t, err := http.ParseTime(lm); err == nil {
+			modtime = t
+		}
+	}
+	http.ServeContent(w, r, "", modtime, bytes.NewReader(body))
+}
+
+// serveFromComplete answers the range request r from originResponse, the
+// origin's answer to a request for the complete representation, and caches
+// the representation when it fits. The origin is not asked again when it
+// does not.
+func (p *Proxy) serveFromComplete(w http.ResponseWriter, r *http.Request, rt *Route, cacheKey string, originResponse *http.Response, status cacheStatus) {
+	if originResponse.StatusCode != http.StatusOK {
+		p.streamResponse(w, r, rt, originResponse, cacheKey, status)
+		return
+	}
+
+	item, body, err := p.readItem(rt, cacheKey, originResponse)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "reading origin response body", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	status.fwdStatus = originResponse.StatusCode
+	if item == nil {
+		slog.DebugContext(r.Context(), "not caching response, body exceeds max object size", "key", cacheKey, "max_object_size", p.MaxObjectSize)
+		p.streamRange(w, r, rt, originResponse, body, status)
+		return
+	}
+	p.Cache.Set(r.Context(), cacheKey, item)
+	status.stored = true
+	status.ttl, status.hasTTL = time.Until(item.Expiration), true
+	serveRange(w, r, rt, item, item.ResponseBody, status)
+}
+
+// streamRange answers the range request r from body, the complete identity
+// body of originResponse, as it arrives. Requests for several ranges, with
+// If-Range or for a body of unknown length get the complete representation,
+// which a server may always send instead of ranges.
+func (p *Proxy) streamRange(w http.ResponseWriter, r *http.Request, rt *Route, originResponse *http.Response, body io.Reader, status cacheStatus) {
+	size := originResponse.ContentLength
+	start, end, ok := parseSingleRange(r.Header.Get("Range"))
+	if !ok || size < 0 || r.Header.Get("If-Range") != "" {
+		complete := *originResponse
+		complete.Body = io.NopCloser(body)
+		p.streamResponse(w, r, rt, &complete, "", status)
+		return
+	}
+
+	switch {
+	case start < 0:
+		// suffix range, the last end bytes
+		start = max(size-end, 0)
+		end = size - 1
+	case end < 0 || end >= size:
+		end = size - 1
+	}
+	if start >= size || start > end {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	copyResponseHeader(w.Header(), originResponse.Header, rt)
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	setCacheStatus(w, r, status)
+	w.WriteHeader(http.StatusPartialContent)
+
+	if _, err := io.CopyN(io.Discard, body, start); err != nil {
+		slog.ErrorContext(r.Context(), "reading origin response body", "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	if _, err := io.CopyN(flushWriter{w}, body, end-start+1); err != nil {
+		// the status line is already sent, abort so the client sees a truncated response
+		slog.DebugContext(r.Context(), "streaming range response to client", "error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// serveChunked answers a single range request from chunks of the object,
+// fetching and caching the missing ones from the origin. It returns false
+// without writing anything when the request cannot be served this way.
+func (p *Proxy) serveChunked(w http.ResponseWriter, r *http.Request, rt *Route, cacheKey string) bool {
+	// validating If-Range needs the complete representation's validators
+	if r.Header.Get("If-Range") != "" {
+		return false
+	}
+	start, end, ok := parseSingleRange(r.Header.Get("Range"))
+	if !ok {
+		return false
+	}
+
+	// the total length is only known once a chunk has been seen
+	first := int64(0)
+	if start >= 0 {
+		first = start / p.RangeChunkSize
+	}
+	chunk, hit, total, err := p.chunk(r, rt, cacheKey, first)
+	var unsupported *rangeNotSupportedError
+	if errors.As(err, &unsupported) {
+		defer unsupported.resp.Body.Close()
+		p.serveFromComplete(w, r, rt, cacheKey, unsupported.resp, cacheStatus{fwd: fwdURIMiss, key: cacheKey})
+		return true
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fetching range chunk", "key", cacheKey, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+
+	switch {
+	case start < 0:
+		// suffix range, the last end bytes
+		start = max(total-end, 0)
+		end = total - 1
+	case end < 0 || end >= total:
+		end = total - 1
+	}
+	if chunk == nil || start >= total || start > end {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+		http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+
+	copyResponseHeader(w.Header(), chunk.ResponseHeaders, rt)
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	now := time.Now()
+	status := cachedStatus(chunk, now)
+	if hit {
+		setAge(w.Header(), chunk, now)
+	} else {
+		status.hit, status.fwd, status.fwdStatus, status.stored, status.tier = false, fwdURIMiss, http.StatusPartialContent, true, ""
+	}
+	setCacheStatus(w, r, status)
+	w.WriteHeader(http.StatusPartialContent)
+
+	for idx := start / p.RangeChunkSize; idx <= end/p.RangeChunkSize; idx++ {
+		if idx != first || chunk == nil {
+			if chunk, _, _, err = p.chunk(r, rt, cacheKey, idx); err != nil || chunk == nil {
+				if errors.As(err, &unsupported) {
+					unsupported.resp.Body.Close()
+				}
+				// the status line is already sent, abort so the client sees a truncated response
+				slog.ErrorContext(r.Context(), "fetching range chunk", "key", cacheKey, "error", err)
+				panic(http.ErrAbortHandler)
+			}
+		}
+		body, err := chunk.Body()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "decoding cached chunk", "key", cacheKey, "error", err)
+			panic(http.ErrAbortHandler)
+		}
+
+		offset := idx * p.RangeChunkSize
+		lo := max(start-offset, 0)
+		hi := min(end-offset+1, int64(len(body)))
+		if _, err := w.Write(body[lo:hi]); err != nil {
+			slog.DebugContext(r.Context(), "writing range response to client", "error", err)
+			return true
+		}
+		chunk = nil
+	}
+	return true
+}
+
+// chunk returns the idx-th chunk of the object, from the cache when possible.
+// It also returns whether it was a cache hit and the total length of the
+// object. A nil chunk with no error means the chunk lies past the end.
+func (p *Proxy) chunk(r *http.Request, rt *Route, cacheKey string, idx int64) (*cache.Item, bool, int64, error) {
+	key := cacheKey + "#chunk=" + strconv.FormatInt(idx, 10)
+	if item, ok := p.cacheGet(r.Context(), key); ok {
+		total, err := contentRangeTotal(item.ResponseHeaders.Get("Content-Range"))
+		return item, true, total, err
+	}
+
+	req, err := p.newOriginRequest(r, rt)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	start := idx * p.RangeChunkSize
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+p.RangeChunkSize-1))
+
+	originResponse, err := p.do(rt, key, req)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	if originResponse.StatusCode != http.StatusPartialContent && originResponse.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		return nil, false, 0, &rangeNotSupportedError{resp: originResponse}
+	}
+	defer originResponse.Body.Close()
+
+	if originResponse.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		total, err := contentRangeTotal(originResponse.Header.Get("Content-Range"))
+		return nil, false, total, err
+	}
+
+	total, err := contentRangeTotal(originResponse.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, false, 0, err
+	}
+	body, err := io.ReadAll(io.LimitReader(originResponse.Body, p.RangeChunkSize))
+	if err != nil {
+		return nil, false, 0, err
+	}
+	header := originResponse.Header.Clone()
+	header.Del("Content-Length")
+
+	item := &cache.Item{
+		Key:                key,
+		ResponseBody:       body,
+		ResponseHeaders:    header,
+		ResponseStatusCode: http.StatusPartialContent,
+		Expiration:         time.Now().Add(p.ttl(rt)),
+		Tags:               append(responseTags(header), chunksTag(cacheKey)),
+	}
+	p.Cache.Set(r.Context(), key, item)
+	return item, false, total, nil
+}
+
+// parseSingleRange parses a Range header asking for exactly one byte range.
+// An open range ("bytes=10-") returns end -1, a suffix range ("bytes=-10")
+// returns start -1 and the suffix length as end.
+func parseSingleRange(s string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(s, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false
+	}
+
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return -1, n, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if last == "" {
+		return start, -1, true
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// contentRangeTotal returns the complete length from a Content-Range header
+// value such as "bytes 0-99/1234" or "bytes */1234".
+func contentRangeTotal(s string) (int64, error) {
+	_, total, ok := strings.Cut(s, "/")
+	if !ok || total == "*" {
+		return 0, fmt.Errorf("unknown complete length in Content-Range %q", s)
+	}
+	return strconv.ParseInt(total, 10, 64)
+}
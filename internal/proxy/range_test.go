@@ -0,0 +1,369 @@
+package proxy
+
+import (
+	"bytes"
+	"caching-proxy/internal/cache"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const rangeBody = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+func TestProxyHandler_RangeFromCache(t *testing.T) {
+	tests := []struct {
+		name           string
+		rangeHeader    string
+		ifRange        string
+		expectedStatus int
+		expectedBody   string
+		expectedRange  string
+	}{
+		{
+			name:           "single range",
+			rangeHeader:    "bytes=2-5",
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "2345",
+			expectedRange:  "bytes 2-5/36",
+		},
+		{
+			name:           "suffix range",
+			rangeHeader:    "bytes=-3",
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "xyz",
+			expectedRange:  "bytes 33-35/36",
+		},
+		{
+			name:           "if-range matches",
+			rangeHeader:    "bytes=0-1",
+			ifRange:        `"v1"`,
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "01",
+			expectedRange:  "bytes 0-1/36",
+		},
+		{
+			name:           "if-range does not match",
+			rangeHeader:    "bytes=0-1",
+			ifRange:        `"v0"`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   rangeBody,
+		},
+		{
+			name:           "unsatisfiable range",
+			rangeHeader:    "bytes=100-200",
+			expectedStatus: http.StatusRequestedRangeNotSatisfiable,
+			expectedRange:  "bytes */36",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/video", nil)
+			req.Header.Set("Range", tt.rangeHeader)
+			if tt.ifRange != "" {
+				req.Header.Set("If-Range", tt.ifRange)
+			}
+			w := httptest.NewRecorder()
+
+			proxy := &Proxy{
+				Cache: &MockCache{items: map[string]*cache.Item{
+					http.MethodGet + req.Host + "/video": {
+						ResponseBody:       []byte(rangeBody),
+						ResponseHeaders:    http.Header{"Content-Type": []string{"video/mp4"}, "Etag": []string{`"v1"`}},
+						ResponseStatusCode: http.StatusOK,
+						Expiration:         time.Now().Add(time.Minute),
+					},
+				}},
+			}
+			proxy.Handler().ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if tt.expectedBody != "" && string(body) != tt.expectedBody {
+				t.Errorf("expected body %q, got %q", tt.expectedBody, string(body))
+			}
+			if resp.Header.Get("Content-Range") != tt.expectedRange {
+				t.Errorf("expected Content-Range %q, got %q", tt.expectedRange, resp.Header.Get("Content-Range"))
+			}
+			if resp.Header.Get("X-Cache") != "hit" {
+				t.Errorf("expected X-Cache %q, got %q", "hit", resp.Header.Get("X-Cache"))
+			}
+		})
+	}
+}
+
+func TestProxyHandler_MultiRangeFromCache(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/video", nil)
+	req.Header.Set("Range", "bytes=0-1,10-12")
+	w := httptest.NewRecorder()
+
+	proxy := &Proxy{
+		Cache: &MockCache{items: map[string]*cache.Item{
+			http.MethodGet + req.Host + "/video": {
+				ResponseBody:       []byte(rangeBody),
+				ResponseHeaders:    http.Header{"Content-Type": []string{"video/mp4"}},
+				ResponseStatusCode: http.StatusOK,
+				Expiration:         time.Now().Add(time.Minute),
+			},
+		}},
+	}
+	proxy.Handler().ServeHTTP(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected status %d, got %d", http.StatusPartialContent, resp.StatusCode)
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("expected multipart/byteranges, got %q", resp.Header.Get("Content-Type"))
+	}
+
+	var parts []string
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, string(b))
+	}
+	if strings.Join(parts, ",") != "01,abc" {
+		t.Errorf("expected parts %q, got %q", "01,abc", strings.Join(parts, ","))
+	}
+}
+
+func TestProxyHandler_RangeMiss(t *testing.T) {
+	var originRange []string
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originRange = append(originRange, r.Header.Get("Range"))
+		http.ServeContent(w, r, "video.mp4", time.Time{}, strings.NewReader(rangeBody))
+	}))
+	defer originServer.Close()
+
+	mockCache := &MockCache{items: make(map[string]*cache.Item)}
+	proxy := &Proxy{
+		Origin:     originServer.URL,
+		HttpClient: originServer.Client(),
+		Cache:      mockCache,
+	}
+
+	for _, expectedCache := range []string{"miss", "hit"} {
+		req := httptest.NewRequest(http.MethodGet, "/video", nil)
+		req.Header.Set("Range", "bytes=4-7")
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, req)
+
+		resp := w.Result()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Errorf("expected status %d, got %d", http.StatusPartialContent, resp.StatusCode)
+		}
+		if string(body) != "4567" {
+			t.Errorf("expected body %q, got %q", "4567", string(body))
+		}
+		if resp.Header.Get("X-Cache") != expectedCache {
+			t.Errorf("expected X-Cache %q, got %q", expectedCache, resp.Header.Get("X-Cache"))
+		}
+	}
+
+	// the origin is asked for the full representation once, which is cached
+	if len(originRange) != 1 || originRange[0] != "" {
+		t.Errorf("expected a single request without Range to the origin, got %q", originRange)
+	}
+	item, ok := mockCache.items[http.MethodGet+"example.com/video"]
+	if !ok || item.ResponseStatusCode != http.StatusOK || string(item.ResponseBody) != rangeBody {
+		t.Errorf("expected the full 200 response to be cached")
+	}
+}
+
+func TestProxyHandler_RangeChunked(t *testing.T) {
+	var originRange []string
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originRange = append(originRange, r.Header.Get("Range"))
+		http.ServeContent(w, r, "video.mp4", time.Time{}, strings.NewReader(rangeBody))
+	}))
+	defer originServer.Close()
+
+	mockCache := &MockCache{items: make(map[string]*cache.Item)}
+	proxy := &Proxy{
+		Origin:         originServer.URL,
+		HttpClient:     originServer.Client(),
+		Cache:          mockCache,
+		RangeChunkSize: 10,
+	}
+
+	tests := []struct {
+		rangeHeader    string
+		expectedStatus int
+		expectedBody   string
+		expectedRange  string
+		expectedOrigin []string
+	}{
+		{
+			rangeHeader:    "bytes=8-21",
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "89abcdefghijkl",
+			expectedRange:  "bytes 8-21/36",
+			expectedOrigin: []string{"bytes=0-9", "bytes=10-19", "bytes=20-29"},
+		},
+		{
+			rangeHeader:    "bytes=12-15",
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "cdef",
+			expectedRange:  "bytes 12-15/36",
+		},
+		{
+			rangeHeader:    "bytes=-4",
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "wxyz",
+			expectedRange:  "bytes 32-35/36",
+			expectedOrigin: []string{"bytes=30-39"},
+		},
+		{
+			rangeHeader:    "bytes=50-",
+			expectedStatus: http.StatusRequestedRangeNotSatisfiable,
+			expectedRange:  "bytes */36",
+			expectedOrigin: []string{"bytes=50-59"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rangeHeader, func(t *testing.T) {
+			originRange = nil
+			req := httptest.NewRequest(http.MethodGet, "/video", nil)
+			req.Header.Set("Range", tt.rangeHeader)
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if tt.expectedBody != "" && !bytes.Equal(body, []byte(tt.expectedBody)) {
+				t.Errorf("expected body %q, got %q", tt.expectedBody, string(body))
+			}
+			if resp.Header.Get("Content-Range") != tt.expectedRange {
+				t.Errorf("expected Content-Range %q, got %q", tt.expectedRange, resp.Header.Get("Content-Range"))
+			}
+			if strings.Join(originRange, ",") != strings.Join(tt.expectedOrigin, ",") {
+				t.Errorf("expected origin ranges %q, got %q", tt.expectedOrigin, originRange)
+			}
+		})
+	}
+}
+
+func TestProxyHandler_RangeFromOpenResponse(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxObjectSize  int64
+		rangeChunkSize int64
+		rangeHeader    string
+		expectedStatus int
+		expectedBody   string
+		expectCached   bool
+	}{
+		{"too large to cache", 10, 0, "bytes=4-7", http.StatusPartialContent, "4567", false},
+		{"too large to cache, suffix", 10, 0, "bytes=-3", http.StatusPartialContent, "xyz", false},
+		{"too large to cache, several ranges", 10, 0, "bytes=0-1,4-5", http.StatusOK, rangeBody, false},
+		{"origin ignores chunk range", 0, 10, "bytes=12-15", http.StatusPartialContent, "cdef", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var originRequests int
+			originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				originRequests++
+				// ignores Range
+				w.Header().Set("Content-Length", strconv.Itoa(len(rangeBody)))
+				w.Write([]byte(rangeBody))
+			}))
+			defer originServer.Close()
+
+			mockCache := &MockCache{items: make(map[string]*cache.Item)}
+			proxy := &Proxy{
+				Origin:         originServer.URL,
+				HttpClient:     originServer.Client(),
+				Cache:          mockCache,
+				MaxObjectSize:  tt.maxObjectSize,
+				RangeChunkSize: tt.rangeChunkSize,
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/video", nil)
+			req.Header.Set("Range", tt.rangeHeader)
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if string(body) != tt.expectedBody {
+				t.Errorf("expected body %q, got %q", tt.expectedBody, string(body))
+			}
+			if originRequests != 1 {
+				t.Errorf("expected a single request to the origin, got %d", originRequests)
+			}
+			if _, ok := mockCache.items[http.MethodGet+"example.com/video"]; ok != tt.expectCached {
+				t.Errorf("expected cached %v, got %v", tt.expectCached, ok)
+			}
+		})
+	}
+}
+
+func TestParseSingleRange(t *testing.T) {
+	tests := []struct {
+		header        string
+		expectedStart int64
+		expectedEnd   int64
+		expectedOK    bool
+	}{
+		{header: "bytes=0-99", expectedStart: 0, expectedEnd: 99, expectedOK: true},
+		{header: "bytes=100-", expectedStart: 100, expectedEnd: -1, expectedOK: true},
+		{header: "bytes=-50", expectedStart: -1, expectedEnd: 50, expectedOK: true},
+		{header: "bytes=0-1,5-6", expectedOK: false},
+		{header: "bytes=9-1", expectedOK: false},
+		{header: "items=0-1", expectedOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			start, end, ok := parseSingleRange(tt.header)
+			if ok != tt.expectedOK {
+				t.Fatalf("expected ok %v, got %v", tt.expectedOK, ok)
+			}
+			if ok && (start != tt.expectedStart || end != tt.expectedEnd) {
+				t.Errorf("expected %d-%d, got %d-%d", tt.expectedStart, tt.expectedEnd, start, end)
+			}
+		})
+	}
+}
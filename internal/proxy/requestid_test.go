@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestProxyHandler_RequestID(t *testing.T) {
+	var originID string
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originID = r.Header.Get("X-Request-ID")
+		// an origin echoing the ID must not leak it to the clients of cached copies
+		w.Header().Set("X-Request-ID", originID)
+		w.Write([]byte("Hello from origin"))
+	}))
+	defer originServer.Close()
+
+	proxy := &Proxy{
+		Origin:     originServer.URL,
+		HttpClient: originServer.Client(),
+		Cache:      &MockCache{items: make(map[string]*cache.Item)},
+	}
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	tests := []struct {
+		name     string
+		path     string
+		incoming string
+		reused   bool
+	}{
+		{"reused", "/request-id", "client-id-1", true},
+		{"cached response", "/request-id", "client-id-2", true},
+		{"generated", "/request-id-generated", "", false},
+		{"invalid characters", "/request-id-invalid", "bad id\x01", false},
+		{"too long", "/request-id-long", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originID = ""
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.incoming != "" {
+				req.Header.Set("X-Request-ID", tt.incoming)
+			}
+			rr := httptest.NewRecorder()
+			proxy.Handler()(rr, req)
+
+			got := rr.Result().Header.Values("X-Request-ID")
+			if len(got) != 1 {
+				t.Fatalf("expected a single X-Request-ID, got %q", got)
+			}
+			if tt.reused && got[0] != tt.incoming {
+				t.Errorf("expected X-Request-ID %q, got %q", tt.incoming, got[0])
+			}
+			if !tt.reused && !generated.MatchString(got[0]) {
+				t.Errorf("expected a generated X-Request-ID, got %q", got[0])
+			}
+			if originID != "" && originID != got[0] {
+				t.Errorf("expected the origin to receive X-Request-ID %q, got %q", got[0], originID)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"caching-proxy/internal/upstream"
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy configures retries of failed idempotent origin requests.
+type RetryPolicy struct {
+	// Attempts is the maximum number of retries of a request, 0 disables retries.
+	Attempts int
+	// Backoff is the base delay of the exponential backoff between retries.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+	// Budget bounds the share of retries across all requests, nil means unbounded.
+	Budget *upstream.RetryBudget
+}
+
+// allow reports whether the retry budget allows one more retry.
+func (rp RetryPolicy) allow() bool {
+	return rp.Budget == nil || rp.Budget.Withdraw()
+}
+
+// isIdempotent reports whether a request with the given method can safely be sent twice.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// shouldRetry reports whether the outcome of req is worth retrying: an error
+// other than the client going away, or a gateway error from the origin.
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// drainBody discards and closes the body of a response that is not used, so
+// its connection can be reused.
+func drainBody(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
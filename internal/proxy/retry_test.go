@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"caching-proxy/internal/upstream"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyHandler_Retry(t *testing.T) {
+	tests := []struct {
+		name             string
+		method           string
+		body             string
+		retry            RetryPolicy
+		expectedStatus   int
+		expectedRequests int32
+	}{
+		{
+			name:             "GET is retried",
+			method:           http.MethodGet,
+			retry:            RetryPolicy{Attempts: 2, Backoff: time.Millisecond},
+			expectedStatus:   http.StatusOK,
+			expectedRequests: 2,
+		},
+		{
+			name:             "POST is not retried",
+			method:           http.MethodPost,
+			body:             "payload",
+			retry:            RetryPolicy{Attempts: 2, Backoff: time.Millisecond},
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedRequests: 1,
+		},
+		{
+			name:             "retries disabled",
+			method:           http.MethodGet,
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedRequests: 1,
+		},
+		{
+			name:             "budget exhausted",
+			method:           http.MethodGet,
+			retry:            RetryPolicy{Attempts: 2, Backoff: time.Millisecond, Budget: upstream.NewRetryBudget(0, 0)},
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if requests.Add(1) == 1 {
+					http.Error(w, "try again", http.StatusServiceUnavailable)
+					return
+				}
+				w.Write([]byte("Hello from origin"))
+			}))
+			defer originServer.Close()
+
+			proxy := &Proxy{
+				Origin:     originServer.URL,
+				HttpClient: originServer.Client(),
+				Cache:      &MockCache{items: make(map[string]*cache.Item)},
+				Retry:      tt.retry,
+			}
+
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, httptest.NewRequest(tt.method, "/test", body))
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if got := requests.Load(); got != tt.expectedRequests {
+				t.Errorf("expected %d origin requests, got %d", tt.expectedRequests, got)
+			}
+		})
+	}
+}
+
+func TestProxyHandler_RetryOtherMember(t *testing.T) {
+	var failed, served atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failed.Add(1)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		w.Write([]byte("ok"))
+	}))
+	defer healthy.Close()
+
+	pool, err := upstream.NewPool(upstream.Config{Origins: []string{failing.URL, healthy.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{
+		HttpClient: &http.Client{},
+		Cache:      &MockCache{items: make(map[string]*cache.Item)},
+		Routes:     []*Route{{Pool: pool, Bypass: true}},
+		Retry:      RetryPolicy{Attempts: 1, Backoff: time.Millisecond},
+	}
+
+	for range 4 {
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+	if served.Load() != 4 {
+		t.Errorf("expected %d requests to the healthy member, got %d", 4, served.Load())
+	}
+}
+
+func TestProxyHandler_HeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer originServer.Close()
+	defer close(release)
+
+	proxy := &Proxy{
+		Origin: originServer.URL,
+		HttpClient: &http.Client{
+			Transport: upstream.NewTransport(upstream.TransportConfig{ResponseHeaderTimeout: 50 * time.Millisecond}),
+		},
+		Cache: &MockCache{items: make(map[string]*cache.Item)},
+	}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected status %d, got %d", http.StatusGatewayTimeout, w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the request to time out, took %v", elapsed)
+	}
+}
+
+func TestProxyHandler_CircuitBreaker(t *testing.T) {
+	var requests atomic.Int32
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer originServer.Close()
+
+	c := cache.New(&cache.CacheConfig{TTL: time.Minute, Capacity: 10, StaleTTL: time.Hour})
+	c.Set(context.TODO(), "GETexample.com/stale", &cache.Item{
+		Key:                "GETexample.com/stale",
+		ResponseBody:       []byte("stale body"),
+		ResponseHeaders:    http.Header{},
+		ResponseStatusCode: http.StatusOK,
+		Expiration:         time.Now().Add(-time.Second),
+	})
+
+	proxy := &Proxy{
+		Origin:     originServer.URL,
+		HttpClient: originServer.Client(),
+		Cache:      c,
+		Breakers:   upstream.NewBreakers(upstream.BreakerConfig{MinRequests: 2, ErrorRate: 1, OpenTime: time.Hour}),
+	}
+
+	tests := []struct {
+		name                string
+		path                string
+		expectedStatus      int
+		expectedCache       string
+		expectedCacheStatus string
+		expectedRequests    int32
+	}{
+		{name: "closed", path: "/a", expectedStatus: http.StatusInternalServerError, expectedCache: "miss",
+			expectedCacheStatus: `caching-proxy; fwd=uri-miss; fwd-status=500; ttl=60; key="GETexample.com/a"`, expectedRequests: 1},
+		{name: "opens", path: "/b", expectedStatus: http.StatusInternalServerError, expectedCache: "miss",
+			expectedCacheStatus: `caching-proxy; fwd=uri-miss; fwd-status=500; ttl=60; key="GETexample.com/b"`, expectedRequests: 2},
+		{name: "fails fast", path: "/c", expectedStatus: http.StatusServiceUnavailable,
+			expectedCacheStatus: `caching-proxy; fwd=uri-miss; key="GETexample.com/c"`, expectedRequests: 2},
+		{name: "serves stale", path: "/stale", expectedStatus: http.StatusOK, expectedCache: "stale",
+			expectedCacheStatus: `caching-proxy; fwd=stale; ttl=-2; key="GETexample.com/stale"; detail=memory`, expectedRequests: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil))
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if got := w.Header().Get("X-Cache"); got != tt.expectedCache {
+				t.Errorf("expected X-Cache %q, got %q", tt.expectedCache, got)
+			}
+			if got := w.Header().Get("Cache-Status"); got != tt.expectedCacheStatus {
+				t.Errorf("expected Cache-Status %q, got %q", tt.expectedCacheStatus, got)
+			}
+			if got := requests.Load(); got != tt.expectedRequests {
+				t.Errorf("expected %d origin requests, got %d", tt.expectedRequests, got)
+			}
+		})
+	}
+}
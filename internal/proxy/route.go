@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"caching-proxy/internal/upstream"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// errNoOrigin is returned when a request matches no route and there is no default origin.
+var errNoOrigin = errors.New("no origin for request")
+
+// Route maps requests matching a host pattern and a path prefix to an origin.
+type Route struct {
+	// Name identifies the route in metrics, see label.
+	Name string
+	// Host is an exact host name or a "*.example.com" wildcard matching its
+	// subdomains. An empty Host matches every host.
+	Host string
+	// PathPrefix is the prefix the request path must start with. An empty
+	// PathPrefix matches every path.
+	PathPrefix string
+	// Origin is the upstream server the matching requests are forwarded to.
+	// It is only used when the route has no Pool.
+	Origin string
+	// Pool balances the matching requests over several origin servers.
+	Pool *upstream.Pool
+	// TTL overrides the cache TTL for responses of this route, 0 keeps the cache TTL.
+	TTL time.Duration
+	// Bypass disables caching for this route, every request goes to the origin.
+	Bypass bool
+	// RequestHeaders are applied to the requests forwarded to the origin.
+	RequestHeaders HeaderRules
+	// ResponseHeaders are applied to the responses sent to the client.
+	ResponseHeaders HeaderRules
+}
+
+// HeaderRules describes changes applied to a header.
+type HeaderRules struct {
+	// Set replaces the values of these fields.
+	Set map[string]string
+	// Remove deletes these fields.
+	Remove []string
+}
+
+// apply changes h according to the rules.
+func (hr HeaderRules) apply(h http.Header) {
+	for _, k := range hr.Remove {
+		h.Del(k)
+	}
+	for k, v := range hr.Set {
+		h.Set(k, v)
+	}
+}
+
+// matches reports whether r is handled by the route.
+func (rt *Route) matches(r *http.Request) bool {
+	if rt.Host != "" && !matchHost(rt.Host, requestHost(r)) {
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, rt.PathPrefix)
+}
+
+// label returns the name of the route in metrics: its Name, else its host
+// and path prefix, else "default" for the route of the default Origin.
+func (rt *Route) label() string {
+	if rt.Name != "" {
+		return rt.Name
+	}
+	if rt.Host != "" || rt.PathPrefix != "" {
+		return rt.Host + rt.PathPrefix
+	}
+	return "default"
+}
+
+// routing is the part of the configuration that can be reloaded at runtime.
+type routing struct {
+	routes []*Route
+	ttl    time.Duration
+}
+
+// Reload atomically replaces the routes and the default TTL, 0 keeps the
+// cache TTL. Requests in flight finish with the routes they started with.
+func (p *Proxy) Reload(routes []*Route, ttl time.Duration) {
+	p.routing.Store(&routing{routes: routes, ttl: ttl})
+}
+
+// currentRouting returns the routes and default TTL in effect, the ones set
+// by Reload or else the initial Routes.
+func (p *Proxy) currentRouting() *routing {
+	if rt := p.routing.Load(); rt != nil {
+		return rt
+	}
+	return &routing{routes: p.Routes}
+}
+
+// route returns the first route matching r, in configuration order. Requests
+// matching no route go to the default Origin.
+func (p *Proxy) route(r *http.Request) *Route {
+	for _, rt := range p.currentRouting().routes {
+		if rt.matches(r) {
+			return rt
+		}
+	}
+	return &Route{Origin: p.Origin}
+}
+
+// OriginsReady reports whether at least one origin, of the routes or the
+// default Origin, may currently receive requests.
+func (p *Proxy) OriginsReady() bool {
+	for _, rt := range p.currentRouting().routes {
+		if p.originReady(rt) {
+			return true
+		}
+	}
+	return p.originReady(&Route{Origin: p.Origin})
+}
+
+// originReady reports whether an origin of rt may currently receive requests.
+func (p *Proxy) originReady(rt *Route) bool {
+	if rt.Pool != nil {
+		return rt.Pool.Healthy()
+	}
+	if rt.Origin == "" {
+		return false
+	}
+	origin, err := upstream.ParseOrigin(rt.Origin)
+	return err == nil && p.Breakers.Get(origin.String()).Ready()
+}
+
+// ttl returns how long responses of rt are cached.
+func (p *Proxy) ttl(rt *Route) time.Duration {
+	if rt.TTL > 0 {
+		return rt.TTL
+	}
+	if ttl := p.currentRouting().ttl; ttl > 0 {
+		return ttl
+	}
+	return p.Cache.TTL()
+}
+
+// matchHost reports whether host matches pattern, which may start with "*."
+// to match any subdomain.
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == pattern
+}
+
+// requestHost returns the lower-cased host r was sent to, without port.
+func requestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"caching-proxy/internal/upstream"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		host     string
+		expected bool
+	}{
+		{pattern: "example.com", host: "example.com", expected: true},
+		{pattern: "Example.com", host: "example.com", expected: true},
+		{pattern: "example.com", host: "api.example.com", expected: false},
+		{pattern: "*.example.com", host: "api.example.com", expected: true},
+		{pattern: "*.example.com", host: "example.com", expected: false},
+		{pattern: "*.example.com", host: "badexample.com", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.host, func(t *testing.T) {
+			if got := matchHost(tt.pattern, tt.host); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestProxyRoute(t *testing.T) {
+	proxy := &Proxy{
+		Origin: "http://default",
+		Routes: []*Route{
+			{Host: "api.example.com", PathPrefix: "/v1", Origin: "http://api-v1"},
+			{Host: "api.example.com", Origin: "http://api"},
+			{Host: "*.cdn.example.com", Origin: "http://static"},
+			{PathPrefix: "/docs", Origin: "http://docs"},
+		},
+	}
+
+	tests := []struct {
+		url            string
+		expectedOrigin string
+	}{
+		{url: "http://api.example.com/v1/users", expectedOrigin: "http://api-v1"},
+		{url: "http://api.example.com:8080/v2/users", expectedOrigin: "http://api"},
+		{url: "http://img.cdn.example.com/logo.png", expectedOrigin: "http://static"},
+		{url: "http://www.example.com/docs/intro", expectedOrigin: "http://docs"},
+		{url: "http://www.example.com/", expectedOrigin: "http://default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			rt := proxy.route(httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rt.Origin != tt.expectedOrigin {
+				t.Errorf("expected origin %q, got %q", tt.expectedOrigin, rt.Origin)
+			}
+		})
+	}
+}
+
+func TestProxyHandler_Routes(t *testing.T) {
+	newOrigin := func(name string, requestHeader *http.Header) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*requestHeader = r.Header.Clone()
+			w.Header().Set("Server", name)
+			w.Header().Set("Set-Cookie", "session=1")
+			if _, err := w.Write([]byte("Hello from " + name)); err != nil {
+				t.Fatalf("failed to write response: %v", err)
+			}
+		}))
+	}
+	var apiHeader, staticHeader http.Header
+	apiServer := newOrigin("api", &apiHeader)
+	defer apiServer.Close()
+	staticServer := newOrigin("static", &staticHeader)
+	defer staticServer.Close()
+
+	mockCache := &MockCache{items: make(map[string]*cache.Item)}
+	proxy := &Proxy{
+		HttpClient: http.DefaultClient,
+		Cache:      mockCache,
+		Routes: []*Route{
+			{
+				PathPrefix: "/api",
+				Origin:     apiServer.URL,
+				Bypass:     true,
+				RequestHeaders: HeaderRules{
+					Set:    map[string]string{"X-Route": "api"},
+					Remove: []string{"Cookie"},
+				},
+			},
+			{
+				PathPrefix: "/static",
+				Origin:     staticServer.URL,
+				TTL:        time.Hour,
+				ResponseHeaders: HeaderRules{
+					Set:    map[string]string{"Cache-Control": "public, max-age=3600"},
+					Remove: []string{"Set-Cookie"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		path          string
+		expectedBody  string
+		expectedCache string
+	}{
+		{path: "/api/users", expectedBody: "Hello from api", expectedCache: "miss"},
+		{path: "/api/users", expectedBody: "Hello from api", expectedCache: "miss"},
+		{path: "/static/app.js", expectedBody: "Hello from static", expectedCache: "miss"},
+		{path: "/static/app.js", expectedBody: "Hello from static", expectedCache: "hit"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Header.Set("Cookie", "session=1")
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, req)
+
+		resp := w.Result()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != tt.expectedBody {
+			t.Errorf("%s: expected body %q, got %q", tt.path, tt.expectedBody, string(body))
+		}
+		if resp.Header.Get("X-Cache") != tt.expectedCache {
+			t.Errorf("%s: expected X-Cache %q, got %q", tt.path, tt.expectedCache, resp.Header.Get("X-Cache"))
+		}
+	}
+
+	if apiHeader.Get("X-Route") != "api" || apiHeader.Get("Cookie") != "" {
+		t.Errorf("expected api request header rules to be applied, got %v", apiHeader)
+	}
+	if _, ok := mockCache.items[http.MethodGet+"example.com/api/users"]; ok {
+		t.Errorf("expected bypass route not to be cached")
+	}
+
+	item, ok := mockCache.items[http.MethodGet+"example.com/static/app.js"]
+	if !ok {
+		t.Fatalf("expected static route to be cached")
+	}
+	if ttl := time.Until(item.Expiration); ttl < 59*time.Minute {
+		t.Errorf("expected the route TTL to be used, got %v", ttl)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/static/app.js", nil)
+	w := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(w, req)
+	resp := w.Result()
+	if resp.Header.Get("Set-Cookie") != "" {
+		t.Errorf("expected Set-Cookie to be removed, got %q", resp.Header.Get("Set-Cookie"))
+	}
+	if resp.Header.Get("Cache-Control") != "public, max-age=3600" {
+		t.Errorf("expected Cache-Control to be set, got %q", resp.Header.Get("Cache-Control"))
+	}
+}
+
+func TestProxyHandler_RoutePool(t *testing.T) {
+	var badRequests, goodRequests int
+	badServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badRequests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer badServer.Close()
+	goodServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		goodRequests++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer goodServer.Close()
+
+	pool, err := upstream.NewPool(upstream.Config{
+		Origins:          []string{badServer.URL, goodServer.URL},
+		OutlierDetection: upstream.OutlierDetection{ConsecutiveFailures: 1, EjectionTime: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{
+		HttpClient: http.DefaultClient,
+		Cache:      &MockCache{items: make(map[string]*cache.Item)},
+		Routes:     []*Route{{Pool: pool, Bypass: true}},
+	}
+
+	for i := 0; i < 6; i++ {
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+	}
+	if badRequests != 1 {
+		t.Errorf("expected the failing origin to be ejected after one request, got %d requests", badRequests)
+	}
+	if goodRequests != 5 {
+		t.Errorf("expected the healthy origin to serve the remaining requests, got %d", goodRequests)
+	}
+
+	single, err := upstream.NewPool(upstream.Config{
+		Origins:          []string{badServer.URL},
+		OutlierDetection: upstream.OutlierDetection{ConsecutiveFailures: 1, EjectionTime: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Routes = []*Route{{Pool: single, Bypass: true}}
+
+	// once every origin is ejected the proxy fails fast
+	expected := []int{http.StatusInternalServerError, http.StatusServiceUnavailable}
+	for _, status := range expected {
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+		if w.Code != status {
+			t.Errorf("expected status %d, got %d", status, w.Code)
+		}
+	}
+}
+
+func TestProxy_OriginsReady(t *testing.T) {
+	breakers := upstream.NewBreakers(upstream.BreakerConfig{MinRequests: 1, ErrorRate: 0.5, OpenTime: time.Minute})
+	p := &Proxy{Breakers: breakers}
+	if p.OriginsReady() {
+		t.Errorf("expected no ready origin without origins")
+	}
+
+	p.Origin = "http://origin.example.com"
+	if !p.OriginsReady() {
+		t.Errorf("expected the default origin to be ready")
+	}
+
+	breaker := breakers.Get("http://origin.example.com")
+	breaker.Allow()
+	breaker.Record(true, 0)
+	if p.OriginsReady() {
+		t.Errorf("expected no ready origin once its circuit breaker is open")
+	}
+
+	pool, err := upstream.NewPool(upstream.Config{Origins: []string{"http://pool.example.com"}, Breakers: breakers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Reload([]*Route{{PathPrefix: "/api/", Pool: pool}}, 0)
+	if !p.OriginsReady() {
+		t.Errorf("expected the pool origin to be ready")
+	}
+}
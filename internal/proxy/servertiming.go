@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"caching-proxy/internal/servertiming"
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"time"
+)
+
+// debugTokenHeader carries a token enabling the Server-Timing header for a
+// single request, see Proxy.DebugTokens.
+const debugTokenHeader = "X-Debug-Token"
+
+// serverTiming reports whether the response to r gets a Server-Timing header.
+func (p *Proxy) serverTiming(r *http.Request) bool {
+	if p.ServerTiming {
+		return true
+	}
+	token := r.Header.Get(debugTokenHeader)
+	if token == "" {
+		return false
+	}
+	for _, t := range p.DebugTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheGet is p.Cache.Get, timed as the cache phase of the request.
+func (p *Proxy) cacheGet(ctx context.Context, key string) (*cache.Item, bool) {
+	defer servertiming.Since(ctx, "cache", time.Now())
+	return p.Cache.Get(ctx, key)
+}
+
+// cacheGetStale is p.Cache.GetStale, timed as the cache phase of the request.
+func (p *Proxy) cacheGetStale(ctx context.Context, key string) (*cache.Item, bool) {
+	defer servertiming.Since(ctx, "cache", time.Now())
+	return p.Cache.GetStale(ctx, key)
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestProxyHandler_ServerTiming(t *testing.T) {
+	var originToken string
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originToken = r.Header.Get("X-Debug-Token")
+		w.Write([]byte("Hello from origin"))
+	}))
+	defer originServer.Close()
+
+	miss := regexp.MustCompile(`^cache;dur=[0-9.]+, origin;dur=[0-9.]+, total;dur=[0-9.]+$`)
+	hit := regexp.MustCompile(`^cache;dur=[0-9.]+, total;dur=[0-9.]+$`)
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		token    string
+		expected *regexp.Regexp
+	}{
+		{"disabled", false, "", nil},
+		{"enabled", true, "", miss},
+		{"debug token", false, "secret", miss},
+		{"wrong debug token", false, "guess", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := &Proxy{
+				Origin:       originServer.URL,
+				HttpClient:   originServer.Client(),
+				Cache:        &MockCache{items: make(map[string]*cache.Item)},
+				ServerTiming: tt.enabled,
+				DebugTokens:  []string{"secret"},
+			}
+			for _, expected := range []*regexp.Regexp{tt.expected, hit} {
+				req := httptest.NewRequest(http.MethodGet, "/timed", nil)
+				if tt.token != "" {
+					req.Header.Set("X-Debug-Token", tt.token)
+				}
+				rr := httptest.NewRecorder()
+				proxy.Handler()(rr, req)
+
+				got := rr.Result().Header.Get("Server-Timing")
+				if tt.expected == nil {
+					if got != "" {
+						t.Errorf("expected no Server-Timing, got %q", got)
+					}
+					continue
+				}
+				if !expected.MatchString(got) {
+					t.Errorf("expected Server-Timing matching %q, got %q", expected, got)
+				}
+			}
+			if originToken != "" {
+				t.Errorf("expected the debug token not to reach the origin, got %q", originToken)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// captureBuffer keeps a copy of a streamed body for the cache. Once the body
+// grows past limit the copy is dropped and further writes are discarded.
+type captureBuffer struct {
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+// newCaptureBuffer returns a captureBuffer for a body of contentLength bytes
+// (-1 if unknown). A limit of 0 means no limit.
+func newCaptureBuffer(limit, contentLength int64) *captureBuffer {
+	c := &captureBuffer{limit: limit}
+	if limit > 0 && contentLength > limit {
+		// the origin announced a body that can never be cached, do not buffer it at all
+		c.overflow = true
+	} else if contentLength > 0 {
+		c.buf.Grow(int(contentLength))
+	}
+	return c
+}
+
+func (c *captureBuffer) Write(b []byte) (int, error) {
+	if c.overflow {
+		return len(b), nil
+	}
+	if c.limit > 0 && int64(c.buf.Len()+len(b)) > c.limit {
+		c.overflow = true
+		c.buf = bytes.Buffer{}
+		return len(b), nil
+	}
+	return c.buf.Write(b)
+}
+
+// Bytes returns the captured body.
+func (c *captureBuffer) Bytes() []byte {
+	return c.buf.Bytes()
+}
+
+// flushWriter flushes the response after every write so the client receives
+// the body as it arrives from the origin.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, nil
+}
+
+// stream copies src into dst, telling apart failures reading from src and
+// failures writing into dst.
+func stream(dst io.Writer, src io.Reader) (readErr, writeErr error) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return nil, werr
+			}
+		}
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return err, nil
+		}
+	}
+}
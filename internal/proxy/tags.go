@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// tagHeaders are the response fields origins send cache tags in. They are
+// meant for the cache only and are never forwarded to clients.
+var tagHeaders = []string{"Surrogate-Key", "Cache-Tag"}
+
+// chunksTag is the tag of the chunks of the object stored under key, fetched
+// for range requests, so purging the object removes them without a scan.
+func chunksTag(key string) string {
+	return "#chunks " + key
+}
+
+// responseTags returns the cache tags of a response: the space-separated
+// Surrogate-Key values and the comma-separated Cache-Tag values.
+func responseTags(h http.Header) []string {
+	var tags []string
+	seen := map[string]bool{}
+	add := func(tag string) {
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	for _, v := range h.Values("Surrogate-Key") {
+		for _, tag := range strings.Fields(v) {
+			add(tag)
+		}
+	}
+	for _, v := range h.Values("Cache-Tag") {
+		for _, tag := range strings.Split(v, ",") {
+			add(strings.TrimSpace(tag))
+		}
+	}
+	return tags
+}
+
+// removeTagHeaders deletes the cache tag fields from h.
+func removeTagHeaders(h http.Header) {
+	for _, f := range tagHeaders {
+		h.Del(f)
+	}
+}
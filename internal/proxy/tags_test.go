@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestResponseTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected []string
+	}{
+		{name: "none", header: http.Header{}, expected: nil},
+		{name: "surrogate key", header: http.Header{"Surrogate-Key": []string{"product-1  category-2"}}, expected: []string{"product-1", "category-2"}},
+		{name: "cache tag", header: http.Header{"Cache-Tag": []string{"product-1, category-2,"}}, expected: []string{"product-1", "category-2"}},
+		{
+			name:     "both without duplicates",
+			header:   http.Header{"Surrogate-Key": []string{"product-1"}, "Cache-Tag": []string{"product-1,home"}},
+			expected: []string{"product-1", "home"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := responseTags(tt.header); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestProxyHandler_Tags(t *testing.T) {
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Surrogate-Key", "product-1 home")
+		w.Header().Set("Cache-Tag", "category-2")
+		w.Write([]byte("Hello from origin"))
+	}))
+	defer originServer.Close()
+
+	mockCache := &MockCache{items: make(map[string]*cache.Item)}
+	proxy := &Proxy{
+		Origin:     originServer.URL,
+		HttpClient: originServer.Client(),
+		Cache:      mockCache,
+	}
+
+	for _, expectedCache := range []string{"miss", "hit"} {
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/products/1", nil))
+
+		if got := w.Header().Get("X-Cache"); got != expectedCache {
+			t.Errorf("expected X-Cache %q, got %q", expectedCache, got)
+		}
+		for _, f := range []string{"Surrogate-Key", "Cache-Tag"} {
+			if got := w.Header().Get(f); got != "" {
+				t.Errorf("expected %s to be stripped, got %q", f, got)
+			}
+		}
+	}
+
+	item, ok := mockCache.items["GETexample.com/products/1"]
+	if !ok {
+		t.Fatal("expected the response to be cached")
+	}
+	if expected := []string{"product-1", "home", "category-2"}; !reflect.DeepEqual(item.Tags, expected) {
+		t.Errorf("expected tags %q, got %q", expected, item.Tags)
+	}
+}
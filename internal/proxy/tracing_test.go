@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"caching-proxy/internal/cache"
+	"caching-proxy/internal/tracing"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// collectedSpan is the part of an OTLP/HTTP JSON span the tests look at.
+type collectedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+}
+
+// newCollector returns a stand-in for an OpenTelemetry collector and the
+// spans it received.
+func newCollector(t *testing.T) (*httptest.Server, func() []collectedSpan) {
+	var (
+		mu    sync.Mutex
+		spans []collectedSpan
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []collectedSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(collector.Close)
+	return collector, func() []collectedSpan {
+		mu.Lock()
+		defer mu.Unlock()
+		return spans
+	}
+}
+
+func TestProxyHandler_Tracing(t *testing.T) {
+	var originTraceparent string
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originTraceparent = r.Header.Get("Traceparent")
+		w.Write([]byte("Hello from origin"))
+	}))
+	defer originServer.Close()
+
+	collector, collected := newCollector(t)
+	exporter := tracing.NewOTLPExporter(collector.URL, "caching-proxy")
+	tracing.SetDefault(tracing.NewTracer(exporter, 1))
+	t.Cleanup(func() { tracing.SetDefault(nil) })
+
+	proxy := &Proxy{
+		Origin:     originServer.URL,
+		HttpClient: originServer.Client(),
+		Cache:      &MockCache{items: make(map[string]*cache.Item)},
+	}
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest(http.MethodGet, "/traced", nil)
+	req.Header.Set("Traceparent", "00-"+traceID+"-"+parentID+"-01")
+	proxy.Handler()(httptest.NewRecorder(), req)
+
+	if err := exporter.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := map[string]collectedSpan{}
+	for _, s := range collected() {
+		if s.TraceID != traceID {
+			t.Errorf("expected span %q in trace %q, got %q", s.Name, traceID, s.TraceID)
+		}
+		spans[s.Name] = s
+	}
+	server, origin, write := spans["GET"], spans["origin GET"], spans["response write"]
+	if server.ParentSpanID != parentID {
+		t.Errorf("expected the request span to be a child of %q, got %q", parentID, server.ParentSpanID)
+	}
+	for _, child := range []collectedSpan{origin, write} {
+		if child.SpanID == "" || child.ParentSpanID != server.SpanID {
+			t.Errorf("expected the %q span to be a child of the request span, got %+v", child.Name, child)
+		}
+	}
+	if expected := "00-" + traceID + "-" + origin.SpanID + "-01"; originTraceparent != expected {
+		t.Errorf("expected the origin to receive traceparent %q, got %q", expected, originTraceparent)
+	}
+}
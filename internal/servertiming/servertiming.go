@@ -0,0 +1,74 @@
+// Package servertiming measures the phases of a request for the
+// Server-Timing response header.
+package servertiming
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timings accumulates the time spent in each phase of a request.
+type Timings struct {
+	mu     sync.Mutex
+	phases []phase
+}
+
+type phase struct {
+	name string
+	dur  time.Duration
+}
+
+type timingsKey struct{}
+
+// NewContext returns ctx carrying t, which Add then adds to.
+func NewContext(ctx context.Context, t *Timings) context.Context {
+	return context.WithValue(ctx, timingsKey{}, t)
+}
+
+// Add adds d to the phase name of the timings of ctx, if any.
+func Add(ctx context.Context, name string, d time.Duration) {
+	if t, ok := ctx.Value(timingsKey{}).(*Timings); ok {
+		t.Add(name, d)
+	}
+}
+
+// Since is Add with the time elapsed since start.
+func Since(ctx context.Context, name string, start time.Time) {
+	Add(ctx, name, time.Since(start))
+}
+
+// Add adds d to the phase name.
+func (t *Timings) Add(name string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.phases {
+		if t.phases[i].name == name {
+			t.phases[i].dur += d
+			return
+		}
+	}
+	t.phases = append(t.phases, phase{name: name, dur: d})
+}
+
+// Header formats the phases, in the order they were first added, followed
+// by total as a Server-Timing field value. Durations are in milliseconds.
+func (t *Timings) Header(total time.Duration) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var b strings.Builder
+	for _, p := range t.phases {
+		writeMetric(&b, p.name, p.dur)
+		b.WriteString(", ")
+	}
+	writeMetric(&b, "total", total)
+	return b.String()
+}
+
+func writeMetric(b *strings.Builder, name string, d time.Duration) {
+	b.WriteString(name)
+	b.WriteString(";dur=")
+	b.WriteString(strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', -1, 64))
+}
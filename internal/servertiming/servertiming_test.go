@@ -0,0 +1,26 @@
+package servertiming
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTimings(t *testing.T) {
+	Add(context.Background(), "cache", time.Millisecond)
+
+	timings := &Timings{}
+	ctx := NewContext(context.Background(), timings)
+	Add(ctx, "cache", 1500*time.Microsecond)
+	Add(ctx, "redis", time.Millisecond)
+	Add(ctx, "origin", 120*time.Millisecond)
+	Add(ctx, "cache", 250*time.Microsecond)
+
+	expected := "cache;dur=1.75, redis;dur=1, origin;dur=120, total;dur=123.456"
+	if got := timings.Header(123456 * time.Microsecond); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if got := (&Timings{}).Header(time.Millisecond); got != "total;dur=1" {
+		t.Errorf("expected %q, got %q", "total;dur=1", got)
+	}
+}
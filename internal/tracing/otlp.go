@@ -0,0 +1,234 @@
+package tracing
+
+import (
+	"bytes"
+	"caching-proxy/internal/metrics"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBatch is the number of spans that triggers an export.
+	maxBatch = 512
+	// maxQueue is the number of spans kept while the collector is slow or
+	// unavailable, the newer spans are dropped.
+	maxQueue = 4096
+	// flushInterval is the longest a span waits before it is exported.
+	flushInterval = 5 * time.Second
+	// exportTimeout bounds a single export.
+	exportTimeout = 10 * time.Second
+)
+
+var droppedSpans = metrics.Default.NewCounter("caching_proxy_trace_spans_dropped_total",
+	"Spans dropped because the export queue was full.")
+
+// OTLPExporter sends spans in batches to an OpenTelemetry collector with
+// the OTLP/HTTP JSON encoding.
+type OTLPExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+
+	mu    sync.Mutex
+	spans []*Span
+
+	flush chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewOTLPExporter returns an exporter posting spans to endpoint, e.g.
+// "http://localhost:4318/v1/traces", as the service named service.
+// Shutdown stops it.
+func NewOTLPExporter(endpoint, service string) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: exportTimeout},
+		flush:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Export queues s for the next batch.
+func (e *OTLPExporter) Export(s *Span) {
+	e.mu.Lock()
+	if len(e.spans) >= maxQueue {
+		e.mu.Unlock()
+		droppedSpans.With().Inc()
+		return
+	}
+	e.spans = append(e.spans, s)
+	full := len(e.spans) >= maxBatch
+	e.mu.Unlock()
+	if full {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		case <-e.flush:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		if err := e.Flush(ctx); err != nil {
+			slog.Warn("tracing: exporting spans", "endpoint", e.endpoint, "error", err)
+		}
+		cancel()
+	}
+}
+
+// Flush exports the queued spans. They are dropped when the collector
+// cannot be reached.
+func (e *OTLPExporter) Flush(ctx context.Context) error {
+	for {
+		e.mu.Lock()
+		n := min(len(e.spans), maxBatch)
+		batch := e.spans[:n:n]
+		e.spans = e.spans[n:]
+		e.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		if err := e.send(ctx, batch); err != nil {
+			return err
+		}
+	}
+}
+
+// Shutdown stops the periodic exports and exports the queued spans.
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	close(e.stop)
+	<-e.done
+	return e.Flush(ctx)
+}
+
+func (e *OTLPExporter) send(ctx context.Context, batch []*Span) error {
+	body, err := json.Marshal(e.request(batch))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of an export request, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+type (
+	exportRequest struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}
+	resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	resource struct {
+		Attributes []keyValue `json:"attributes"`
+	}
+	scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	scope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              Kind       `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []keyValue `json:"attributes,omitempty"`
+		Status            status     `json:"status"`
+	}
+	status struct {
+		// Code is 0 for unset and 2 for error.
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	keyValue struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	anyValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+// int64Value formats v as an OTLP JSON intValue, a decimal string.
+func int64Value(v int64) *string {
+	s := strconv.FormatInt(v, 10)
+	return &s
+}
+
+func (e *OTLPExporter) request(batch []*Span) exportRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           s.sc.TraceID.String(),
+			SpanID:            s.sc.SpanID.String(),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        s.attrs,
+		}
+		if s.parent.IsValid() {
+			span.ParentSpanID = s.parent.String()
+		}
+		if s.err != "" {
+			span.Status = status{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+		spans = append(spans, span)
+	}
+	service := e.service
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource: resource{Attributes: []keyValue{
+			{Key: "service.name", Value: anyValue{StringValue: &service}},
+		}},
+		ScopeSpans: []scopeSpans{{
+			Scope: scope{Name: "caching-proxy"},
+			Spans: spans,
+		}},
+	}}}
+}
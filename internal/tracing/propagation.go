@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// ParseTraceparent parses a W3C traceparent field value.
+func ParseTraceparent(v string) (SpanContext, bool) {
+	// version-traceid-parentid-flags, later versions may append fields
+	v = strings.TrimSpace(v)
+	if len(v) < 55 || v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return SpanContext{}, false
+	}
+	version := v[:2]
+	if version == "ff" || !isLowerHex(version) || (version == "00" && len(v) != 55) || (len(v) > 55 && v[55] != '-') {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	if !decodeHex(sc.TraceID[:], v[3:35]) || !decodeHex(sc.SpanID[:], v[36:52]) || !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], v[53:55]) {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// Traceparent formats sc as a version 00 traceparent field value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// Extract returns ctx carrying the remote parent of the traceparent field
+// of h, if it is valid.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	if sc, ok := ParseTraceparent(h.Get("Traceparent")); ok {
+		return ContextWithRemoteParent(ctx, sc)
+	}
+	return ctx
+}
+
+// Inject sets the traceparent field of h to the span of ctx. Without a span,
+// h is left as is.
+func Inject(ctx context.Context, h http.Header) {
+	if s := SpanFromContext(ctx); s != nil {
+		h.Set("Traceparent", s.sc.Traceparent())
+	}
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if !isLowerHex(s) {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
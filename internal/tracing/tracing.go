@@ -0,0 +1,196 @@
+// Package tracing records spans of the work done for a request, propagates
+// them to the origins with the W3C traceparent header and exports them over
+// OTLP/HTTP.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether id is not all zeros.
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether id is not all zeros.
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// SpanContext is the part of a span propagated to other services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Sampled is set when the span is exported.
+	Sampled bool
+}
+
+// IsValid reports whether sc identifies a span.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Kind is the role of a span, with the OTLP values.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Exporter sends ended spans to a tracing backend.
+type Exporter interface {
+	Export(s *Span)
+}
+
+// Tracer creates the spans, see SetDefault.
+type Tracer struct {
+	exporter Exporter
+	// sampleRatio is the share of new traces sampled, from 0 to 1
+	sampleRatio float64
+}
+
+// NewTracer returns a tracer exporting a sampleRatio share of the traces it
+// starts to e. Traces continued from a remote parent keep its sampling decision.
+func NewTracer(e Exporter, sampleRatio float64) *Tracer {
+	return &Tracer{exporter: e, sampleRatio: sampleRatio}
+}
+
+var defaultTracer atomic.Pointer[Tracer]
+
+// SetDefault makes Start create spans with t, nil disables tracing.
+func SetDefault(t *Tracer) {
+	defaultTracer.Store(t)
+}
+
+// Span is a timed operation of a trace. A nil *Span, returned while tracing
+// is disabled, ignores every call.
+type Span struct {
+	tracer *Tracer
+	name   string
+	kind   Kind
+	sc     SpanContext
+	parent SpanID
+	start  time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []keyValue
+	err   string
+	ended bool
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// SpanFromContext returns the span of ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithRemoteParent returns ctx carrying sc as the parent of the spans
+// started from it.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Start starts a span named name, child of the span of ctx if any, and
+// returns ctx carrying it. The span must be ended with End.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	t := defaultTracer.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	var parent SpanContext
+	if p := SpanFromContext(ctx); p != nil {
+		parent = p.sc
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = remote
+	}
+	if parent.IsValid() {
+		s.sc.TraceID, s.sc.Sampled, s.parent = parent.TraceID, parent.Sampled, parent.SpanID
+	} else {
+		rand.Read(s.sc.TraceID[:])
+		s.sc.Sampled = t.sampleRatio >= 1 || mathrand.Float64() < t.sampleRatio
+	}
+	rand.Read(s.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Context returns the span context of s, the zero value for a nil span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttr records an attribute of the span. value is a string, a bool, an
+// integer or a float64, other types are formatted with fmt.
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	kv := keyValue{Key: key}
+	switch v := value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	case int:
+		kv.Value.IntValue = int64Value(int64(v))
+	case int64:
+		kv.Value.IntValue = int64Value(v)
+	case float64:
+		kv.Value.DoubleValue = &v
+	default:
+		str := fmt.Sprint(v)
+		kv.Value.StringValue = &str
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, kv)
+}
+
+// SetError marks the span failed with err, a nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End ends the span and exports it if it is sampled. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.end = true, time.Now()
+	s.mu.Unlock()
+	if s.sc.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.Export(s)
+	}
+}
@@ -0,0 +1,183 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"future version with more fields", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"version 00 with more fields", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"upper case", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"too short", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false, false},
+		{"empty", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.value)
+			if ok != tt.ok {
+				t.Fatalf("expected ok %v, got %v", tt.ok, ok)
+			}
+			if !ok {
+				return
+			}
+			if sc.Sampled != tt.sampled {
+				t.Errorf("expected sampled %v, got %v", tt.sampled, sc.Sampled)
+			}
+			if got := sc.TraceID.String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+				t.Errorf("expected trace id %q, got %q", "4bf92f3577b34da6a3ce929d0e0e4736", got)
+			}
+		})
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	const value = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, _ := ParseTraceparent(value)
+	if got := sc.Traceparent(); got != value {
+		t.Errorf("expected %q, got %q", value, got)
+	}
+}
+
+type recorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *recorder) Export(s *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func TestStart(t *testing.T) {
+	ctx, span := Start(context.Background(), "disabled", KindInternal)
+	if span != nil || SpanFromContext(ctx) != nil {
+		t.Fatal("expected no span while tracing is disabled")
+	}
+	span.SetAttr("key", "value")
+	span.End()
+
+	rec := &recorder{}
+	SetDefault(NewTracer(rec, 1))
+	t.Cleanup(func() { SetDefault(nil) })
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, parent := Start(ContextWithRemoteParent(context.Background(), remote), "parent", KindServer)
+	_, child := Start(ctx, "child", KindInternal)
+	child.End()
+	parent.End()
+	parent.End()
+
+	if parent.sc.TraceID != remote.TraceID || parent.parent != remote.SpanID {
+		t.Errorf("expected the parent span to continue the remote trace, got %v", parent.sc)
+	}
+	if child.sc.TraceID != parent.sc.TraceID || child.parent != parent.sc.SpanID {
+		t.Errorf("expected the child span to be a child of the parent span")
+	}
+	if len(rec.spans) != 2 || rec.spans[0] != child || rec.spans[1] != parent {
+		t.Errorf("expected the child and the parent span exported once, got %d spans", len(rec.spans))
+	}
+
+	remote.Sampled = false
+	_, unsampled := Start(ContextWithRemoteParent(context.Background(), remote), "unsampled", KindServer)
+	unsampled.End()
+	if len(rec.spans) != 2 {
+		t.Errorf("expected the span of an unsampled trace not to be exported")
+	}
+}
+
+func TestInject(t *testing.T) {
+	SetDefault(NewTracer(nil, 1))
+	t.Cleanup(func() { SetDefault(nil) })
+
+	h := http.Header{}
+	h.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, span := Start(Extract(context.Background(), h), "request", KindServer)
+	out := http.Header{}
+	Inject(ctx, out)
+	expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + span.sc.SpanID.String() + "-01"
+	if got := out.Get("Traceparent"); got != expected {
+		t.Errorf("expected traceparent %q, got %q", expected, got)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received exportRequest
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		var req exportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received.ResourceSpans = append(received.ResourceSpans, req.ResourceSpans...)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL+"/v1/traces", "test-service")
+	SetDefault(NewTracer(exporter, 1))
+	t.Cleanup(func() { SetDefault(nil) })
+
+	ctx, parent := Start(context.Background(), "GET", KindServer)
+	parent.SetAttr("http.response.status_code", 200)
+	_, child := Start(ctx, "redis get", KindClient)
+	child.SetError(errors.New("connection refused"))
+	child.End()
+	parent.End()
+
+	if err := exporter.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received.ResourceSpans) != 1 {
+		t.Fatalf("expected 1 export request, got %d", len(received.ResourceSpans))
+	}
+	rs := received.ResourceSpans[0]
+	if got := *rs.Resource.Attributes[0].Value.StringValue; got != "test-service" {
+		t.Errorf("expected service name %q, got %q", "test-service", got)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	gotChild, gotParent := spans[0], spans[1]
+	if gotChild.Name != "redis get" || gotChild.Kind != KindClient || gotChild.Status.Code != 2 || gotChild.Status.Message != "connection refused" {
+		t.Errorf("unexpected child span %+v", gotChild)
+	}
+	if gotChild.ParentSpanID != gotParent.SpanID || gotChild.TraceID != gotParent.TraceID {
+		t.Errorf("expected the child span to be a child of the parent span")
+	}
+	if gotParent.ParentSpanID != "" {
+		t.Errorf("expected a root span, got parent %q", gotParent.ParentSpanID)
+	}
+	if attr := gotParent.Attributes[0]; attr.Key != "http.response.status_code" || attr.Value.IntValue == nil || *attr.Value.IntValue != "200" {
+		t.Errorf("unexpected attribute %+v", attr)
+	}
+}
@@ -0,0 +1,315 @@
+package upstream
+
+import (
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when a request is rejected by an open circuit breaker.
+var ErrCircuitOpen = errors.New("upstream: circuit breaker open")
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every request through and watches the outcomes.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects every request until the open time has passed.
+	BreakerOpen
+	// BreakerHalfOpen lets a few probe requests through to decide whether to close again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerConfig configures the circuit breakers of the origins. A zero
+// ErrorRate and SlowCallRate disable them.
+type BreakerConfig struct {
+	// Window is the number of most recent requests the rates are computed over.
+	Window int
+	// MinRequests is the number of requests in the window before the breaker may open.
+	MinRequests int
+	// ErrorRate is the share of failed requests, from 0 to 1, that opens the breaker.
+	ErrorRate float64
+	// SlowCall is the latency above which a request counts as slow.
+	SlowCall time.Duration
+	// SlowCallRate is the share of slow requests, from 0 to 1, that opens the breaker.
+	SlowCallRate float64
+	// OpenTime is how long the breaker rejects requests before probing the origin.
+	OpenTime time.Duration
+	// HalfOpenRequests is the number of successful probes that close the breaker.
+	HalfOpenRequests int
+}
+
+// enabled reports whether the configuration can ever open a breaker.
+func (cfg BreakerConfig) enabled() bool {
+	return cfg.ErrorRate > 0 || (cfg.SlowCallRate > 0 && cfg.SlowCall > 0)
+}
+
+// BreakerStatus is a snapshot of the state of a breaker.
+type BreakerStatus struct {
+	Origin    string    `json:"origin"`
+	State     string    `json:"state"`
+	Requests  int       `json:"requests"`
+	Failures  int       `json:"failures"`
+	Slow      int       `json:"slow"`
+	OpenUntil time.Time `json:"open_until,omitempty"`
+}
+
+type outcome struct {
+	failed bool
+	slow   bool
+}
+
+// Breaker stops sending requests to an origin that is failing or too slow.
+// The methods of a nil Breaker let every request through.
+type Breaker struct {
+	origin string
+	cfg    BreakerConfig
+
+	mu        sync.Mutex
+	state     BreakerState
+	outcomes  []outcome
+	next      int
+	openUntil time.Time
+	probes    int
+	successes int
+}
+
+// NewBreaker returns a closed breaker for origin.
+func NewBreaker(origin string, cfg BreakerConfig) *Breaker {
+	if cfg.Window <= 0 {
+		cfg.Window = 20
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 1
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	return &Breaker{
+		origin:   origin,
+		cfg:      cfg,
+		outcomes: make([]outcome, 0, cfg.Window),
+	}
+}
+
+// Allow reports whether a request may be sent, returning ErrCircuitOpen if
+// not. Every allowed request must be followed by Record or Discard.
+func (b *Breaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && !time.Now().Before(b.openUntil) {
+		b.setState(BreakerHalfOpen)
+	}
+	switch b.state {
+	case BreakerOpen:
+		return ErrCircuitOpen
+	case BreakerHalfOpen:
+		if b.probes >= b.cfg.HalfOpenRequests {
+			return ErrCircuitOpen
+		}
+		b.probes++
+	}
+	return nil
+}
+
+// Ready reports whether Allow would currently let a request through, without
+// admitting one.
+func (b *Breaker) Ready() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return !time.Now().Before(b.openUntil)
+	case BreakerHalfOpen:
+		return b.probes < b.cfg.HalfOpenRequests
+	}
+	return true
+}
+
+// Record reports the outcome of an allowed request: whether it failed and
+// how long the origin took to answer.
+func (b *Breaker) Record(failed bool, latency time.Duration) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	slow := b.cfg.SlowCall > 0 && latency > b.cfg.SlowCall
+	switch b.state {
+	case BreakerHalfOpen:
+		b.probes = max(b.probes-1, 0)
+		if failed || slow {
+			b.open()
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenRequests {
+			b.setState(BreakerClosed)
+		}
+	case BreakerClosed:
+		b.add(outcome{failed: failed, slow: slow})
+		if b.tripped() {
+			b.open()
+		}
+	}
+}
+
+// Discard releases an allowed request whose outcome says nothing about the
+// origin, such as one canceled by the client.
+func (b *Breaker) Discard() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.probes = max(b.probes-1, 0)
+	}
+}
+
+// Status returns a snapshot of the breaker.
+func (b *Breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := BreakerStatus{
+		Origin:   b.origin,
+		State:    b.state.String(),
+		Requests: len(b.outcomes),
+	}
+	for _, o := range b.outcomes {
+		if o.failed {
+			s.Failures++
+		}
+		if o.slow {
+			s.Slow++
+		}
+	}
+	if b.state == BreakerOpen {
+		s.OpenUntil = b.openUntil
+	}
+	return s
+}
+
+// add records o in the window, replacing the oldest outcome once it is full.
+func (b *Breaker) add(o outcome) {
+	if len(b.outcomes) < b.cfg.Window {
+		b.outcomes = append(b.outcomes, o)
+		return
+	}
+	b.outcomes[b.next] = o
+	b.next = (b.next + 1) % b.cfg.Window
+}
+
+// tripped reports whether the outcomes in the window exceed a threshold.
+func (b *Breaker) tripped() bool {
+	if len(b.outcomes) < b.cfg.MinRequests {
+		return false
+	}
+	var failures, slow int
+	for _, o := range b.outcomes {
+		if o.failed {
+			failures++
+		}
+		if o.slow {
+			slow++
+		}
+	}
+	n := float64(len(b.outcomes))
+	if b.cfg.ErrorRate > 0 && float64(failures)/n >= b.cfg.ErrorRate {
+		return true
+	}
+	return b.cfg.SlowCallRate > 0 && b.cfg.SlowCall > 0 && float64(slow)/n >= b.cfg.SlowCallRate
+}
+
+func (b *Breaker) open() {
+	b.openUntil = time.Now().Add(b.cfg.OpenTime)
+	b.setState(BreakerOpen)
+}
+
+// setState switches to state and starts over with a fresh window.
+func (b *Breaker) setState(state BreakerState) {
+	if state == BreakerOpen {
+		slog.Warn("upstream: opening circuit breaker", "origin", b.origin, "until", b.openUntil.Format(time.RFC3339))
+	} else {
+		slog.Info("upstream: circuit breaker state changed", "origin", b.origin, "state", state.String())
+	}
+	b.state = state
+	b.outcomes = b.outcomes[:0]
+	b.next = 0
+	b.probes = 0
+	b.successes = 0
+}
+
+// Breakers holds a circuit breaker per origin, created on first use. The
+// methods of a nil Breakers return nil breakers, which never open.
+type Breakers struct {
+	cfg BreakerConfig
+
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+// NewBreakers returns the breakers for cfg, or nil when cfg disables them.
+func NewBreakers(cfg BreakerConfig) *Breakers {
+	if !cfg.enabled() {
+		return nil
+	}
+	return &Breakers{cfg: cfg, breakers: make(map[string]*Breaker)}
+}
+
+// Get returns the breaker of origin.
+func (bs *Breakers) Get(origin string) *Breaker {
+	if bs == nil {
+		return nil
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.breakers[origin]
+	if !ok {
+		b = NewBreaker(origin, bs.cfg)
+		bs.breakers[origin] = b
+	}
+	return b
+}
+
+// Status returns a snapshot of every breaker, sorted by origin.
+func (bs *Breakers) Status() []BreakerStatus {
+	if bs == nil {
+		return nil
+	}
+	bs.mu.Lock()
+	list := make([]*Breaker, 0, len(bs.breakers))
+	for _, b := range bs.breakers {
+		list = append(list, b)
+	}
+	bs.mu.Unlock()
+
+	status := make([]BreakerStatus, 0, len(list))
+	for _, b := range list {
+		status = append(status, b.Status())
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Origin < status[j].Origin })
+	return status
+}
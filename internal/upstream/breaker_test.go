@@ -0,0 +1,132 @@
+package upstream
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker_ErrorRate(t *testing.T) {
+	b := NewBreaker("http://a", BreakerConfig{Window: 4, MinRequests: 4, ErrorRate: 0.5, OpenTime: time.Hour})
+
+	for _, failed := range []bool{false, true, false} {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("expected closed breaker to allow, got %v", err)
+		}
+		b.Record(failed, 0)
+	}
+	if b.Status().State != "closed" {
+		t.Fatalf("expected breaker to stay closed below min requests, got %s", b.Status().State)
+	}
+
+	b.Allow()
+	b.Record(true, 0)
+	if b.Status().State != "open" {
+		t.Fatalf("expected breaker to open at 50%% errors, got %s", b.Status().State)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected %v, got %v", ErrCircuitOpen, err)
+	}
+	if b.Ready() {
+		t.Errorf("expected open breaker to not be ready")
+	}
+}
+
+func TestBreaker_SlowCalls(t *testing.T) {
+	b := NewBreaker("http://a", BreakerConfig{Window: 2, MinRequests: 2, SlowCall: 10 * time.Millisecond, SlowCallRate: 1, OpenTime: time.Hour})
+
+	b.Allow()
+	b.Record(false, time.Second)
+	b.Allow()
+	b.Record(false, time.Millisecond)
+	if b.Status().State != "closed" {
+		t.Fatalf("expected breaker to stay closed, got %s", b.Status().State)
+	}
+
+	// the window only keeps the 2 most recent requests
+	b.Allow()
+	b.Record(false, time.Second)
+	b.Allow()
+	b.Record(false, time.Second)
+	if b.Status().State != "open" {
+		t.Errorf("expected breaker to open on slow calls, got %s", b.Status().State)
+	}
+}
+
+func TestBreaker_HalfOpen(t *testing.T) {
+	b := NewBreaker("http://a", BreakerConfig{ErrorRate: 1, OpenTime: 20 * time.Millisecond, HalfOpenRequests: 2})
+
+	b.Allow()
+	b.Record(true, 0)
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected %v, got %v", ErrCircuitOpen, err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !b.Ready() {
+		t.Fatalf("expected breaker to be ready after the open time")
+	}
+
+	// only HalfOpenRequests probes are let through at once
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expected first probe to be allowed, got %v", err)
+	}
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expected second probe to be allowed, got %v", err)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected third probe to be rejected, got %v", err)
+	}
+	if b.Status().State != "half_open" {
+		t.Fatalf("expected half_open, got %s", b.Status().State)
+	}
+
+	b.Record(false, 0)
+	b.Record(false, 0)
+	if b.Status().State != "closed" {
+		t.Errorf("expected successful probes to close the breaker, got %s", b.Status().State)
+	}
+
+	// a failed probe opens the breaker again
+	b.Allow()
+	b.Record(true, 0)
+	time.Sleep(30 * time.Millisecond)
+	b.Allow()
+	b.Record(true, 0)
+	if b.Status().State != "open" {
+		t.Errorf("expected failed probe to reopen the breaker, got %s", b.Status().State)
+	}
+}
+
+func TestPool_Breakers(t *testing.T) {
+	breakers := NewBreakers(BreakerConfig{ErrorRate: 1, OpenTime: time.Hour})
+	pool, err := NewPool(Config{Origins: []string{"http://a", "http://b"}, Breakers: breakers})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := breakers.Get("http://a")
+	a.Allow()
+	a.Record(true, 0)
+
+	for range 4 {
+		m, err := pool.Pick("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.URL.String() != "http://b" {
+			t.Errorf("expected %s, got %s", "http://b", m.URL)
+		}
+		pool.Release(m)
+	}
+
+	b := breakers.Get("http://b")
+	b.Allow()
+	b.Record(true, 0)
+	if _, err := pool.Pick(""); !errors.Is(err, ErrNoHealthyMember) {
+		t.Errorf("expected %v, got %v", ErrNoHealthyMember, err)
+	}
+	if status := breakers.Status(); len(status) != 2 || status[0].State != "open" {
+		t.Errorf("expected 2 open breakers, got %+v", status)
+	}
+}
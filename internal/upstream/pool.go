@@ -0,0 +1,370 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// RoundRobin hands out members in turn.
+	RoundRobin = "round_robin"
+	// LeastConn picks the member with the fewest requests in flight.
+	LeastConn = "least_conn"
+	// ConsistentHash picks the same member for the same key while it is available.
+	ConsistentHash = "consistent_hash"
+)
+
+// DefaultHealthCheckTimeout is the longest default timeout of a health
+// check, so that an origin hanging after accepting the connection fails it.
+const DefaultHealthCheckTimeout = 5 * time.Second
+
+// ErrNoHealthyMember is returned when every member of a pool is unhealthy or ejected.
+var ErrNoHealthyMember = errors.New("upstream: no healthy member")
+
+// HealthCheck configures the active health checks of a pool. A zero Interval
+// disables them.
+type HealthCheck struct {
+	// Path is requested on every member, a 2xx or 3xx status means healthy.
+	Path string
+	// Interval is the time between two checks of a member.
+	Interval time.Duration
+	// Timeout bounds a single check. It defaults to Interval, up to
+	// DefaultHealthCheckTimeout.
+	Timeout time.Duration
+	// HealthyThreshold is the number of consecutive successes to re-admit a member.
+	HealthyThreshold int
+	// UnhealthyThreshold is the number of consecutive failures to mark a member unhealthy.
+	UnhealthyThreshold int
+}
+
+// OutlierDetection configures the passive ejection of members failing live
+// traffic. A zero ConsecutiveFailures disables it.
+type OutlierDetection struct {
+	// ConsecutiveFailures is the number of 5xx responses or errors in a row that eject a member.
+	ConsecutiveFailures int
+	// EjectionTime is how long an ejected member receives no traffic.
+	EjectionTime time.Duration
+}
+
+// Config configures a Pool.
+type Config struct {
+	// Origins lists the members of the pool.
+	Origins []string
+	// Balancer is one of RoundRobin (the default), LeastConn or ConsistentHash.
+	Balancer         string
+	HealthCheck      HealthCheck
+	OutlierDetection OutlierDetection
+	// Breakers, if set, keeps traffic away from members whose circuit breaker is open.
+	Breakers *Breakers
+	// Transport sends the health checks, nil uses http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+// Member is an origin server of a pool.
+type Member struct {
+	URL *url.URL
+
+	active atomic.Int64
+
+	mu           sync.Mutex
+	healthy      bool
+	checkStreak  int
+	failures     int
+	ejectedUntil time.Time
+}
+
+// MemberStatus is a snapshot of the state of a member.
+type MemberStatus struct {
+	URL          string    `json:"url"`
+	Healthy      bool      `json:"healthy"`
+	Ejected      bool      `json:"ejected"`
+	EjectedUntil time.Time `json:"ejected_until,omitempty"`
+	Active       int64     `json:"active"`
+}
+
+// available reports whether the member may receive traffic at now.
+func (m *Member) available(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.healthy && !now.Before(m.ejectedUntil)
+}
+
+// Pool balances requests over a set of origin servers.
+type Pool struct {
+	members     []*Member
+	balancer    string
+	healthCheck HealthCheck
+	outlier     OutlierDetection
+	breakers    *Breakers
+	next        atomic.Uint64
+	client      *http.Client
+}
+
+// NewPool creates a pool of the configured origins. Every member starts healthy.
+func NewPool(cfg Config) (*Pool, error) {
+	if len(cfg.Origins) == 0 {
+		return nil, errors.New("upstream: at least one origin is required")
+	}
+	switch cfg.Balancer {
+	case "":
+		cfg.Balancer = RoundRobin
+	case RoundRobin, LeastConn, ConsistentHash:
+	default:
+		return nil, fmt.Errorf("upstream: unknown balancer %q", cfg.Balancer)
+	}
+
+	if cfg.HealthCheck.Timeout <= 0 {
+		cfg.HealthCheck.Timeout = DefaultHealthCheckTimeout
+		if cfg.HealthCheck.Interval > 0 {
+			cfg.HealthCheck.Timeout = min(cfg.HealthCheck.Interval, DefaultHealthCheckTimeout)
+		}
+	}
+
+	pool := &Pool{
+		balancer:    cfg.Balancer,
+		healthCheck: cfg.HealthCheck,
+		outlier:     cfg.OutlierDetection,
+		breakers:    cfg.Breakers,
+		client:      &http.Client{Timeout: cfg.HealthCheck.Timeout, Transport: cfg.Transport},
+	}
+	if pool.healthCheck.HealthyThreshold <= 0 {
+		pool.healthCheck.HealthyThreshold = 1
+	}
+	if pool.healthCheck.UnhealthyThreshold <= 0 {
+		pool.healthCheck.UnhealthyThreshold = 1
+	}
+	for _, origin := range cfg.Origins {
+		u, err := ParseOrigin(origin)
+		if err != nil {
+			return nil, err
+		}
+		pool.members = append(pool.members, &Member{URL: u, healthy: true})
+	}
+	return pool, nil
+}
+
+// ParseOrigin parses an origin, defaulting to the http scheme when it has none.
+func ParseOrigin(origin string) (*url.URL, error) {
+	// if origin is hostname:port, add default scheme http for url.Parse recognize it as url
+	if !strings.Contains(origin, "://") && strings.Contains(origin, ":") {
+		origin = "http://" + origin
+	}
+
+	parsedOrigin, err := url.Parse(origin)
+	if err != nil {
+		return nil, fmt.Errorf("invalid origin: %s", err)
+	}
+
+	if parsedOrigin.Scheme == "" {
+		parsedOrigin.Scheme = "http"
+	}
+	// a bare host name is parsed as a path
+	if parsedOrigin.Host == "" && parsedOrigin.Path != "" && !strings.HasPrefix(parsedOrigin.Path, "/") {
+		host, path, _ := strings.Cut(parsedOrigin.Path, "/")
+		parsedOrigin.Host = host
+		parsedOrigin.Path = strings.TrimSuffix("/"+path, "/")
+	}
+	return parsedOrigin, nil
+}
+
+// Pick selects the member that serves the next request. key is only used by
+// the ConsistentHash balancer, which picks in turn when it is empty. Callers
+// must call Done with the outcome.
+func (p *Pool) Pick(key string) (*Member, error) {
+	return p.pick(key, nil)
+}
+
+// PickExcept is like Pick but avoids the given member if another one is
+// available, so that a retry goes to a different server.
+func (p *Pool) PickExcept(key string, except *Member) (*Member, error) {
+	return p.pick(key, except)
+}
+
+func (p *Pool) pick(key string, except *Member) (*Member, error) {
+	now := time.Now()
+	candidates := make([]*Member, 0, len(p.members))
+	for _, m := range p.members {
+		if m != except && p.available(m, now) {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 && except != nil && p.available(except, now) {
+		candidates = append(candidates, except)
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoHealthyMember
+	}
+
+	balancer := p.balancer
+	if balancer == ConsistentHash && key == "" {
+		// requests without a key, such as bypassed ones, would all hash to
+		// the same member
+		balancer = RoundRobin
+	}
+
+	var m *Member
+	switch balancer {
+	case LeastConn:
+		m = candidates[0]
+		for _, c := range candidates[1:] {
+			if c.active.Load() < m.active.Load() {
+				m = c
+			}
+		}
+	case ConsistentHash:
+		// rendezvous hashing keeps keys on their member when others come and go
+		var best uint64
+		for _, c := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(c.URL.String()))
+			h.Write([]byte(key))
+			if score := h.Sum64(); m == nil || score > best {
+				m, best = c, score
+			}
+		}
+	default:
+		m = candidates[p.next.Add(1)%uint64(len(candidates))]
+	}
+	m.active.Add(1)
+	return m, nil
+}
+
+// Release returns a member picked for a request that was not sent.
+func (p *Pool) Release(m *Member) {
+	m.active.Add(-1)
+}
+
+// Done records the outcome of a request sent to m. failed is true for
+// transport errors, timeouts and 5xx responses.
+func (p *Pool) Done(m *Member, failed bool) {
+	m.active.Add(-1)
+	if p.outlier.ConsecutiveFailures <= 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !failed {
+		m.failures = 0
+		return
+	}
+	m.failures++
+	if m.failures >= p.outlier.ConsecutiveFailures {
+		m.failures = 0
+		m.ejectedUntil = time.Now().Add(p.outlier.EjectionTime)
+		slog.Warn("upstream: ejecting origin", "origin", m.URL.String(), "until", m.ejectedUntil.Format(time.RFC3339))
+	}
+}
+
+// Healthy reports whether at least one member may receive traffic.
+func (p *Pool) Healthy() bool {
+	now := time.Now()
+	for _, m := range p.members {
+		if p.available(m, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// available reports whether m may receive traffic at now, taking its circuit
+// breaker into account.
+func (p *Pool) available(m *Member, now time.Time) bool {
+	return m.available(now) && p.breakers.Get(m.URL.String()).Ready()
+}
+
+// Status returns a snapshot of every member.
+func (p *Pool) Status() []MemberStatus {
+	now := time.Now()
+	status := make([]MemberStatus, 0, len(p.members))
+	for _, m := range p.members {
+		m.mu.Lock()
+		s := MemberStatus{
+			URL:     m.URL.String(),
+			Healthy: m.healthy,
+			Ejected: now.Before(m.ejectedUntil),
+			Active:  m.active.Load(),
+		}
+		if s.Ejected {
+			s.EjectedUntil = m.ejectedUntil
+		}
+		m.mu.Unlock()
+		status = append(status, s)
+	}
+	return status
+}
+
+// Start runs the active health checks until ctx is done. It returns
+// immediately when health checks are disabled.
+func (p *Pool) Start(ctx context.Context) {
+	if p.healthCheck.Interval <= 0 {
+		return
+	}
+	for _, m := range p.members {
+		go p.checkLoop(ctx, m)
+	}
+}
+
+func (p *Pool) checkLoop(ctx context.Context, m *Member) {
+	ticker := time.NewTicker(p.healthCheck.Interval)
+	defer ticker.Stop()
+	for {
+		p.check(ctx, m)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check probes m once and updates its health.
+func (p *Pool) check(ctx context.Context, m *Member) {
+	ok := p.probe(ctx, m)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// checkStreak counts consecutive results contradicting the current state
+	if ok == m.healthy {
+		m.checkStreak = 0
+		return
+	}
+	m.checkStreak++
+	threshold := p.healthCheck.UnhealthyThreshold
+	if ok {
+		threshold = p.healthCheck.HealthyThreshold
+	}
+	if m.checkStreak >= threshold {
+		m.healthy = ok
+		m.checkStreak = 0
+		if ok {
+			slog.Info("upstream: health check passing again, re-admitting origin", "origin", m.URL.String())
+		} else {
+			slog.Warn("upstream: health check failing, marking origin unhealthy", "origin", m.URL.String())
+		}
+	}
+}
+
+func (p *Pool) probe(ctx context.Context, m *Member) bool {
+	target := *m.URL
+	target.Path = strings.TrimSuffix(target.Path, "/") + p.healthCheck.Path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
@@ -0,0 +1,301 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseOrigin(t *testing.T) {
+	tests := []struct {
+		name        string
+		origin      string
+		expectedURL string
+		expectError bool
+	}{
+		{
+			name:        "valid URL with scheme",
+			origin:      "http://example.com",
+			expectedURL: "http://example.com",
+			expectError: false,
+		},
+		{
+			name:        "valid URL without scheme",
+			origin:      "example.com",
+			expectedURL: "http://example.com",
+			expectError: false,
+		},
+		{
+			name:        "valid URL without scheme and port",
+			origin:      "example:80",
+			expectedURL: "http://example:80",
+			expectError: false,
+		},
+		{
+			name:        "invalid URL",
+			origin:      "://example.com",
+			expectedURL: "",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ParseOrigin(tt.origin)
+			if (err != nil) != tt.expectError {
+				t.Errorf("expected error: %v, got: %v", tt.expectError, err)
+			}
+			if err == nil && result.String() != tt.expectedURL {
+				t.Errorf("expected URL: %s, got: %s", tt.expectedURL, result)
+			}
+		})
+	}
+}
+
+func TestPool_RoundRobin(t *testing.T) {
+	pool, err := NewPool(Config{Origins: []string{"http://a", "http://b", "http://c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 9; i++ {
+		m, err := pool.Pick("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[m.URL.Host]++
+		pool.Done(m, false)
+	}
+	for _, host := range []string{"a", "b", "c"} {
+		if counts[host] != 3 {
+			t.Errorf("expected 3 requests to %s, got %d", host, counts[host])
+		}
+	}
+}
+
+func TestPool_LeastConn(t *testing.T) {
+	pool, err := NewPool(Config{Origins: []string{"http://a", "http://b"}, Balancer: LeastConn})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := pool.Pick("")
+	second, _ := pool.Pick("")
+	if first == second {
+		t.Fatalf("expected the second request to go to the idle member")
+	}
+	pool.Done(first, false)
+
+	third, _ := pool.Pick("")
+	if third != first {
+		t.Errorf("expected %s, got %s", first.URL, third.URL)
+	}
+}
+
+func TestPool_ConsistentHash(t *testing.T) {
+	pool, err := NewPool(Config{
+		Origins:          []string{"http://a", "http://b", "http://c"},
+		Balancer:         ConsistentHash,
+		OutlierDetection: OutlierDetection{ConsecutiveFailures: 1, EjectionTime: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owners := map[string]*Member{}
+	for _, key := range []string{"GET/a", "GET/b", "GET/c", "GET/d", "GET/e", "GET/f"} {
+		m, _ := pool.Pick(key)
+		pool.Done(m, false)
+		owners[key] = m
+		if again, _ := pool.Pick(key); again != m {
+			t.Errorf("expected key %s to stay on %s, got %s", key, m.URL, again.URL)
+		}
+		pool.Done(m, false)
+	}
+
+	// ejecting a member only moves the keys it owned
+	ejected := owners["GET/a"]
+	m, _ := pool.Pick("GET/a")
+	pool.Done(m, true)
+	for key, owner := range owners {
+		m, _ := pool.Pick(key)
+		pool.Done(m, false)
+		if owner != ejected && m != owner {
+			t.Errorf("expected key %s to stay on %s, got %s", key, owner.URL, m.URL)
+		}
+		if m == ejected {
+			t.Errorf("expected key %s to move off the ejected member", key)
+		}
+	}
+}
+
+func TestPool_ConsistentHashEmptyKey(t *testing.T) {
+	pool, err := NewPool(Config{
+		Origins:  []string{"http://a", "http://b", "http://c"},
+		Balancer: ConsistentHash,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	picked := map[*Member]int{}
+	for i := 0; i < 6; i++ {
+		m, err := pool.Pick("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.Done(m, false)
+		picked[m]++
+	}
+	if len(picked) != 3 {
+		t.Errorf("expected requests without a key to spread over 3 members, got %d", len(picked))
+	}
+}
+
+func TestPool_OutlierDetection(t *testing.T) {
+	pool, err := NewPool(Config{
+		Origins:          []string{"http://a", "http://b"},
+		OutlierDetection: OutlierDetection{ConsecutiveFailures: 2, EjectionTime: 50 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := pool.members[0]
+
+	pool.Done(pickMember(t, pool, bad), true)
+	if !bad.available(time.Now()) {
+		t.Fatalf("expected member to stay available after a single failure")
+	}
+	pool.Done(pickMember(t, pool, bad), true)
+	if bad.available(time.Now()) {
+		t.Fatalf("expected member to be ejected after consecutive failures")
+	}
+	for i := 0; i < 4; i++ {
+		m, _ := pool.Pick("")
+		if m == bad {
+			t.Errorf("expected ejected member to receive no traffic")
+		}
+		pool.Done(m, false)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !bad.available(time.Now()) {
+		t.Errorf("expected member to be re-admitted after the ejection time")
+	}
+
+	// with every member ejected the pool has nothing to offer
+	single, _ := NewPool(Config{
+		Origins:          []string{"http://a"},
+		OutlierDetection: OutlierDetection{ConsecutiveFailures: 1, EjectionTime: time.Minute},
+	})
+	m, _ := single.Pick("")
+	single.Done(m, true)
+	if _, err := single.Pick(""); !errors.Is(err, ErrNoHealthyMember) {
+		t.Errorf("expected ErrNoHealthyMember, got %v", err)
+	}
+	if single.Healthy() {
+		t.Errorf("expected pool not to be healthy")
+	}
+}
+
+func TestPool_HealthCheck(t *testing.T) {
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pool, err := NewPool(Config{
+		Origins: []string{server.URL},
+		HealthCheck: HealthCheck{
+			Path:               "/healthz",
+			Interval:           time.Hour,
+			Timeout:            time.Second,
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 2,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := pool.members[0]
+	ctx := context.Background()
+
+	failing.Store(true)
+	pool.check(ctx, m)
+	if !pool.Healthy() {
+		t.Fatalf("expected member to stay healthy below the unhealthy threshold")
+	}
+	pool.check(ctx, m)
+	if pool.Healthy() {
+		t.Fatalf("expected member to be unhealthy after reaching the threshold")
+	}
+
+	failing.Store(false)
+	pool.check(ctx, m)
+	if pool.Healthy() {
+		t.Fatalf("expected member to stay unhealthy below the healthy threshold")
+	}
+	pool.check(ctx, m)
+	if !pool.Healthy() {
+		t.Fatalf("expected member to be re-admitted after reaching the threshold")
+	}
+}
+
+func TestPool_HealthCheckTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// accepts the connection, then hangs
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	pool, err := NewPool(Config{
+		Origins:     []string{server.URL},
+		HealthCheck: HealthCheck{Path: "/healthz", Interval: 50 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pool.check(context.Background(), pool.members[0])
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the check to time out")
+	}
+	if pool.Healthy() {
+		t.Errorf("expected the hanging member to be unhealthy")
+	}
+}
+
+// pickMember picks from pool until it gets want.
+func pickMember(t *testing.T, pool *Pool, want *Member) *Member {
+	t.Helper()
+	for i := 0; i < len(pool.members); i++ {
+		m, err := pool.Pick("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m == want {
+			return m
+		}
+		pool.Done(m, false)
+	}
+	t.Fatalf("member %s was never picked", want.URL)
+	return nil
+}
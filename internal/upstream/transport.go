@@ -0,0 +1,97 @@
+package upstream
+
+import (
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TransportConfig configures the connections to the origin servers. A zero
+// timeout means no timeout.
+type TransportConfig struct {
+	// ConnectTimeout bounds establishing the TCP connection.
+	ConnectTimeout time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake.
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds waiting for the response headers once the request is sent.
+	ResponseHeaderTimeout time.Duration
+	// IdleConnTimeout is how long an idle keep-alive connection is kept open.
+	IdleConnTimeout time.Duration
+	// MaxIdleConnsPerHost is the number of idle keep-alive connections kept per origin.
+	MaxIdleConnsPerHost int
+}
+
+// NewTransport returns an http.Transport tuned for talking to origin servers.
+func NewTransport(cfg TransportConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// Backoff returns the delay before retry number attempt (starting at 0): an
+// exponential backoff from base capped at maxDelay, with full jitter.
+func Backoff(attempt int, base, maxDelay time.Duration) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	d := base << min(attempt, 30)
+	if d <= 0 || (maxDelay > 0 && d > maxDelay) {
+		d = maxDelay
+	}
+	if d <= 0 {
+		d = base
+	}
+	return rand.N(d) + 1
+}
+
+// RetryBudget bounds the share of retries across all requests, so that
+// retries cannot multiply the load on an origin that is already failing.
+// Every request earns ratio tokens, every retry spends one.
+type RetryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+	max    float64
+}
+
+// NewRetryBudget returns a budget allowing retries for ratio of the requests,
+// with up to burst retries saved up.
+func NewRetryBudget(ratio float64, burst int) *RetryBudget {
+	return &RetryBudget{
+		ratio:  ratio,
+		tokens: float64(burst),
+		max:    float64(burst),
+	}
+}
+
+// Request records a new request.
+func (b *RetryBudget) Request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.max, b.tokens+b.ratio)
+}
+
+// Withdraw reports whether a retry is allowed, spending from the budget if so.
+func (b *RetryBudget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,65 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt  int
+		base     time.Duration
+		maxDelay time.Duration
+		limit    time.Duration
+	}{
+		{attempt: 0, base: 10 * time.Millisecond, maxDelay: time.Second, limit: 10 * time.Millisecond},
+		{attempt: 3, base: 10 * time.Millisecond, maxDelay: time.Second, limit: 80 * time.Millisecond},
+		{attempt: 10, base: 10 * time.Millisecond, maxDelay: time.Second, limit: time.Second},
+		{attempt: 100, base: 10 * time.Millisecond, maxDelay: time.Second, limit: time.Second},
+		{attempt: 2, base: 0, maxDelay: time.Second, limit: 0},
+	}
+
+	for _, tt := range tests {
+		for range 100 {
+			d := Backoff(tt.attempt, tt.base, tt.maxDelay)
+			if d < 0 || d > tt.limit {
+				t.Fatalf("attempt %d: expected backoff in [0, %v], got %v", tt.attempt, tt.limit, d)
+			}
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := NewRetryBudget(0.5, 2)
+
+	// the burst is available up front
+	if !budget.Withdraw() || !budget.Withdraw() {
+		t.Fatal("expected the burst to allow 2 retries")
+	}
+	if budget.Withdraw() {
+		t.Fatal("expected the budget to be exhausted")
+	}
+
+	// two requests earn one retry
+	budget.Request()
+	if budget.Withdraw() {
+		t.Error("expected half a token to allow no retry")
+	}
+	budget.Request()
+	budget.Request()
+	if !budget.Withdraw() {
+		t.Error("expected the earned token to allow a retry")
+	}
+
+	// the saved tokens are capped by the burst
+	for range 100 {
+		budget.Request()
+	}
+	allowed := 0
+	for budget.Withdraw() {
+		allowed++
+	}
+	if allowed != 2 {
+		t.Errorf("expected %d retries, got %d", 2, allowed)
+	}
+}